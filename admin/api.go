@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/danii7514/codpen/commons"
+	"github.com/danii7514/codpen/crdt"
+)
+
+// requestTimeout bounds how long a request to the server may take.
+const requestTimeout = 30 * time.Second
+
+// A roomSummary describes a room in a room listing.
+type roomSummary struct {
+	Name      string `json:"name"`
+	ID        string `json:"id"`
+	Clients   int    `json:"clients"`
+	Protected bool   `json:"protected"`
+}
+
+// A roomDetails describes a single room.
+type roomDetails struct {
+	roomSummary
+	Participants []participant `json:"participants"`
+	Text         string        `json:"text"`
+}
+
+// A participant describes a client connected to a room.
+type participant struct {
+	ID       string       `json:"id"`
+	Username string       `json:"username"`
+	SiteID   string       `json:"siteID"`
+	Role     commons.Role `json:"role"`
+}
+
+// A ban keeps users out of a room.
+type ban struct {
+	ID       string     `json:"id"`
+	Username string     `json:"username,omitempty"`
+	Subject  string     `json:"subject,omitempty"`
+	Address  string     `json:"address,omitempty"`
+	Reason   string     `json:"reason,omitempty"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+}
+
+// A banRequest asks the server to ban users from a room.
+type banRequest struct {
+	Username string `json:"username,omitempty"`
+	Subject  string `json:"subject,omitempty"`
+	Address  string `json:"address,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Duration string `json:"duration,omitempty"`
+}
+
+// A banResponse describes a new ban, and how many participants it kicked.
+type banResponse struct {
+	ban
+	Kicked int `json:"kicked"`
+}
+
+// An auditEntry records a change to a room's document.
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	Seq       uint64    `json:"seq"`
+	User      string    `json:"user,omitempty"`
+	Client    string    `json:"client,omitempty"`
+	Site      string    `json:"site,omitempty"`
+	Node      string    `json:"node,omitempty"`
+	Type      string    `json:"type"`
+	Position  int       `json:"position,omitempty"`
+	Character string    `json:"character,omitempty"`
+	Text      string    `json:"text"`
+}
+
+// A contribution is what a user wrote in a room.
+type contribution struct {
+	User     string `json:"user"`
+	Inserted int    `json:"inserted"`
+	Deleted  int    `json:"deleted"`
+	Text     string `json:"text"`
+}
+
+// An apiClient makes requests to the server's room management API.
+type apiClient struct {
+	http  *http.Client
+	base  string
+	token string
+}
+
+// newAPIClient returns a client of the API reached as given by flags.
+func newAPIClient(flags Flags) (*apiClient, error) {
+	c := &apiClient{http: &http.Client{Timeout: requestTimeout}, base: strings.TrimSuffix(flags.Server, "/")}
+
+	if flags.Socket != "" {
+		// Requests on the admin socket need no token, and the host is ignored.
+		socket := flags.Socket
+		c.http.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+		c.base = "http://codpen"
+		return c, nil
+	}
+
+	var err error
+	if c.token, err = readToken(flags); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// rooms lists the rooms.
+func (c *apiClient) rooms() ([]roomSummary, error) {
+	var resp struct {
+		Rooms []roomSummary `json:"rooms"`
+	}
+	err := c.do(http.MethodGet, "/rooms", http.StatusOK, &resp)
+	return resp.Rooms, err
+}
+
+// room returns the details of a room.
+func (c *apiClient) room(name string) (roomDetails, error) {
+	var room roomDetails
+	err := c.do(http.MethodGet, roomPath(name), http.StatusOK, &room)
+	return room, err
+}
+
+// document returns the CRDT document of a room.
+func (c *apiClient) document(name string) (crdt.Document, error) {
+	var doc crdt.Document
+	err := c.do(http.MethodGet, roomPath(name)+"/content?format=json", http.StatusOK, &doc)
+	return doc, err
+}
+
+// findClient returns the ID of the participant of a room given by user, which
+// is either a client ID or a username.
+func (c *apiClient) findClient(name, user string) (string, error) {
+	room, err := c.room(name)
+	if err != nil {
+		return "", err
+	}
+
+	var ids []string
+	for _, p := range room.Participants {
+		if p.ID == user {
+			return p.ID, nil
+		}
+		if p.Username == user {
+			ids = append(ids, p.ID)
+		}
+	}
+	switch len(ids) {
+	case 0:
+		return "", fmt.Errorf("no participant %q in %s", user, name)
+	case 1:
+		return ids[0], nil
+	default:
+		return "", fmt.Errorf("%d participants are named %q in %s, give a client ID instead: %s", len(ids), user, name, strings.Join(ids, ", "))
+	}
+}
+
+// kick disconnects a participant of a room, telling them reason if not empty.
+func (c *apiClient) kick(name, id, reason string) error {
+	path := roomPath(name) + "/clients/" + url.PathEscape(id)
+	if reason != "" {
+		path += "?reason=" + url.QueryEscape(reason)
+	}
+	return c.do(http.MethodDelete, path, http.StatusNoContent, nil)
+}
+
+// bans lists the bans in effect in a room.
+func (c *apiClient) bans(name string) ([]ban, error) {
+	var resp struct {
+		Bans []ban `json:"bans"`
+	}
+	err := c.doJSON(http.MethodGet, roomPath(name)+"/bans", nil, http.StatusOK, &resp)
+	return resp.Bans, err
+}
+
+// ban bans users from a room, kicking those connected.
+func (c *apiClient) ban(name string, req banRequest) (banResponse, error) {
+	var resp banResponse
+	err := c.doJSON(http.MethodPost, roomPath(name)+"/bans", req, http.StatusCreated, &resp)
+	return resp, err
+}
+
+// unban lifts a ban from a room.
+func (c *apiClient) unban(name, id string) error {
+	return c.do(http.MethodDelete, roomPath(name)+"/bans/"+url.PathEscape(id), http.StatusNoContent, nil)
+}
+
+// closeRoom closes a room.
+func (c *apiClient) closeRoom(name string) error {
+	return c.do(http.MethodDelete, roomPath(name), http.StatusNoContent, nil)
+}
+
+// snapshot makes the server write a snapshot of a room, and returns its file.
+func (c *apiClient) snapshot(name string) (string, error) {
+	var resp struct {
+		File string `json:"file"`
+	}
+	err := c.doJSON(http.MethodPost, roomPath(name)+"/snapshot", struct{}{}, http.StatusCreated, &resp)
+	return resp.File, err
+}
+
+// audit queries the audit log of a room. query holds the user, since and until
+// filters, if set.
+func (c *apiClient) audit(name string, query url.Values) ([]auditEntry, error) {
+	var resp struct {
+		Entries []auditEntry `json:"entries"`
+	}
+	err := c.do(http.MethodGet, roomPath(name)+"/audit?"+query.Encode(), http.StatusOK, &resp)
+	return resp.Entries, err
+}
+
+// contributions returns what a user wrote in a room.
+func (c *apiClient) contributions(name, user string) (contribution, error) {
+	var resp contribution
+	err := c.do(http.MethodGet, roomPath(name)+"/audit/contributions?user="+url.QueryEscape(user), http.StatusOK, &resp)
+	return resp, err
+}
+
+// do makes a request to the API, and decodes the response into v, if not nil.
+// A response without the status want is an error.
+func (c *apiClient) do(method, path string, want int, v interface{}) error {
+	return c.doJSON(method, path, nil, want, v)
+}
+
+// doJSON is like do, sending body as JSON if not nil.
+func (c *apiClient) doJSON(method, path string, body interface{}, want int, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.base+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != want {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&apiErr) == nil && apiErr.Error != "" {
+			return fmt.Errorf("%s: %s", resp.Status, apiErr.Error)
+		}
+		return errors.New(resp.Status)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// roomPath returns the API path of a room.
+func roomPath(name string) string {
+	return "/rooms/" + url.PathEscape(name)
+}
+
+// writeJSON writes v as indented JSON.
+func writeJSON(out io.Writer, v interface{}) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// writeTable writes a table with the given header, whose rows are added by rows.
+func writeTable(out io.Writer, header []string, rows func(row func(...interface{}))) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	rows(func(values ...interface{}) {
+		cells := make([]string, len(values))
+		for i, v := range values {
+			cells[i] = fmt.Sprint(v)
+		}
+		fmt.Fprintln(w, strings.Join(cells, "\t"))
+	})
+	return w.Flush()
+}
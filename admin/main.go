@@ -0,0 +1,355 @@
+// Command codpen-admin manages the rooms of a running codpen server, through its
+// admin socket or its room management API.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// usage describes the commands.
+const usage = `Usage: codpen-admin [flags] <command> [arguments]
+
+Commands:
+  rooms                  list rooms
+  users <room>           list the participants of a room
+  dump <room>            print the text of a room, or its CRDT document with -json
+  kick [-reason text] <room> <user>
+                         disconnect a participant, given by client ID or username
+  ban [-for 1h] [-reason text] <room> <target>
+                         ban users and kick those connected; target is
+                         user:NAME, subject:NAME or addr:IP[/BITS], and a bare
+                         NAME is a username; bans are permanent without -for
+  bans <room>            list the bans in effect in a room
+  unban <room> <id>      lift a ban
+  audit [-user NAME] [-since TIME] [-until TIME] <room>
+                         list the changes recorded in a room's audit log;
+                         times are RFC 3339, or durations like 2h meaning ago
+  contributions <room> <user>
+                         print the text a user wrote that is still in a room
+  close <room>           close a room, disconnecting its participants
+  snapshot <room>        write a room's document to the server's snapshot directory
+
+Flags:
+`
+
+// Flags represents the command-line flags that are passed to codpen-admin.
+type Flags struct {
+	// Socket is the path of the server's admin socket. Server is the address of
+	// the server, used when Socket is empty.
+	Socket string
+	Server string
+
+	// Token is the access token, with the admin claim, presented to the server
+	// when it isn't reached through its admin socket. TokenFile, if set, names a
+	// file to read the token from instead.
+	Token     string
+	TokenFile string
+
+	// JSON prints the server's responses as JSON instead of tables.
+	JSON bool
+}
+
+func main() {
+	flags, args := parseFlags(os.Args[1:], os.Stderr)
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	client, err := newAPIClient(flags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "codpen-admin: %s\n", err)
+		os.Exit(1)
+	}
+
+	if err := run(client, flags, args, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "codpen-admin: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// parseFlags parses command-line flags, and returns them with the command and
+// its arguments.
+func parseFlags(arguments []string, out io.Writer) (Flags, []string) {
+	fs := flag.NewFlagSet("codpen-admin", flag.ExitOnError)
+	fs.SetOutput(out)
+	fs.Usage = func() {
+		fmt.Fprint(out, usage)
+		fs.PrintDefaults()
+	}
+	flag.Usage = fs.Usage
+
+	socket := fs.String("socket", os.Getenv("CODPEN_ADMIN_SOCKET"), "Path of the server's admin socket (default $CODPEN_ADMIN_SOCKET)")
+	server := fs.String("server", "http://localhost:8084", "URL of the server, used without -socket")
+	token := fs.String("token", os.Getenv("CODPEN_TOKEN"), "Admin access token, used without -socket (default $CODPEN_TOKEN)")
+	tokenFile := fs.String("token-file", "", "The file to read the admin access token from")
+	jsonOutput := fs.Bool("json", false, "Print JSON instead of tables")
+
+	_ = fs.Parse(arguments)
+
+	return Flags{
+		Socket:    *socket,
+		Server:    *server,
+		Token:     *token,
+		TokenFile: *tokenFile,
+		JSON:      *jsonOutput,
+	}, fs.Args()
+}
+
+// run runs the command given by args, writing its output to out.
+func run(client *apiClient, flags Flags, args []string, out io.Writer) error {
+	command, args := args[0], args[1:]
+
+	want := map[string]int{"rooms": 0, "users": 1, "dump": 1, "kick": 2, "ban": 2, "bans": 1, "unban": 2, "audit": 1, "contributions": 2, "close": 1, "snapshot": 1}
+	n, ok := want[command]
+	if !ok {
+		return fmt.Errorf("unknown command %q, see codpen-admin -h", command)
+	}
+
+	// kick, ban and audit take their own flags, before their arguments.
+	var reason, duration, user, since, until string
+	if command == "kick" || command == "ban" || command == "audit" {
+		fs := flag.NewFlagSet(command, flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		if command == "audit" {
+			fs.StringVar(&user, "user", "", "")
+			fs.StringVar(&since, "since", "", "")
+			fs.StringVar(&until, "until", "", "")
+		} else {
+			fs.StringVar(&reason, "reason", "", "")
+		}
+		if command == "ban" {
+			fs.StringVar(&duration, "for", "", "")
+		}
+		if err := fs.Parse(args); err != nil {
+			return fmt.Errorf("%s: %w", command, err)
+		}
+		args = fs.Args()
+	}
+	if len(args) != n {
+		return fmt.Errorf("%s takes %d argument(s), got %d", command, n, len(args))
+	}
+
+	switch command {
+	case "rooms":
+		rooms, err := client.rooms()
+		if err != nil {
+			return err
+		}
+		if flags.JSON {
+			return writeJSON(out, rooms)
+		}
+		return writeTable(out, []string{"NAME", "CLIENTS", "PROTECTED", "ID"}, func(row func(...interface{})) {
+			for _, room := range rooms {
+				row(room.Name, room.Clients, room.Protected, room.ID)
+			}
+		})
+
+	case "users":
+		room, err := client.room(args[0])
+		if err != nil {
+			return err
+		}
+		if flags.JSON {
+			return writeJSON(out, room.Participants)
+		}
+		return writeTable(out, []string{"USERNAME", "ROLE", "SITE", "ID"}, func(row func(...interface{})) {
+			for _, p := range room.Participants {
+				row(p.Username, p.Role, p.SiteID, p.ID)
+			}
+		})
+
+	case "dump":
+		if flags.JSON {
+			doc, err := client.document(args[0])
+			if err != nil {
+				return err
+			}
+			return writeJSON(out, doc)
+		}
+		room, err := client.room(args[0])
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(out, room.Text)
+		return err
+
+	case "kick":
+		id, err := client.findClient(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		if err := client.kick(args[0], id, reason); err != nil {
+			return err
+		}
+		return report(out, flags, map[string]string{"kicked": id}, "Kicked %s from %s\n", args[1], args[0])
+
+	case "ban":
+		req, err := parseBanTarget(args[1])
+		if err != nil {
+			return err
+		}
+		req.Reason, req.Duration = reason, duration
+		resp, err := client.ban(args[0], req)
+		if err != nil {
+			return err
+		}
+		return report(out, flags, resp, "Banned %s from %s with ban %s, kicking %d participant(s)\n", args[1], args[0], resp.ID, resp.Kicked)
+
+	case "bans":
+		bans, err := client.bans(args[0])
+		if err != nil {
+			return err
+		}
+		if flags.JSON {
+			return writeJSON(out, bans)
+		}
+		return writeTable(out, []string{"ID", "TARGET", "EXPIRES", "REASON"}, func(row func(...interface{})) {
+			for _, b := range bans {
+				expires := "never"
+				if b.Expires != nil {
+					expires = b.Expires.Format(time.RFC3339)
+				}
+				row(b.ID, banTarget(b), expires, b.Reason)
+			}
+		})
+
+	case "unban":
+		if err := client.unban(args[0], args[1]); err != nil {
+			return err
+		}
+		return report(out, flags, map[string]string{"unbanned": args[1]}, "Lifted ban %s from %s\n", args[1], args[0])
+
+	case "audit":
+		query := url.Values{}
+		if user != "" {
+			query.Set("user", user)
+		}
+		for param, value := range map[string]string{"since": since, "until": until} {
+			if value == "" {
+				continue
+			}
+			t, err := parseTime(value, time.Now())
+			if err != nil {
+				return err
+			}
+			query.Set(param, t.Format(time.RFC3339))
+		}
+		entries, err := client.audit(args[0], query)
+		if err != nil {
+			return err
+		}
+		if flags.JSON {
+			return writeJSON(out, entries)
+		}
+		return writeTable(out, []string{"TIME", "USER", "TYPE", "POSITION", "CHARACTER", "TEXT"}, func(row func(...interface{})) {
+			for _, e := range entries {
+				user := e.User
+				if e.Node != "" {
+					user = "node:" + e.Node
+				}
+				row(e.Time.Format(time.RFC3339), user, e.Type, e.Position, e.Character, strconv.Quote(e.Text))
+			}
+		})
+
+	case "contributions":
+		c, err := client.contributions(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		if flags.JSON {
+			return writeJSON(out, c)
+		}
+		_, err = fmt.Fprintf(out, "%s inserted %d and deleted %d character(s); %d remain:\n%s\n", c.User, c.Inserted, c.Deleted, len([]rune(c.Text)), c.Text)
+		return err
+
+	case "close":
+		if err := client.closeRoom(args[0]); err != nil {
+			return err
+		}
+		return report(out, flags, map[string]string{"closed": args[0]}, "Closed %s\n", args[0])
+
+	case "snapshot":
+		file, err := client.snapshot(args[0])
+		if err != nil {
+			return err
+		}
+		return report(out, flags, map[string]string{"file": file}, "Wrote %s\n", file)
+	}
+	return nil
+}
+
+// parseBanTarget returns a request banning the users given by target, one of
+// user:NAME, subject:NAME or addr:IP[/BITS]. Any other target is a username.
+func parseBanTarget(target string) (banRequest, error) {
+	var req banRequest
+	switch {
+	case strings.HasPrefix(target, "user:"):
+		req.Username = strings.TrimPrefix(target, "user:")
+	case strings.HasPrefix(target, "subject:"):
+		req.Subject = strings.TrimPrefix(target, "subject:")
+	case strings.HasPrefix(target, "addr:"):
+		req.Address = strings.TrimPrefix(target, "addr:")
+	default:
+		req.Username = target
+	}
+	if req == (banRequest{}) {
+		return req, fmt.Errorf("empty ban target %q", target)
+	}
+	return req, nil
+}
+
+// banTarget describes the users a ban applies to, as given to parseBanTarget.
+func banTarget(b ban) string {
+	var targets []string
+	if b.Username != "" {
+		targets = append(targets, "user:"+b.Username)
+	}
+	if b.Subject != "" {
+		targets = append(targets, "subject:"+b.Subject)
+	}
+	if b.Address != "" {
+		targets = append(targets, "addr:"+b.Address)
+	}
+	return strings.Join(targets, ",")
+}
+
+// parseTime parses a time given as RFC 3339, or as a duration before now.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return time.Time{}, fmt.Errorf("invalid time %q: expected RFC 3339 or a duration like 2h", s)
+	}
+	return now.Add(-d), nil
+}
+
+// report writes the outcome of a command, as v with -json or as a sentence otherwise.
+func report(out io.Writer, flags Flags, v interface{}, format string, args ...interface{}) error {
+	if flags.JSON {
+		return writeJSON(out, v)
+	}
+	_, err := fmt.Fprintf(out, format, args...)
+	return err
+}
+
+// readToken returns the access token given by the -token or -token-file flags.
+func readToken(flags Flags) (string, error) {
+	if flags.TokenFile == "" {
+		return flags.Token, nil
+	}
+	data, err := os.ReadFile(flags.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("reading token file: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
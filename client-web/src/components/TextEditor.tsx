@@ -38,6 +38,7 @@ const socket = useSocket({room: `${room}-${language}`, username});
 
 const doc = useRef(new Doc());
 const hasSynced = useRef(false);
+const siteRejections = useRef(0);
 const [users, setUsers] = useState<string []>([]); // [username, siteID, cursorPos, selectionStart, selectionEnd]
 
 console.log("Users: ", users)
@@ -73,6 +74,19 @@ console.log("Users: ", users)
             const siteID = parseInt(msg.text!);
             console.log(`SiteID RECEIVED, updating local SiteID ${msg.ID}`);
             Doc.SiteID = siteID;
+            // Characters from this site in the document would get duplicate IDs, so ask for another.
+            if (doc.current.HasSite(siteID) && siteRejections.current < 3) {
+              siteRejections.current++;
+              socket.send(JSON.stringify({ type: 'SiteID', text: msg.text }));
+            }
+            break;
+          case 'error':
+            toast.error(msg.text, { position: "bottom-right", autoClose: 5000, theme: "colored" });
+            // The server follows a rejected operation with its document: start over from it.
+            if (msg.code === 'invalid_operation') {
+              doc.current = new Doc();
+              hasSynced.current = false;
+            }
             break;
           case 'users':
             console.log(`USERS RECEIVED, updating local users ${msg.text}`);
@@ -119,6 +133,12 @@ console.log("Users: ", users)
             break;
         }
       });
+      // Tell the user why the server closed the connection, like a kick or a ban.
+      socket.addEventListener('close', (event) => {
+        if (event.reason) {
+          toast.error(`Disconnected: ${event.reason}`, { position: "bottom-right", autoClose: false, theme: "colored" });
+        }
+      });
     }
   }, [socket]);
   
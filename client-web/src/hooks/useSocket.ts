@@ -6,8 +6,12 @@ type Props = {
   room: string;
   username: string;
 };
+// defaultHost is the WebSocket endpoint of the server the page was served from.
+const defaultHost = () =>
+  `${window.location.protocol === "https:" ? "wss" : "ws"}://${window.location.host}/ws`;
+
 const useSocket = ({ host, room, username }: Props) => {
-  const url = `${host ? host : "ws://localhost:8084"}?room=${room}`;
+  const url = `${host ? host : defaultHost()}?room=${room}`;
   const [socket, setSocket] = useState<WebSocket | null>(null);
 
   useEffect(() => {
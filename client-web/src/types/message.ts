@@ -8,6 +8,7 @@ export interface Message {
   ID?: string;
   operation?: Operation;
   document?: Doc;
+  code?: ErrorCode;
 }
 
 // MessageType represents the type of the message.
@@ -17,13 +18,22 @@ export type MessageType =
   | "SiteID"
   | "join"
   | "users"
-  | "operation";
+  | "operation"
+  | "error";
 
-// Currently, pairpad supports 5 message types:
+// ErrorCode tells why the server rejected a message, in error messages.
+export type ErrorCode =
+  | "unknown_type"
+  | "invalid_message"
+  | "invalid_operation"
+  | "read_only";
+
+// Currently, pairpad supports 6 message types:
 // - docSync (for syncing documents)
 // - docReq (for requesting documents)
 // - SiteID (for generating site IDs)
 // - join (for joining messages)
 // - users (for the list of active users)
+// - error (for telling a client its message was rejected)
 
 // Operation represents a CRDT operation.
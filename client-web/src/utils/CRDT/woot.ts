@@ -151,6 +151,11 @@ export class Doc {
     return position !== -1;
   }
 
+  HasSite(site: number): boolean {
+    const prefix = `${site}.`;
+    return this.Characters.some((char) => char.ID.startsWith(prefix));
+  }
+
   Find(id: string): Character {
     for (const char of this.Characters) {
       if (char.ID === id) {
@@ -241,7 +246,7 @@ export class Doc {
     }
 
     const char = new Character(
-      `${Doc.SiteID}${Doc.LocalClock}`,
+      `${Doc.SiteID}.${Doc.LocalClock}`,
       true,
       value,
       charPrev.ID,
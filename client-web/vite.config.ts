@@ -4,4 +4,15 @@ import react from '@vitejs/plugin-react'
 // https://vitejs.dev/config/
 export default defineConfig({
   plugins: [react()],
+  build: {
+    // codpen-server embeds the web client from there.
+    outDir: '../server/webui/dist',
+    emptyOutDir: true,
+  },
+  server: {
+    // In development, WebSockets go to a codpen-server running locally.
+    proxy: {
+      '/ws': { target: 'ws://localhost:8084', ws: true },
+    },
+  },
 })
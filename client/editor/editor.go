@@ -57,6 +57,10 @@ type Editor struct {
 	// IsConnected shows whether the editor is currently connected to the server.
 	IsConnected bool
 
+	// ReadOnly is set when the user may only view the document, for example when
+	// joining a room as a viewer. A badge is shown in the status bar.
+	ReadOnly bool
+
 	// DrawChan is used to send and receive signals to update the terminal display.
 	DrawChan chan int
 
@@ -64,6 +68,9 @@ type Editor struct {
 	mu sync.RWMutex
 }
 
+// readOnlyBadge is displayed in the status bar when the editor is read-only.
+const readOnlyBadge = " READ-ONLY "
+
 var userColors = []termbox.Attribute{
 	termbox.ColorGreen,
 	termbox.ColorYellow,
@@ -223,6 +230,17 @@ func (e *Editor) DrawStatusBar() {
 		e.DrawInfoBar()
 	}
 
+	// Render read-only badge next to the connection indicator.
+	e.StatusMu.Lock()
+	readOnly := e.ReadOnly
+	e.StatusMu.Unlock()
+	if readOnly {
+		badge := []rune(readOnlyBadge)
+		for i, r := range badge {
+			termbox.SetCell(e.Width-1-len(badge)+i, e.Height-1, r, termbox.ColorBlack, termbox.ColorYellow)
+		}
+	}
+
 	// Render connection indicator
 	if e.IsConnected {
 		termbox.SetBg(e.Width-1, e.Height-1, termbox.ColorGreen)
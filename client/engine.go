@@ -3,7 +3,6 @@ package main
 import (
 	"errors"
 	"fmt"
-	"strconv"
 	"strings"
 	"time"
 
@@ -19,6 +18,13 @@ import (
 func handleTermboxEvent(ev termbox.Event, conn *websocket.Conn) error {
 	// We only want to deal with termbox key events (EventKey).
 	if ev.Type == termbox.EventKey {
+		// Viewers can move around and save, but not change the document.
+		if isReadOnly() && isEditKey(ev) {
+			e.StatusChan <- "Read-only: you joined this room as a viewer"
+			e.SendDraw()
+			return nil
+		}
+
 		switch ev.Key {
 
 		// The default keys for exiting an session are Esc and Ctrl+C.
@@ -125,6 +131,23 @@ func handleTermboxEvent(ev termbox.Event, conn *websocket.Conn) error {
 	return nil
 }
 
+// isReadOnly reports whether the editor is in read-only mode.
+func isReadOnly() bool {
+	e.StatusMu.Lock()
+	defer e.StatusMu.Unlock()
+	return e.ReadOnly
+}
+
+// isEditKey reports whether a key event changes the document.
+func isEditKey(ev termbox.Event) bool {
+	switch ev.Key {
+	case termbox.KeyBackspace, termbox.KeyBackspace2, termbox.KeyDelete, termbox.KeyTab,
+		termbox.KeyEnter, termbox.KeySpace, termbox.KeyCtrlL:
+		return true
+	}
+	return ev.Key == 0 && ev.Ch != 0
+}
+
 const (
 	OperationInsert = iota
 	OperationDelete
@@ -155,8 +178,10 @@ func performOperation(opType int, ev termbox.Event, conn *websocket.Conn) {
 	case OperationDelete:
 		logger.Infof("LOCAL DELETE: cursor position %v\n", e.Cursor)
 
-		if e.Cursor-1 < 0 {
+		// There is nothing to delete before the start of the text.
+		if e.Cursor <= 0 {
 			e.Cursor = 0
+			return
 		}
 
 		text := doc.Delete(e.Cursor)
@@ -166,13 +191,16 @@ func performOperation(opType int, ev termbox.Event, conn *websocket.Conn) {
 		e.MoveCursor(-1, 0)
 	}
 
-	// Send the message.
-	if e.IsConnected {
-		err := conn.WriteJSON(msg)
-		if err != nil {
-			e.IsConnected = false
-			e.StatusChan <- "lost connection!"
-		}
+	// Send the message, or keep the operation until the connection is back.
+	if !e.IsConnected {
+		queueOperation(msg.Operation)
+		return
+	}
+	if err := conn.WriteJSON(msg); err != nil {
+		e.IsConnected = false
+		queueOperation(msg.Operation)
+		// Closing the connection makes getMsgChan report it lost.
+		conn.Close()
 	}
 }
 
@@ -197,6 +225,10 @@ func handleMsg(msg commons.Message, conn *websocket.Conn) {
 
 		doc = msg.Document
 		e.SetText(crdt.Content(doc))
+		if msg.Seq != 0 {
+			session.lastSeq = msg.Seq
+		}
+		checkSite(conn)
 
 	case commons.DocReqMessage:
 		logger.Infof("DOCREQ RECEIVED, sending local document to %v\n", msg.ID)
@@ -205,44 +237,42 @@ func handleMsg(msg commons.Message, conn *websocket.Conn) {
 		_ = conn.WriteJSON(&docMsg)
 
 	case commons.SiteIDMessage:
-		siteID, err := strconv.Atoi(msg.Text)
-		if err != nil {
-			logger.Errorf("failed to set siteID, err: %v\n", err)
-		}
-
-		crdt.SiteID = siteID
-		logger.Infof("SITE ID %v, INTENDED SITE ID: %v", crdt.SiteID, siteID)
+		handleSiteID(msg, conn)
 
 	case commons.JoinMessage:
 		e.StatusChan <- fmt.Sprintf("%s has joined the session!", msg.Username)
 
+	case commons.RoleMessage:
+		role := commons.Role(msg.Text)
+		e.StatusMu.Lock()
+		e.ReadOnly = !role.CanEdit()
+		e.StatusMu.Unlock()
+		e.StatusChan <- fmt.Sprintf("Joined as %s", role)
+
+	case commons.ErrorMessage:
+		logger.Warnf("server rejected message: %s", msg.Text)
+		e.StatusChan <- msg.Text
+
 	case commons.UsersMessage:
 		e.StatusMu.Lock()
 		e.Users = strings.Split(msg.Text, ",")
 		e.StatusMu.Unlock()
 
-	default:
-		switch msg.Operation.Type {
-		case "insert":
-			_, err := doc.Insert(msg.Operation.Position, msg.Operation.Value)
-			if err != nil {
-				logger.Errorf("failed to insert, err: %v\n", err)
-			}
+	case commons.SessionMessage:
+		handleSession(msg, conn)
 
-			e.SetText(crdt.Content(doc))
-			if msg.Operation.Position-1 <= e.Cursor {
-				e.MoveCursor(len(msg.Operation.Value), 0)
-			}
-			logger.Infof("REMOTE INSERT: %s at position %v\n", msg.Operation.Value, msg.Operation.Position)
+	case commons.ResumeMessage:
+		handleResume(msg, conn)
 
-		case "delete":
-			_ = doc.Delete(msg.Operation.Position)
-			e.SetText(crdt.Content(doc))
-			if msg.Operation.Position-1 <= e.Cursor {
-				e.MoveCursor(-len(msg.Operation.Value), 0)
+	default:
+		if msg.Seq != 0 {
+			if msg.Seq <= session.lastSeq {
+				// Already applied.
+				break
 			}
-			logger.Infof("REMOTE DELETE: position %v\n", msg.Operation.Position)
+			session.lastSeq = msg.Seq
 		}
+		applyRemoteOperation(msg.Operation)
 	}
 
 	// printDoc is used for debugging purposes. Don't comment this out.
@@ -254,9 +284,49 @@ func handleMsg(msg commons.Message, conn *websocket.Conn) {
 	e.SendDraw()
 }
 
-// getMsgChan returns a message channel that repeatedly reads from a websocket connection.
-func getMsgChan(conn *websocket.Conn) chan commons.Message {
+// applyRemoteOperation applies an operation received from another client to the
+// local document, keeping the cursor on the same character.
+func applyRemoteOperation(op commons.Operation) {
+	switch op.Type {
+	case "insert":
+		_, err := doc.Insert(op.Position, op.Value)
+		if err != nil {
+			logger.Errorf("failed to insert, err: %v\n", err)
+		}
+
+		e.SetText(crdt.Content(doc))
+		if op.Position-1 <= e.Cursor {
+			e.MoveCursor(len(op.Value), 0)
+		}
+		logger.Infof("REMOTE INSERT: %s at position %v\n", op.Value, op.Position)
+
+	case "delete":
+		_ = doc.Delete(op.Position)
+		e.SetText(crdt.Content(doc))
+		if op.Position-1 <= e.Cursor {
+			e.MoveCursor(-len(op.Value), 0)
+		}
+		logger.Infof("REMOTE DELETE: position %v\n", op.Position)
+	}
+}
+
+// applyOperation applies an operation to the local document, leaving the editor alone.
+func applyOperation(op commons.Operation) {
+	switch op.Type {
+	case "insert":
+		if _, err := doc.Insert(op.Position, op.Value); err != nil {
+			logger.Errorf("failed to insert, err: %v\n", err)
+		}
+	case "delete":
+		_ = doc.Delete(op.Position)
+	}
+}
+
+// getMsgChan returns a message channel that repeatedly reads from a websocket
+// connection, and a channel receiving the error the connection was lost with.
+func getMsgChan(conn *websocket.Conn) (chan commons.Message, chan error) {
 	messageChan := make(chan commons.Message)
+	lost := make(chan error, 1)
 	go func() {
 		for {
 			var msg commons.Message
@@ -264,12 +334,12 @@ func getMsgChan(conn *websocket.Conn) chan commons.Message {
 			// Read message.
 			err := conn.ReadJSON(&msg)
 			if err != nil {
-				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure, websocket.CloseServiceRestart) {
 					logger.Errorf("websocket error: %v", err)
 				}
 				e.IsConnected = false
-				e.StatusChan <- "lost connection!"
-				break
+				lost <- err
+				return
 			}
 
 			logger.Infof("message received: %+v\n", msg)
@@ -279,7 +349,17 @@ func getMsgChan(conn *websocket.Conn) chan commons.Message {
 
 		}
 	}()
-	return messageChan
+	return messageChan, lost
+}
+
+// closeReason returns the reason given in the close frame that ended a connection,
+// or an empty string if the connection wasn't closed by the server.
+func closeReason(err error) string {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		return closeErr.Text
+	}
+	return ""
 }
 
 // handleStatusMsg asynchronously waits for messages from e.StatusChan and
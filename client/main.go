@@ -28,6 +28,10 @@ var (
 
 	// Parsed flags.
 	flags Flags
+
+	// The user's name, and the room's password if any, kept to reconnect.
+	username string
+	password string
 )
 
 func main() {
@@ -37,24 +41,45 @@ func main() {
 	s := bufio.NewScanner(os.Stdin)
 
 	// Generate a random username.
-	name := randomdata.SillyName()
+	username = randomdata.SillyName()
 
 	// Read username based if login flag is set to true.
 	if flags.Login {
 		fmt.Print("Enter your name: ")
 		s.Scan()
-		name = s.Text()
+		username = s.Text()
+	}
+
+	// Read the room password if password flag is set to true.
+	if flags.Password {
+		fmt.Print("Enter the room password: ")
+		s.Scan()
+		password = s.Text()
 	}
 
-	conn, _, err := createConn(flags)
+	u := serverURL(flags)
+	fmt.Printf("Connecting to %s...\n", u.String())
+
+	conn, resp, err := createConn(flags, password, "", 0)
 	if err != nil {
+		// The server explains refused handshakes, for example a missing or invalid
+		// token, or a full room.
+		if resp != nil {
+			reason := refusal(resp)
+			if isFull(resp, reason) {
+				fmt.Printf("Can't join the room: %s\n", reason)
+				return
+			}
+			fmt.Printf("Connection refused, exiting: %s: %s\n", resp.Status, reason)
+			return
+		}
 		fmt.Printf("Connection error, exiting: %s\n", err)
 		return
 	}
 	defer conn.Close()
 
 	// Send joining message.
-	msg := commons.Message{Username: name, Text: "has joined the session.", Type: commons.JoinMessage}
+	msg := commons.Message{Username: username, Text: "has joined the session.", Type: commons.JoinMessage}
 	_ = conn.WriteJSON(msg)
 
 	logFile, debugLogFile, err := setupLogger(logger)
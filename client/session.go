@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/danii7514/codpen/commons"
+	"github.com/danii7514/codpen/crdt"
+	"github.com/gorilla/websocket"
+)
+
+// When the connection to the server drops, the client keeps editing offline and
+// reconnects, waiting longer after every failed attempt. It presents the session
+// token the server gave it along with the number of the last operation it
+// received, and the server sends it the operations it missed. The client then
+// sends the operations it made while offline, rebased on those it missed, which
+// it applies on top of its own, so that it ends up with the server's text.
+
+const (
+	// minReconnectDelay and maxReconnectDelay bound the delay before reconnecting.
+	minReconnectDelay = 500 * time.Millisecond
+	maxReconnectDelay = 30 * time.Second
+)
+
+// sessionState holds what the client needs to resume its session. It is only
+// used by the main loop.
+type sessionState struct {
+	// token is the session token given by the server.
+	token string
+
+	// lastSeq is the number of the last operation received.
+	lastSeq uint64
+
+	// pending holds the operations made while offline, in order.
+	pending []commons.Operation
+
+	// resuming is set from reconnecting until the server has said whether it
+	// resumed the session.
+	resuming bool
+}
+
+// session is the client's session.
+var session sessionState
+
+// handleSession handles the session message the server sends after every connection.
+func handleSession(msg commons.Message, conn *websocket.Conn) {
+	resumed := msg.Text == session.token
+	session.token = msg.Text
+	session.lastSeq = msg.Seq
+
+	if !session.resuming || resumed {
+		// After a resumed session comes the resume message.
+		return
+	}
+
+	// The server no longer knows the session, for example because it restarted,
+	// so this is a new client as far as it is concerned.
+	session.resuming = false
+	joinMsg := commons.Message{Username: username, Text: "has joined the session.", Type: commons.JoinMessage}
+	if err := conn.WriteJSON(joinMsg); err != nil {
+		logger.Errorf("failed to send join message: %v", err)
+	}
+
+	if n := len(session.pending); n > 0 {
+		logger.Warnf("session expired, dropping %d offline operations", n)
+		e.StatusChan <- fmt.Sprintf("Reconnected, but the session expired: %d offline edits weren't sent", n)
+		session.pending = nil
+	} else {
+		e.StatusChan <- "Reconnected"
+	}
+	e.IsConnected = true
+}
+
+// handleResume catches the document up with what happened while the client was
+// offline, and sends the operations made meanwhile.
+func handleResume(msg commons.Message, conn *websocket.Conn) {
+	if len(msg.Document.Characters) > 0 {
+		// The server no longer has the operations missed, so start over from its
+		// document, with the offline operations on top.
+		doc = msg.Document
+		for _, op := range session.pending {
+			applyOperation(op)
+		}
+		e.SetText(crdt.Content(doc))
+		checkSite(conn)
+	} else {
+		// The missed and offline operations both apply to the document as it was
+		// when the connection dropped.
+		pending, missed := rebase(session.pending, msg.Operations)
+		for _, op := range missed {
+			applyRemoteOperation(op)
+		}
+		session.pending = pending
+	}
+	session.lastSeq = msg.Seq
+
+	sent := len(session.pending)
+	for i, op := range session.pending {
+		if err := conn.WriteJSON(commons.Message{Type: commons.OperationMessage, Operation: op}); err != nil {
+			// Lost again: the rest is sent once reconnected.
+			session.pending = session.pending[i:]
+			conn.Close()
+			return
+		}
+	}
+	session.pending = nil
+	session.resuming = false
+	e.IsConnected = true
+
+	logger.Infof("session resumed, %d missed and %d offline operations", len(msg.Operations), sent)
+	e.StatusChan <- fmt.Sprintf("Reconnected, %d offline edits sent", sent)
+}
+
+// rebase transforms the operations made offline, pending, and those missed
+// meanwhile, missed, which both apply to the same document. It returns pending
+// as it applies after missed, and missed as it applies after pending, so that
+// both orders give the same text. Characters inserted at the same position by
+// both go in the order of missed first, and a character deleted by both is
+// deleted once.
+func rebase(pending, missed []commons.Operation) ([]commons.Operation, []commons.Operation) {
+	var rebased []commons.Operation
+	for _, op := range pending {
+		kept := true
+		transformed := make([]commons.Operation, 0, len(missed))
+		for _, m := range missed {
+			if !kept {
+				transformed = append(transformed, m)
+				continue
+			}
+			m2, mKept := transform(m, op, true)
+			op, kept = transform(op, m, false)
+			if mKept {
+				transformed = append(transformed, m2)
+			}
+		}
+		missed = transformed
+		if kept {
+			rebased = append(rebased, op)
+		}
+	}
+	return rebased, missed
+}
+
+// transform returns op as it applies after against, both applying to the same
+// document. When both insert at the same position, op's character goes first if
+// first is set. It reports false if op has nothing left to do, because both
+// delete the same character.
+func transform(op, against commons.Operation, first bool) (commons.Operation, bool) {
+	switch against.Type {
+	case "insert":
+		if against.Position < op.Position || (against.Position == op.Position && (op.Type == "delete" || !first)) {
+			op.Position++
+		}
+	case "delete":
+		if against.Position < op.Position {
+			op.Position--
+		} else if against.Position == op.Position && op.Type == "delete" {
+			return op, false
+		}
+	}
+	return op, true
+}
+
+// queueOperation keeps an operation made while offline, to send it once reconnected.
+func queueOperation(op commons.Operation) {
+	session.pending = append(session.pending, op)
+}
+
+// shouldReconnect reports whether to reconnect after the connection failed with
+// err. The server closing the connection on purpose, for example because the
+// client was kicked or the room deleted, isn't worth retrying.
+func shouldReconnect(err error) bool {
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) {
+		return true
+	}
+	switch closeErr.Code {
+	case websocket.CloseNormalClosure, websocket.ClosePolicyViolation, websocket.CloseMessageTooBig:
+		return false
+	}
+	return true
+}
+
+// reconnectDelay returns how long to wait before the given reconnection attempt,
+// counting from 0. The delay doubles with every attempt, and is randomized so
+// that the clients of a restarting server don't all come back at once.
+func reconnectDelay(attempt int) time.Duration {
+	d := maxReconnectDelay
+	if attempt < 16 {
+		if d = minReconnectDelay << attempt; d > maxReconnectDelay {
+			d = maxReconnectDelay
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// reconnect dials the server until it succeeds, resuming the session given by
+// token and lastSeq, and sends the new connection to conns. It gives up if the
+// server refuses the connection.
+func reconnect(conns chan<- *websocket.Conn, token string, lastSeq uint64) {
+	for attempt := 0; ; attempt++ {
+		time.Sleep(reconnectDelay(attempt))
+
+		conn, resp, err := createConn(flags, password, token, lastSeq)
+		if err == nil {
+			conns <- conn
+			return
+		}
+		logger.Warnf("reconnection attempt %d failed: %v", attempt+1, err)
+
+		if resp == nil {
+			continue
+		}
+		// Client errors, like an expired token, won't go away by retrying. The body
+		// says why, like a ban.
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			e.StatusChan <- fmt.Sprintf("Can't reconnect: %s", refusal(resp))
+			return
+		}
+		// A full room or server may make room later.
+		if reason := refusal(resp); isFull(resp, reason) {
+			e.StatusChan <- fmt.Sprintf("Can't reconnect yet: %s", reason)
+		}
+	}
+}
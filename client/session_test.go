@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/danii7514/codpen/commons"
+	"github.com/danii7514/codpen/crdt"
+)
+
+// replica returns a document holding text, with ops applied to it in order.
+func replica(t *testing.T, text string, ops ...[]commons.Operation) crdt.Document {
+	t.Helper()
+	doc := crdt.New()
+	for i, r := range []rune(text) {
+		if _, err := doc.Insert(i+1, string(r)); err != nil {
+			t.Fatalf("Failed to insert %q: %v", r, err)
+		}
+	}
+	for _, list := range ops {
+		for _, op := range list {
+			switch op.Type {
+			case "insert":
+				if _, err := doc.Insert(op.Position, op.Value); err != nil {
+					t.Fatalf("Failed to apply %+v: %v", op, err)
+				}
+			case "delete":
+				doc.Delete(op.Position)
+			}
+		}
+	}
+	return doc
+}
+
+func insert(position int, value string) commons.Operation {
+	return commons.Operation{Type: "insert", Position: position, Value: value}
+}
+
+func remove(position int) commons.Operation {
+	return commons.Operation{Type: "delete", Position: position}
+}
+
+func TestRebase(t *testing.T) {
+	tests := []struct {
+		description string
+		text        string
+		pending     []commons.Operation
+		missed      []commons.Operation
+		expected    string
+	}{
+		{description: "nothing missed", text: "abc", pending: []commons.Operation{insert(4, "d")}, expected: "abcd"},
+		{description: "nothing offline", text: "abc", missed: []commons.Operation{remove(1)}, expected: "bc"},
+		{description: "inserts apart", text: "abc", pending: []commons.Operation{insert(4, "d")}, missed: []commons.Operation{insert(1, "x")}, expected: "xabcd"},
+		{description: "inserts at the same position", text: "abc", pending: []commons.Operation{insert(2, "y"), insert(3, "z")}, missed: []commons.Operation{insert(2, "x")}, expected: "axyzbc"},
+		{description: "deletes before inserts", text: "abcdef", pending: []commons.Operation{insert(6, "x")}, missed: []commons.Operation{remove(1), remove(1)}, expected: "cdexf"},
+		{description: "inserts before deletes", text: "abcdef", pending: []commons.Operation{remove(5), remove(5)}, missed: []commons.Operation{insert(1, "x"), insert(2, "y")}, expected: "xyabcd"},
+		{description: "same character deleted", text: "abcd", pending: []commons.Operation{remove(2), insert(2, "x")}, missed: []commons.Operation{remove(2), remove(2)}, expected: "axd"},
+		{description: "insert where deleted", text: "abc", pending: []commons.Operation{insert(2, "x")}, missed: []commons.Operation{remove(2)}, expected: "axc"},
+		{description: "both typing", text: "", pending: []commons.Operation{insert(1, "h"), insert(2, "i")}, missed: []commons.Operation{insert(1, "y"), insert(2, "o")}, expected: "yohi"},
+	}
+
+	for _, tc := range tests {
+		pending, missed := rebase(tc.pending, tc.missed)
+
+		// The client applied its offline operations before the ones it missed,
+		// and the server the other way around.
+		client := crdt.Content(replica(t, tc.text, tc.pending, missed))
+		server := crdt.Content(replica(t, tc.text, tc.missed, pending))
+		if client != server {
+			t.Errorf("(%s) replicas diverged: the client has %q, the server %q", tc.description, client, server)
+		}
+		if server != tc.expected {
+			t.Errorf("(%s) expected %q, got %q", tc.description, tc.expected, server)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/danii7514/codpen/commons"
+	"github.com/danii7514/codpen/crdt"
+	"github.com/gorilla/websocket"
+)
+
+// The server hands out site IDs which should never have been used before, but a
+// document can still hold characters from the site it assigned, for example if
+// the document was written before the server changed how it allocates them. Two
+// characters with the same ID would corrupt the document, so the client sends
+// such a site ID back, and the server assigns another.
+
+// maxSiteRejections is how many site IDs in a row the client sends back before
+// giving up and keeping the last one.
+const maxSiteRejections = 3
+
+// siteRejections counts the site IDs sent back since the last accepted one. It
+// is only used by the main loop.
+var siteRejections int
+
+// handleSiteID sets the site ID assigned by the server, unless the document
+// already has characters from it.
+func handleSiteID(msg commons.Message, conn *websocket.Conn) {
+	siteID, err := strconv.Atoi(msg.Text)
+	if err != nil {
+		logger.Errorf("failed to set siteID, err: %v\n", err)
+	}
+
+	crdt.SiteID = siteID
+	logger.Infof("SITE ID %v, INTENDED SITE ID: %v", crdt.SiteID, siteID)
+	checkSite(conn)
+}
+
+// checkSite asks the server for another site ID if the document has characters
+// from the current one. It is called whenever the site ID or the document changes.
+func checkSite(conn *websocket.Conn) {
+	if !doc.HasSite(crdt.SiteID) {
+		siteRejections = 0
+		return
+	}
+	if siteRejections >= maxSiteRejections {
+		logger.Errorf("site ID %d is already used in the document, keeping it after %d rejections", crdt.SiteID, siteRejections)
+		return
+	}
+
+	siteRejections++
+	logger.Warnf("site ID %d is already used in the document, asking for another", crdt.SiteID)
+	msg := commons.Message{Type: commons.SiteIDMessage, Text: strconv.Itoa(crdt.SiteID)}
+	if err := conn.WriteJSON(msg); err != nil {
+		logger.Errorf("failed to reject site ID: %v", err)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+
 	"github.com/danii7514/codpen/client/editor"
 	"github.com/danii7514/codpen/crdt"
 	"github.com/gorilla/websocket"
@@ -40,13 +42,19 @@ func initUI(conn *websocket.Conn, conf UIConfig) error {
 	return nil
 }
 
-// mainLoop is the main update loop for the UI.
+// mainLoop is the main update loop for the UI. When the connection is lost, it
+// keeps going offline while reconnecting.
 func mainLoop(conn *websocket.Conn) error {
+	defer func() { conn.Close() }()
+
 	// termboxChan is used for sending and receiving termbox events.
 	termboxChan := getTermboxChan()
 
-	// msgChan is used for sending and receiving messages.
-	msgChan := getMsgChan(conn)
+	// msgChan is used for sending and receiving messages, and lost tells when the connection is lost.
+	msgChan, lost := getMsgChan(conn)
+
+	// reconnected receives the new connection once reconnected.
+	reconnected := make(chan *websocket.Conn, 1)
 
 	for {
 		select {
@@ -57,6 +65,22 @@ func mainLoop(conn *websocket.Conn) error {
 			}
 		case msg := <-msgChan:
 			handleMsg(msg, conn)
+		case err := <-lost:
+			reason := closeReason(err)
+			if reason == "" {
+				reason = "connection lost"
+			}
+			if !shouldReconnect(err) {
+				e.StatusChan <- fmt.Sprintf("lost connection: %s", reason)
+				continue
+			}
+			e.StatusChan <- fmt.Sprintf("lost connection: %s, reconnecting...", reason)
+			go reconnect(reconnected, session.token, session.lastSeq)
+		case newConn := <-reconnected:
+			conn.Close()
+			conn = newConn
+			msgChan, lost = getMsgChan(conn)
+			session.resuming = true
 		}
 	}
 }
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -8,8 +11,11 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/danii7514/codpen/commons"
 	"github.com/danii7514/codpen/crdt"
 	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
@@ -25,6 +31,25 @@ type Flags struct {
 	Debug  bool
 	Scroll bool
 	Room   string
+
+	// Token is the access token presented to the server. TokenFile, if set, names
+	// a file to read the token from instead.
+	Token     string
+	TokenFile string
+
+	// Viewer asks the server to join the room read-only.
+	Viewer bool
+
+	// Password enables the room password prompt.
+	Password bool
+
+	// TLSCA names a PEM file holding the CAs trusted to sign the server's
+	// certificate, in addition to the system's. TLSCert and TLSKey name the PEM
+	// files holding the client certificate presented to the server, if any.
+	// Setting any of them enables Secure.
+	TLSCA   string
+	TLSCert string
+	TLSKey  string
 }
 
 // parseFlags parses command-line flags.
@@ -36,6 +61,13 @@ func parseFlags() Flags {
 	enableLogin := flag.Bool("login", true, "Enable the login prompt for the server")
 	file := flag.String("file", "", "The file to load the codpen content from")
 	enableScroll := flag.Bool("scroll", true, "Enable scrolling with the cursor")
+	token := flag.String("token", "", "The access token used to join the room")
+	tokenFile := flag.String("token-file", "", "The file to read the access token from")
+	viewer := flag.Bool("viewer", false, "Join the room as a read-only viewer")
+	enablePassword := flag.Bool("password", false, "Enable the password prompt for protected rooms. A new room is protected with the password entered")
+	tlsCA := flag.String("tls-ca", "", "PEM file holding the CAs to trust for the server's certificate (implies -secure)")
+	tlsCert := flag.String("tls-cert", "", "PEM file holding the client certificate to present to the server (implies -secure)")
+	tlsKey := flag.String("tls-key", "", "PEM file holding the private key of the client certificate")
 
 	flag.Parse()
 
@@ -47,31 +79,142 @@ func parseFlags() Flags {
 		File:   *file,
 		Scroll: *enableScroll,
 		Room:   *room,
+
+		Token:     *token,
+		TokenFile: *tokenFile,
+		Viewer:    *viewer,
+		Password:  *enablePassword,
+
+		TLSCA:   *tlsCA,
+		TLSCert: *tlsCert,
+		TLSKey:  *tlsKey,
 	}
 }
 
-// createConn creates a WebSocket connection.
-func createConn(flags Flags) (*websocket.Conn, *http.Response, error) {
+// serverURL returns the URL of the room's WebSocket.
+func serverURL(flags Flags) url.URL {
 	var u url.URL
-	if flags.Secure {
-		u = url.URL{Scheme: "wss", Host: flags.Server, Path: "/"}
+	if flags.Secure || flags.TLSCA != "" || flags.TLSCert != "" {
+		u = url.URL{Scheme: "wss", Host: flags.Server, Path: "/ws"}
 	} else {
-		u = url.URL{Scheme: "ws", Host: flags.Server, Path: "/"}
+		u = url.URL{Scheme: "ws", Host: flags.Server, Path: "/ws"}
 	}
 	if flags.Room != "" {
 		u.RawQuery = "room=" + flags.Room
 	} else {
 		u.RawQuery = "room=" + "default"
 	}
+	if flags.Viewer {
+		u.RawQuery += "&role=" + string(commons.RoleViewer)
+	}
+	return u
+}
+
+// createConn creates a WebSocket connection. password is the room's password, if
+// any. If session isn't empty, the connection resumes that session, whose last
+// operation received was numbered lastSeq.
+func createConn(flags Flags, password, session string, lastSeq uint64) (*websocket.Conn, *http.Response, error) {
+	u := serverURL(flags)
 
-	print("Connecting to ", u.String(), "...\n")
+	token, err := loadToken(flags)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	if password != "" {
+		header.Set("X-Codpen-Room-Password", password)
+	}
+	if session != "" {
+		header.Set("X-Codpen-Session", session)
+		header.Set("X-Codpen-Last-Seq", strconv.FormatUint(lastSeq, 10))
+	}
+
+	tlsConfig, err := loadTLSConfig(flags)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// Get WebSocket connection.
 	dialer := websocket.Dialer{
 		HandshakeTimeout: 2 * time.Minute,
+		TLSClientConfig:  tlsConfig,
+	}
+
+	return dialer.Dial(u.String(), header)
+}
+
+// refusal returns why the server refused a connection, as explained in the body
+// of its response, or the response's status if it doesn't say.
+func refusal(resp *http.Response) string {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if reason := strings.TrimSpace(string(body)); reason != "" {
+		return reason
+	}
+	return resp.Status
+}
+
+// isFull reports whether a connection was refused because the room or the
+// server had as many connections as allowed, which may change later.
+func isFull(resp *http.Response, reason string) bool {
+	return resp.StatusCode == http.StatusServiceUnavailable &&
+		(strings.HasPrefix(reason, commons.RoomFullReason) || strings.HasPrefix(reason, commons.ServerFullReason))
+}
+
+// loadTLSConfig returns the TLS configuration given by the -tls-ca, -tls-cert
+// and -tls-key flags, or nil to use the defaults.
+func loadTLSConfig(flags Flags) (*tls.Config, error) {
+	if flags.TLSCA == "" && flags.TLSCert == "" && flags.TLSKey == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if flags.TLSCA != "" {
+		pem, err := os.ReadFile(flags.TLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", flags.TLSCA)
+		}
+		config.RootCAs = pool
+	}
+
+	if flags.TLSCert != "" || flags.TLSKey != "" {
+		if flags.TLSCert == "" || flags.TLSKey == "" {
+			return nil, errors.New("-tls-cert and -tls-key must be used together")
+		}
+		cert, err := tls.LoadX509KeyPair(flags.TLSCert, flags.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// loadToken returns the access token given by the -token flag, or read from the
+// file given by the -token-file flag.
+func loadToken(flags Flags) (string, error) {
+	if flags.TokenFile == "" {
+		return flags.Token, nil
+	}
+
+	token, err := os.ReadFile(flags.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token file: %w", err)
 	}
 
-	return dialer.Dial(u.String(), nil)
+	return strings.TrimSpace(string(token)), nil
 }
 
 // ensureDirExists ensures that a directory exists, and if it isn't present, it tries to create a new one.
@@ -23,22 +23,71 @@ type Message struct {
 
 	// Document represents the client's document. This is not used frequently, and should be only used when necessary, due to the large size of documents.
 	Document crdt.Document `json:"document"`
+
+	// Seq is the number of the last operation relayed in the room, which the server
+	// sets on operations, document syncs and sessions.
+	Seq uint64 `json:"seq,omitempty"`
+
+	// Operations holds the operations a resuming client missed.
+	Operations []Operation `json:"operations,omitempty"`
+
+	// Code tells why the server rejected a client's message, in error messages.
+	Code ErrorCode `json:"code,omitempty"`
 }
 
 // MessageType represents the type of the message.
 type MessageType string
 
-// Currently, codpen supports 5 message types:
+// Currently, codpen supports 10 message types:
 // - docSync (for syncing documents)
 // - docReq (for requesting documents)
 // - SiteID (for generating site IDs)
 // - join (for joining messages)
 // - users (for the list of active users)
+// - operation (for CRDT operations)
+// - role (for telling a client its role in the room)
+// - error (for telling a client its message was rejected)
+// - session (for giving a client the token resuming its session)
+// - resume (for sending a resuming client what it missed)
+
+const (
+	DocSyncMessage   MessageType = "docSync"
+	DocReqMessage    MessageType = "docReq"
+	SiteIDMessage    MessageType = "SiteID"
+	JoinMessage      MessageType = "join"
+	UsersMessage     MessageType = "users"
+	OperationMessage MessageType = "operation"
+	RoleMessage      MessageType = "role"
+	ErrorMessage     MessageType = "error"
+	SessionMessage   MessageType = "session"
+	ResumeMessage    MessageType = "resume"
+)
+
+// ErrorCode tells why the server rejected a message, in the Code of an error message.
+type ErrorCode string
+
+const (
+	// ErrorUnknownType rejects messages of a type clients may not send.
+	ErrorUnknownType ErrorCode = "unknown_type"
+
+	// ErrorInvalidMessage rejects messages with missing or malformed fields.
+	ErrorInvalidMessage ErrorCode = "invalid_message"
+
+	// ErrorInvalidOperation rejects operations which don't apply to the room's
+	// document. The server follows it with the document, for the client to
+	// catch up with.
+	ErrorInvalidOperation ErrorCode = "invalid_operation"
+
+	// ErrorReadOnly rejects operations from viewers.
+	ErrorReadOnly ErrorCode = "read_only"
+)
+
+// ServerRestartingReason is the close reason sent to clients when the server shuts down.
+const ServerRestartingReason = "server restarting"
 
+// RoomFullReason and ServerFullReason start the reason given to clients turned
+// away because their room, or the server, has as many connections as allowed.
 const (
-	DocSyncMessage MessageType = "docSync"
-	DocReqMessage  MessageType = "docReq"
-	SiteIDMessage  MessageType = "SiteID"
-	JoinMessage    MessageType = "join"
-	UsersMessage   MessageType = "users"
+	RoomFullReason   = "room is full"
+	ServerFullReason = "server is full"
 )
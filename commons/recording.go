@@ -0,0 +1,68 @@
+package commons
+
+import (
+	"time"
+
+	"github.com/danii7514/codpen/crdt"
+)
+
+// A Record is an entry of a room's recording, a file of JSON lines the server
+// writes when it records sessions. Replaying the records in order reproduces
+// what the room's clients sent and received.
+type Record struct {
+	Time time.Time `json:"time"`
+
+	// Kind tells what the record is about.
+	Kind RecordKind `json:"kind"`
+
+	// Seq is the number of the room's last operation, for records made while
+	// operations are relayed.
+	Seq uint64 `json:"seq,omitempty"`
+
+	// Client, Site and User identify the client the record is about. They are
+	// empty for operations and documents coming from the server itself, or from
+	// another server of the cluster.
+	Client string `json:"client,omitempty"`
+	Site   string `json:"site,omitempty"`
+	User   string `json:"user,omitempty"`
+
+	// Message is the message the client sent, for message and operation records.
+	Message *Message `json:"message,omitempty"`
+
+	// Document is the room's document, or the document sent to clients.
+	Document *crdt.Document `json:"document,omitempty"`
+
+	// Error tells why the server rejected the message, if it did.
+	Error string `json:"error,omitempty"`
+}
+
+// RecordKind is the kind of a Record.
+type RecordKind string
+
+// A recording starts with a start record and, unless the server stopped before
+// the room was closed, ends with an end record.
+const (
+	// RecordStart holds the room's document when the recording started.
+	RecordStart RecordKind = "start"
+
+	// RecordConnect is written when a client joins the room, with its site ID.
+	RecordConnect RecordKind = "connect"
+
+	// RecordMessage holds a message a client sent, other than an operation the
+	// room applied.
+	RecordMessage RecordKind = "message"
+
+	// RecordOperation holds an operation the room applied and relayed to its
+	// clients, in the order it was applied.
+	RecordOperation RecordKind = "operation"
+
+	// RecordDocument holds a document the server sent to a client, or to every
+	// client of the room when the record names none.
+	RecordDocument RecordKind = "document"
+
+	// RecordDisconnect is written when a client leaves the room.
+	RecordDisconnect RecordKind = "disconnect"
+
+	// RecordEnd holds the room's document when the recording stopped.
+	RecordEnd RecordKind = "end"
+)
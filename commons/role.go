@@ -0,0 +1,42 @@
+package commons
+
+// Role represents what a client is allowed to do in a room.
+type Role string
+
+// Currently, codpen supports 3 roles:
+// - owner (can edit, and manages the room)
+// - editor (can edit)
+// - viewer (can only read)
+
+const (
+	RoleOwner  Role = "owner"
+	RoleEditor Role = "editor"
+	RoleViewer Role = "viewer"
+)
+
+// Valid reports whether r is a known role.
+func (r Role) Valid() bool {
+	return r == RoleOwner || r == RoleEditor || r == RoleViewer
+}
+
+// CanEdit reports whether clients with the role may change the document.
+func (r Role) CanEdit() bool {
+	return r == RoleOwner || r == RoleEditor
+}
+
+// Includes reports whether r grants at least the permissions of other.
+func (r Role) Includes(other Role) bool {
+	return r.rank() >= other.rank()
+}
+
+// rank orders roles from least to most privileged.
+func (r Role) rank() int {
+	switch r {
+	case RoleOwner:
+		return 2
+	case RoleEditor:
+		return 1
+	default:
+		return 0
+	}
+}
@@ -2,8 +2,8 @@ package crdt
 
 import (
 	"errors"
-	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 )
@@ -167,6 +167,23 @@ func (doc *Document) Contains(charID string) bool {
 	return position != -1
 }
 
+// HasSite checks if the document has characters generated by the given site.
+func (doc *Document) HasSite(site int) bool {
+	prefix := strconv.Itoa(site) + "."
+	for _, char := range doc.Characters {
+		if strings.HasPrefix(char.ID, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// characterID returns the ID of the character generated by a site at a local clock.
+// The separator keeps the IDs of different sites apart, like 1 at 11 and 11 at 1.
+func characterID(site, clock int) string {
+	return strconv.Itoa(site) + "." + strconv.Itoa(clock)
+}
+
 // Find returns the character at the ID.
 func (doc *Document) Find(id string) Character {
 	for _, char := range doc.Characters {
@@ -276,7 +293,7 @@ func (doc *Document) GenerateInsert(position int, value string) (*Document, erro
 	}
 
 	char := Character{
-		ID:      fmt.Sprint(SiteID) + fmt.Sprint(LocalClock),
+		ID:      characterID(SiteID, LocalClock),
 		Visible: true,
 		Value:   value,
 		CP:      charPrev.ID,
@@ -179,3 +179,26 @@ func TestLoad(t *testing.T) {
 		t.Errorf("got != want; diff = %v\n", cmp.Diff(got, want))
 	}
 }
+
+func TestHasSite(t *testing.T) {
+	SiteID, LocalClock = 1, 10
+	doc := New()
+	if _, err := doc.Insert(1, "a"); err != nil {
+		t.Fatalf("error: %v\n", err)
+	}
+
+	// The site 1 with clock 11 and the site 11 with clock 1 don't share IDs.
+	tests := []struct {
+		site int
+		want bool
+	}{
+		{site: 1, want: true},
+		{site: 11, want: false},
+		{site: 0, want: false},
+	}
+	for _, tc := range tests {
+		if got := doc.HasSite(tc.site); got != tc.want {
+			t.Errorf("HasSite(%d) = %v, expected = %v\n", tc.site, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Command codpen-replay replays a session recorded by codpen-server with
+// -record-dir: it feeds the recorded operations and documents through fresh
+// replicas of the room's document, one for the server and one per client, and
+// reports the resulting document, and where the replicas and the recording
+// disagree.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// usage describes the command.
+const usage = `Usage: codpen-replay [flags] <recording>
+
+Replays a room's recording, and prints the room's text at the end of it,
+followed by a newline if it has none. Divergences between the replicas of the
+document and the recording are reported on standard error, and make the exit
+status 1.
+
+Flags:
+`
+
+// Flags represents the command-line flags that are passed to codpen-replay.
+type Flags struct {
+	// Speed is how many times faster than recorded the session is replayed, or
+	// zero to replay it without waiting.
+	Speed float64
+
+	// Verbose prints every record as it is replayed.
+	Verbose bool
+
+	// JSON prints a report of the replay as JSON instead of the room's text.
+	JSON bool
+}
+
+func main() {
+	flags, args := parseFlags(os.Args[1:], os.Stderr)
+	if len(args) != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "codpen-replay: %s\n", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	r := newReplayer()
+	if flags.Verbose {
+		r.trace = os.Stderr
+	}
+	if flags.Speed > 0 {
+		r.wait = func(d time.Duration) { time.Sleep(time.Duration(float64(d) / flags.Speed)) }
+	}
+	if err := r.replay(f); err != nil {
+		fmt.Fprintf(os.Stderr, "codpen-replay: %s\n", err)
+		os.Exit(1)
+	}
+
+	report := r.report()
+	if flags.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+	} else {
+		text := report.Text
+		if !strings.HasSuffix(text, "\n") {
+			text += "\n"
+		}
+		fmt.Fprint(os.Stdout, text)
+		for _, d := range report.Divergences {
+			fmt.Fprintf(os.Stderr, "divergence: %s\n", d)
+		}
+		fmt.Fprintf(os.Stderr, "%d records, %d operations, %d rejected messages, %d divergences\n", report.Records, report.Operations, report.Rejected, len(report.Divergences))
+	}
+	if len(report.Divergences) > 0 {
+		os.Exit(1)
+	}
+}
+
+// parseFlags parses command-line flags, and returns them with the remaining arguments.
+func parseFlags(arguments []string, out io.Writer) (Flags, []string) {
+	fs := flag.NewFlagSet("codpen-replay", flag.ExitOnError)
+	fs.SetOutput(out)
+	fs.Usage = func() {
+		fmt.Fprint(out, usage)
+		fs.PrintDefaults()
+	}
+	flag.Usage = fs.Usage
+
+	speed := fs.Float64("speed", 0, "How many times faster than recorded to replay: 1 for real time, 0 for no waiting")
+	verbose := fs.Bool("v", false, "Print every record as it is replayed")
+	jsonOutput := fs.Bool("json", false, "Print a report of the replay as JSON")
+
+	_ = fs.Parse(arguments)
+	if *speed < 0 {
+		fmt.Fprintln(out, "codpen-replay: -speed can't be negative")
+		os.Exit(2)
+	}
+
+	return Flags{Speed: *speed, Verbose: *verbose, JSON: *jsonOutput}, fs.Args()
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/danii7514/codpen/commons"
+	"github.com/danii7514/codpen/crdt"
+)
+
+// A replica is a copy of the room's document, as the server or a client holds it.
+type replica struct {
+	doc crdt.Document
+
+	// site is the site ID the replica generates characters with.
+	site int
+
+	// user is the name of the client holding the replica, if any.
+	user string
+}
+
+// A replayer replays the records of a recording through replicas of the
+// document. Replicas apply operations the way the server and clients do: the
+// server applies the operations in the order it relays them, and every client
+// applies them in the same order, so that replicas only diverge when the
+// documents clients actually sent differ from their replicas.
+type replayer struct {
+	// server is the server's replica, and clients those of the connected
+	// clients, by client ID.
+	server  replica
+	clients map[string]*replica
+
+	// records, operations and rejected count the records replayed, the
+	// operations applied and the messages the server rejected.
+	records, operations, rejected int
+
+	// divergences describes where replicas and the recording disagreed.
+	divergences []string
+
+	// last is the time of the last record replayed.
+	last time.Time
+
+	// wait waits for the time between two records, if set.
+	wait func(time.Duration)
+
+	// trace receives a line for every record replayed, if set.
+	trace io.Writer
+}
+
+// A report sums up a replay.
+type report struct {
+	// Text is the text of the server's replica at the end of the replay, and
+	// Document the replica itself.
+	Text     string        `json:"text"`
+	Document crdt.Document `json:"document"`
+
+	Records    int `json:"records"`
+	Operations int `json:"operations"`
+	Rejected   int `json:"rejected"`
+
+	Divergences []string `json:"divergences"`
+}
+
+// newReplayer returns a replayer with an empty document and no clients.
+func newReplayer() *replayer {
+	return &replayer{server: replica{doc: crdt.New()}, clients: make(map[string]*replica)}
+}
+
+// replay replays the records read from r, one JSON record per line.
+func (p *replayer) replay(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<30)
+	for line := 1; scanner.Scan(); line++ {
+		var rec commons.Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return fmt.Errorf("line %d: invalid record: %w", line, err)
+		}
+		if p.wait != nil && !p.last.IsZero() && rec.Time.After(p.last) {
+			p.wait(rec.Time.Sub(p.last))
+		}
+		p.last = rec.Time
+		p.apply(rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	// Whatever happened, the clients still connected should hold the server's text.
+	text := crdt.Content(p.server.doc)
+	for _, id := range p.clientIDs() {
+		if got := crdt.Content(p.clients[id].doc); got != text {
+			p.diverged(p.last, 0, "client %s ended with %q, the server with %q", p.clientName(id), got, text)
+		}
+	}
+	return nil
+}
+
+// apply replays a record.
+func (p *replayer) apply(rec commons.Record) {
+	p.records++
+	if p.trace != nil {
+		fmt.Fprintf(p.trace, "%s %s\n", rec.Time.Format("15:04:05.000"), p.describe(rec))
+	}
+
+	switch rec.Kind {
+	case commons.RecordStart:
+		if rec.Document != nil {
+			p.server.doc = copyDocument(*rec.Document)
+		}
+
+	case commons.RecordConnect:
+		// A client starts from the server's document, whether it gets it from
+		// the server or from another client.
+		p.clients[rec.Client] = &replica{doc: copyDocument(p.server.doc), site: parseSite(rec.Site), user: rec.User}
+
+	case commons.RecordDisconnect:
+		delete(p.clients, rec.Client)
+
+	case commons.RecordMessage:
+		p.applyMessage(rec)
+
+	case commons.RecordOperation:
+		if rec.Message == nil {
+			return
+		}
+		p.operations++
+		op := rec.Message.Operation
+		applyOperation(&p.server, op)
+		for _, c := range p.clients {
+			applyOperation(c, op)
+		}
+
+	case commons.RecordDocument:
+		if rec.Document == nil {
+			return
+		}
+		if rec.Client == "" {
+			p.server.doc = copyDocument(*rec.Document)
+			for _, c := range p.clients {
+				c.doc = copyDocument(*rec.Document)
+			}
+		} else if c := p.clients[rec.Client]; c != nil {
+			c.doc = copyDocument(*rec.Document)
+		}
+
+	case commons.RecordEnd:
+		if rec.Document == nil {
+			return
+		}
+		if want, got := crdt.Content(*rec.Document), crdt.Content(p.server.doc); want != got {
+			p.diverged(rec.Time, rec.Seq, "the room ended with %q, the replay with %q", want, got)
+		}
+	}
+}
+
+// applyMessage replays a message a client sent.
+func (p *replayer) applyMessage(rec commons.Record) {
+	msg, sender := rec.Message, p.clients[rec.Client]
+	if msg == nil {
+		return
+	}
+	if rec.Error != "" {
+		p.rejected++
+		// The client applied its operation before sending it, and is sent the
+		// server's document in return.
+		if msg.Type == commons.OperationMessage && sender != nil {
+			applyOperation(sender, msg.Operation)
+		}
+		return
+	}
+
+	switch msg.Type {
+	case commons.JoinMessage:
+		if sender != nil {
+			sender.user = msg.Username
+		}
+
+	case commons.DocSyncMessage:
+		// A client sends its document to a client joining the room, and the
+		// server takes it too.
+		if sender != nil {
+			if want, got := crdt.Content(msg.Document), crdt.Content(sender.doc); want != got {
+				p.diverged(rec.Time, rec.Seq, "client %s sent %q, its replica holds %q", p.clientName(rec.Client), want, got)
+			}
+		}
+		p.server.doc = copyDocument(msg.Document)
+		if c := p.clients[msg.ID.String()]; c != nil {
+			c.doc = copyDocument(msg.Document)
+		}
+	}
+}
+
+// applyOperation applies an operation to a replica, like the server and the
+// clients do.
+func applyOperation(r *replica, op commons.Operation) {
+	crdt.SiteID = r.site
+	switch op.Type {
+	case "insert":
+		_, _ = r.doc.Insert(op.Position, op.Value)
+	case "delete":
+		r.doc.Delete(op.Position)
+	}
+}
+
+// report returns the outcome of the replay.
+func (p *replayer) report() report {
+	divergences := p.divergences
+	if divergences == nil {
+		divergences = []string{}
+	}
+	return report{
+		Text:        crdt.Content(p.server.doc),
+		Document:    p.server.doc,
+		Records:     p.records,
+		Operations:  p.operations,
+		Rejected:    p.rejected,
+		Divergences: divergences,
+	}
+}
+
+// diverged notes a divergence found at time t, after operation seq.
+func (p *replayer) diverged(t time.Time, seq uint64, format string, args ...interface{}) {
+	d := fmt.Sprintf(format, args...)
+	if seq != 0 {
+		d = fmt.Sprintf("operation %d: %s", seq, d)
+	}
+	p.divergences = append(p.divergences, t.Format(time.RFC3339Nano)+": "+d)
+}
+
+// describe returns a line describing a record, for tracing.
+func (p *replayer) describe(rec commons.Record) string {
+	who := "server"
+	if rec.Client != "" {
+		who = p.clientName(rec.Client)
+		if rec.User != "" {
+			who = rec.User
+		}
+	}
+
+	s := fmt.Sprintf("%-10s %s", rec.Kind, who)
+	if msg := rec.Message; msg != nil {
+		if msg.Type == commons.OperationMessage {
+			s += fmt.Sprintf(" %s %q at %d", msg.Operation.Type, msg.Operation.Value, msg.Operation.Position)
+		} else {
+			s += " " + string(msg.Type)
+		}
+	}
+	if rec.Document != nil {
+		s += fmt.Sprintf(" %q", crdt.Content(*rec.Document))
+	}
+	if rec.Error != "" {
+		s += " rejected: " + rec.Error
+	}
+	return s
+}
+
+// clientName returns the name a client goes by in reports.
+func (p *replayer) clientName(id string) string {
+	if c := p.clients[id]; c != nil && c.user != "" {
+		return fmt.Sprintf("%s (%s)", id, c.user)
+	}
+	return id
+}
+
+// clientIDs returns the IDs of the connected clients, sorted.
+func (p *replayer) clientIDs() []string {
+	ids := make([]string, 0, len(p.clients))
+	for id := range p.clients {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// copyDocument returns a copy of doc which shares nothing with it.
+func copyDocument(doc crdt.Document) crdt.Document {
+	return crdt.Document{Characters: append([]crdt.Character(nil), doc.Characters...)}
+}
+
+// parseSite returns the site ID recorded as s, or 0 if there is none.
+func parseSite(s string) int {
+	site, _ := strconv.Atoi(s)
+	return site
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danii7514/codpen/commons"
+	"github.com/danii7514/codpen/crdt"
+	"github.com/google/uuid"
+)
+
+// document returns a document holding text.
+func document(t *testing.T, text string) *crdt.Document {
+	t.Helper()
+	doc := crdt.New()
+	for i, r := range []rune(text) {
+		if _, err := doc.Insert(i+1, string(r)); err != nil {
+			t.Fatalf("Failed to insert %q: %v", r, err)
+		}
+	}
+	return &doc
+}
+
+// operation returns the message of an operation.
+func operation(typ string, position int, value string) *commons.Message {
+	return &commons.Message{Type: commons.OperationMessage, Operation: commons.Operation{Type: typ, Position: position, Value: value}}
+}
+
+// session returns the records of a session in which alice types "hi", bob joins
+// and gets the document from alice, which is text, then has an operation
+// rejected and types "!". The room ends with end.
+func session(t *testing.T, text, end string) []commons.Record {
+	alice, bob := uuid.New(), uuid.New()
+	return []commons.Record{
+		{Kind: commons.RecordStart, Document: document(t, "")},
+		{Kind: commons.RecordConnect, Client: alice.String(), Site: "1"},
+		{Kind: commons.RecordMessage, Client: alice.String(), Message: &commons.Message{Type: commons.JoinMessage, Username: "alice"}},
+		{Kind: commons.RecordOperation, Seq: 1, Client: alice.String(), User: "alice", Message: operation("insert", 1, "h")},
+		{Kind: commons.RecordOperation, Seq: 2, Client: alice.String(), User: "alice", Message: operation("insert", 2, "i")},
+		{Kind: commons.RecordConnect, Client: bob.String(), Site: "2"},
+		{Kind: commons.RecordMessage, Client: alice.String(), Message: &commons.Message{Type: commons.DocSyncMessage, ID: bob, Document: *document(t, text)}},
+		{Kind: commons.RecordMessage, Client: bob.String(), Message: operation("insert", 9, "?"), Error: "invalid insert: position 9 is past the end of the text, at 3"},
+		{Kind: commons.RecordDocument, Seq: 2, Client: bob.String(), Document: document(t, text)},
+		{Kind: commons.RecordOperation, Seq: 3, Client: bob.String(), Message: operation("insert", 3, "!")},
+		{Kind: commons.RecordDisconnect, Client: alice.String()},
+		{Kind: commons.RecordEnd, Seq: 3, Document: document(t, end)},
+	}
+}
+
+func TestReplay(t *testing.T) {
+	tests := []struct {
+		description string
+		records     []commons.Record
+		text        string
+		divergences []string
+	}{
+		{description: "recorded session", records: session(t, "hi", "hi!"), text: "hi!"},
+		{description: "diverging session", records: session(t, "ho", "hi!"), text: "ho!", divergences: []string{
+			`12:00:00.6Z: client `,
+			`(alice) sent "ho", its replica holds "hi"`,
+			`operation 3: the room ended with "hi!", the replay with "ho!"`,
+		}},
+	}
+
+	start := time.Date(2024, 5, 6, 12, 0, 0, 0, time.UTC)
+	for _, tc := range tests {
+		var recording bytes.Buffer
+		enc := json.NewEncoder(&recording)
+		for i, rec := range tc.records {
+			rec.Time = start.Add(time.Duration(i) * 100 * time.Millisecond)
+			if err := enc.Encode(rec); err != nil {
+				t.Fatalf("(%s) failed to encode record: %v", tc.description, err)
+			}
+		}
+
+		r := newReplayer()
+		var waited time.Duration
+		r.wait = func(d time.Duration) { waited += d }
+		var trace strings.Builder
+		r.trace = &trace
+		if err := r.replay(&recording); err != nil {
+			t.Fatalf("(%s) failed to replay: %v", tc.description, err)
+		}
+
+		report := r.report()
+		if report.Text != tc.text {
+			t.Errorf("(%s) expected text %q, got %q", tc.description, tc.text, report.Text)
+		}
+		if report.Records != len(tc.records) || report.Operations != 3 || report.Rejected != 1 {
+			t.Errorf("(%s) expected %d records, 3 operations and 1 rejected message, got %d, %d and %d", tc.description, len(tc.records), report.Records, report.Operations, report.Rejected)
+		}
+		if got := strings.Join(report.Divergences, "\n"); len(tc.divergences) == 0 && got != "" {
+			t.Errorf("(%s) expected no divergences, got:\n%s", tc.description, got)
+		}
+		for _, want := range tc.divergences {
+			if got := strings.Join(report.Divergences, "\n"); !strings.Contains(got, want) {
+				t.Errorf("(%s) expected a divergence containing %q, got:\n%s", tc.description, want, got)
+			}
+		}
+		if want := time.Duration(len(tc.records)-1) * 100 * time.Millisecond; waited != want {
+			t.Errorf("(%s) expected to wait %s, waited %s", tc.description, want, waited)
+		}
+		if got := strings.Count(trace.String(), "\n"); got != len(tc.records) {
+			t.Errorf("(%s) expected a trace line per record, got %d", tc.description, got)
+		}
+	}
+}
+
+func TestReplayMalformed(t *testing.T) {
+	err := newReplayer().replay(strings.NewReader(`{"kind":"start"}` + "\nnot json\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Expected an error on line 2, got %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/danii7514/codpen/crdt"
+)
+
+// The admin socket is a Unix socket serving the room management API to local
+// operators, for example through codpen-admin. Requests on it need no access
+// token: whoever may open the socket, which only the server's user can by
+// default, is trusted with admin access.
+
+// snapshotTimeFormat is the format of the time in the names of snapshot files.
+const snapshotTimeFormat = "20060102T150405.000Z"
+
+var (
+	// snapshotDir is the directory room snapshots are written to. Snapshots are
+	// disabled if it is empty. It is protected by settingsMu.
+	snapshotDir string
+
+	ErrNoSnapshotDir = errors.New("snapshots are disabled: no snapshot directory is configured")
+)
+
+// AdminConfig holds the settings of the admin socket and snapshots.
+type AdminConfig struct {
+	// Socket is the path of the admin socket. It is disabled if empty.
+	Socket string `yaml:"socket"`
+
+	// SnapshotDir is the directory room snapshots are written to.
+	SnapshotDir string `yaml:"snapshot_dir"`
+}
+
+// A snapshot is a room's document at some point, as written to a snapshot file.
+type snapshot struct {
+	Room     string        `json:"room"`
+	ID       string        `json:"id"`
+	Seq      uint64        `json:"seq"`
+	Time     time.Time     `json:"time"`
+	Text     string        `json:"text"`
+	Document crdt.Document `json:"document"`
+}
+
+// trustedKey is the context key marking requests made on the admin socket.
+type trustedKey struct{}
+
+// isTrusted reports whether a request was made on the admin socket.
+func isTrusted(r *http.Request) bool {
+	trusted, _ := r.Context().Value(trustedKey{}).(bool)
+	return trusted
+}
+
+// newAdminMux returns the request router of the admin socket.
+func newAdminMux() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/rooms", handleRooms)
+	mux.HandleFunc("/rooms/", handleRoom)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), trustedKey{}, true)))
+	})
+}
+
+// listenAdmin listens on the admin socket at path, replacing the socket left by
+// a server which didn't stop cleanly.
+func listenAdmin(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("admin socket %s is in use by another server", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// handleRoomSnapshot serves /rooms/{room}/snapshot.
+func handleRoomSnapshot(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	room := findRoom(name)
+	if room == nil {
+		writeError(w, http.StatusNotFound, ErrRoomNotFound)
+		return
+	}
+
+	path, err := room.snapshot(currentSnapshotDir())
+	if errors.Is(err, ErrNoSnapshotDir) {
+		writeError(w, http.StatusNotImplemented, err)
+		return
+	}
+	if err != nil {
+		room.log().WithError(err).Error("Failed to snapshot room")
+		writeError(w, http.StatusInternalServerError, errors.New("failed to write snapshot"))
+		return
+	}
+	room.log().WithField("file", path).Info("Wrote snapshot via the API")
+	room.emitEvent(eventContentSaved, map[string]string{"source": "snapshot", "file": path})
+	writeJSON(w, http.StatusCreated, map[string]string{"file": path})
+}
+
+// snapshot writes the room's document to a new file in dir, and returns its path.
+func (r *Room) snapshot(dir string) (string, error) {
+	if dir == "" {
+		return "", ErrNoSnapshotDir
+	}
+
+	s := snapshot{Room: r.name(), ID: r.ID, Time: time.Now().UTC()}
+	r.relayMu.Lock()
+	s.Seq, s.Document = r.seq, r.document()
+	r.relayMu.Unlock()
+	s.Text = crdt.Content(s.Document)
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, snapshotFileName(s.Room, s.Time))
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	// Writing to a temporary file first keeps a crash from leaving half a snapshot.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return path, nil
+}
+
+// snapshotFileName returns the name of the file holding a snapshot of a room
+// taken at t. Characters not safe in file names are replaced in the room's name.
+func snapshotFileName(room string, t time.Time) string {
+	safe := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, room)
+	return safe + "-" + t.UTC().Format(snapshotTimeFormat) + ".json"
+}
+
+// currentSnapshotDir returns the directory room snapshots are written to.
+func currentSnapshotDir() string {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return snapshotDir
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/danii7514/codpen/crdt"
+	"github.com/google/uuid"
+)
+
+// adminRequest sends a request to the admin socket at path and decodes the JSON
+// response into v, if not nil.
+func adminRequest(t *testing.T, path, method, target string, v interface{}) int {
+	t.Helper()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+	req, err := http.NewRequest(method, "http://codpen"+target, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAdminSocket(t *testing.T) {
+	// Requests on the admin socket need no token, even with authentication enabled.
+	authSecret = []byte("secret")
+	defer func() { authSecret = nil }()
+
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	l, err := listenAdmin(path)
+	if err != nil {
+		t.Fatalf("Failed to listen on the admin socket: %v", err)
+	}
+	server := &http.Server{Handler: newAdminMux()}
+	go server.Serve(l)
+	defer server.Close()
+
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected the socket to be private, got %v, %v", info.Mode(), err)
+	}
+	if _, err := listenAdmin(path); err == nil {
+		t.Errorf("Expected an error listening on a socket in use")
+	}
+
+	name := uuid.New().String()
+	if _, err := createRoom(name, "hello"); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	defer deleteRoom(name, "")
+
+	if status := adminRequest(t, path, http.MethodGet, "/rooms", nil); status != http.StatusOK {
+		t.Errorf("Expected status %d listing rooms, got %d", http.StatusOK, status)
+	}
+	var doc crdt.Document
+	if status := adminRequest(t, path, http.MethodGet, "/rooms/"+name+"/content?format=json", &doc); status != http.StatusOK || crdt.Content(doc) != "hello" {
+		t.Errorf("Expected status %d and the room's document, got %d and %q", http.StatusOK, status, crdt.Content(doc))
+	}
+
+	// Snapshots are only written once a directory is configured.
+	if status := adminRequest(t, path, http.MethodPost, "/rooms/"+name+"/snapshot", nil); status != http.StatusNotImplemented {
+		t.Errorf("Expected status %d without a snapshot directory, got %d", http.StatusNotImplemented, status)
+	}
+
+	snapshotDir = t.TempDir()
+	defer func() { snapshotDir = "" }()
+	var resp struct {
+		File string `json:"file"`
+	}
+	if status := adminRequest(t, path, http.MethodPost, "/rooms/"+name+"/snapshot", &resp); status != http.StatusCreated {
+		t.Fatalf("Expected status %d writing a snapshot, got %d", http.StatusCreated, status)
+	}
+	data, err := os.ReadFile(resp.File)
+	if err != nil {
+		t.Fatalf("Failed to read snapshot: %v", err)
+	}
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		t.Fatalf("Failed to decode snapshot: %v", err)
+	}
+	if s.Room != name || s.Text != "hello" || crdt.Content(s.Document) != "hello" {
+		t.Errorf("Unexpected snapshot: %+v", s)
+	}
+}
+
+func TestSnapshotFileName(t *testing.T) {
+	at := time.Date(2024, 5, 6, 7, 8, 9, 10e6, time.UTC)
+
+	tests := []struct {
+		room string
+		want string
+	}{
+		{room: "notes", want: "notes-20240506T070809.010Z.json"},
+		{room: "../etc/passwd", want: "___etc_passwd-20240506T070809.010Z.json"},
+		{room: "héllo wörld", want: "h_llo_w_rld-20240506T070809.010Z.json"},
+	}
+
+	for _, tc := range tests {
+		if got := snapshotFileName(tc.room, at); got != tc.want {
+			t.Errorf("(%s) expected %q, got %q", tc.room, tc.want, got)
+		}
+	}
+}
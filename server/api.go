@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/danii7514/codpen/commons"
+	"github.com/google/uuid"
+)
+
+// The room management API is a JSON HTTP API served under /rooms:
+//
+//	GET    /rooms                     lists rooms
+//	POST   /rooms                     creates a room, optionally with initial content
+//	GET    /rooms/{room}              returns a room, its participants and its text
+//	PATCH  /rooms/{room}              renames a room
+//	DELETE /rooms/{room}              closes a room, disconnecting its participants
+//	DELETE /rooms/{room}/clients/{id} kicks a participant, with an optional ?reason=
+//	GET    /rooms/{room}/bans         lists a room's bans
+//	POST   /rooms/{room}/bans         bans users from a room
+//	DELETE /rooms/{room}/bans/{id}    lifts a ban
+//	POST   /rooms/{room}/snapshot     writes a room's document to the snapshot directory
+//	GET    /rooms/{room}/audit        queries a room's audit log, see handleRoomAudit
+//
+// When authentication is enabled, requests must carry an access token with the
+// admin claim, unless they are made on the admin socket. The owner of a room may
+// also kick and ban its participants with their own token. When it is disabled,
+// only the admin socket may use the API, unless it is opened with -open-api.
+// Requests with a body must send it as application/json. The content of rooms is
+// served under /rooms/{room}/content, see handleRoomContent.
+
+// roomDeletedReason is the close reason sent to clients of a deleted room.
+const roomDeletedReason = "room deleted"
+
+// kickedReason is the close reason sent to kicked clients.
+const kickedReason = "kicked from the room"
+
+var (
+	ErrNotAdmin  = errors.New("access token doesn't grant admin access")
+	ErrNotOwner  = errors.New("access token doesn't belong to the room's owner or an admin")
+	ErrAPIClosed = errors.New("the API is only served on the admin socket while authentication is disabled, unless -open-api is set")
+	ErrNotJSON   = errors.New("the request body must be application/json")
+)
+
+// A roomSummary describes a room in a room listing.
+type roomSummary struct {
+	Name      string `json:"name"`
+	ID        string `json:"id"`
+	Clients   int    `json:"clients"`
+	Protected bool   `json:"protected"`
+}
+
+// A roomDetails describes a single room.
+type roomDetails struct {
+	roomSummary
+	Participants []participant `json:"participants"`
+	Text         string        `json:"text"`
+}
+
+// A participant describes a client connected to a room.
+type participant struct {
+	ID       uuid.UUID    `json:"id"`
+	Username string       `json:"username"`
+	SiteID   string       `json:"siteID"`
+	Role     commons.Role `json:"role"`
+}
+
+// A createRoomRequest is the body of a POST /rooms request.
+type createRoomRequest struct {
+	Name    string `json:"name"`
+	Content string `json:"content"`
+}
+
+// A renameRoomRequest is the body of a PATCH /rooms/{room} request.
+type renameRoomRequest struct {
+	Name string `json:"name"`
+}
+
+// handleRooms serves /rooms.
+func handleRooms(w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdmin(w, r) || !requireJSON(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string][]roomSummary{"rooms": listRooms()})
+
+	case http.MethodPost:
+		var req createRoomRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+			writeError(w, http.StatusBadRequest, errors.New("a room name is required"))
+			return
+		}
+		room, err := createRoom(req.Name, req.Content)
+		if err != nil {
+			writeError(w, statusFor(err), err)
+			return
+		}
+		room.auditText(requestUser(r))
+		room.log().Info("Created room via the API")
+		writeJSON(w, http.StatusCreated, describeRoom(room))
+
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+// handleRoom serves /rooms/{room} and the paths below it.
+func handleRoom(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/rooms/"), "/")
+	name := parts[0]
+
+	// The content of a room is also available to the users who can join it.
+	if len(parts) == 2 && parts[1] == "content" {
+		handleRoomContent(w, r, name)
+		return
+	}
+
+	// Owners may moderate their room.
+	moderation := len(parts) == 3 && parts[1] == "clients" ||
+		(len(parts) == 2 || len(parts) == 3) && parts[1] == "bans"
+	if moderation {
+		room := findRoom(name)
+		if room == nil {
+			if authorizeAdmin(w, r) {
+				writeError(w, http.StatusNotFound, ErrRoomNotFound)
+			}
+			return
+		}
+		if !authorizeOwner(w, r, room) || !requireJSON(w, r) {
+			return
+		}
+		if parts[1] == "clients" {
+			handleRoomClient(w, r, room, parts[2])
+		} else {
+			handleRoomBans(w, r, room, parts[2:])
+		}
+		return
+	}
+
+	if !authorizeAdmin(w, r) || !requireJSON(w, r) {
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		handleRoomResource(w, r, name)
+	case len(parts) == 2 && parts[1] == "snapshot":
+		handleRoomSnapshot(w, r, name)
+	case (len(parts) == 2 || len(parts) == 3) && parts[1] == "audit":
+		handleRoomAudit(w, r, name, parts[2:])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleRoomResource serves /rooms/{room}.
+func handleRoomResource(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case http.MethodGet:
+		room := findRoom(name)
+		if room == nil {
+			writeError(w, http.StatusNotFound, ErrRoomNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, describeRoom(room))
+
+	case http.MethodPatch:
+		var req renameRoomRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+			writeError(w, http.StatusBadRequest, errors.New("a new room name is required"))
+			return
+		}
+		room, err := renameRoom(name, req.Name)
+		if err != nil {
+			writeError(w, statusFor(err), err)
+			return
+		}
+		room.auditRename(name, requestUser(r))
+		room.log().WithField("old_name", name).Info("Renamed room via the API")
+		writeJSON(w, http.StatusOK, describeRoom(room))
+
+	case http.MethodDelete:
+		if err := deleteRoom(name, roomDeletedReason); err != nil {
+			writeError(w, statusFor(err), err)
+			return
+		}
+		logger.WithField("room", name).Info("Deleted room via the API")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPatch, http.MethodDelete)
+	}
+}
+
+// handleRoomClient serves /rooms/{room}/clients/{id}.
+func handleRoomClient(w http.ResponseWriter, r *http.Request, room *Room, clientID string) {
+	if r.Method != http.MethodDelete {
+		methodNotAllowed(w, http.MethodDelete)
+		return
+	}
+
+	id, err := uuid.Parse(clientID)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("invalid client ID"))
+		return
+	}
+
+	reason := kickedReason
+	if text := r.URL.Query().Get("reason"); text != "" {
+		reason = truncateReason(kickedReason + ": " + text)
+	}
+	if !room.kick(id, reason) {
+		writeError(w, http.StatusNotFound, errors.New("client not found"))
+		return
+	}
+	room.log().WithField("client", id).Info("Kicked client via the API")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requireJSON checks that a request which may carry a body declares it as JSON,
+// responding with an error if it doesn't. Browsers send cross-site POSTs of forms
+// and plain text without asking the server first, but not of JSON.
+func requireJSON(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodPatch {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		writeError(w, http.StatusUnsupportedMediaType, ErrNotJSON)
+		return false
+	}
+	return true
+}
+
+// authorizeAdmin checks that a request may use the API, responding with an error
+// if it may not.
+func authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	return authorize(w, r, nil)
+}
+
+// authorizeOwner checks that a request may moderate a room, responding with an
+// error if it may not. Besides admins, the room's owner may.
+func authorizeOwner(w http.ResponseWriter, r *http.Request, room *Room) bool {
+	return authorize(w, r, room)
+}
+
+// authorize checks that a request comes from an admin, or from the owner of
+// room if it isn't nil, responding with an error if it doesn't.
+func authorize(w http.ResponseWriter, r *http.Request, room *Room) bool {
+	if isTrusted(r) {
+		return true
+	}
+	secret := currentAuthSecret()
+	if len(secret) == 0 {
+		if currentOpenAPI() {
+			return true
+		}
+		writeError(w, http.StatusForbidden, ErrAPIClosed)
+		return false
+	}
+
+	token := tokenFromRequest(r)
+	if token == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="codpen"`)
+		writeError(w, http.StatusUnauthorized, ErrNoToken)
+		return false
+	}
+
+	claims, err := parseToken(token, secret)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="codpen"`)
+		writeError(w, http.StatusUnauthorized, err)
+		return false
+	}
+
+	if claims.Admin {
+		return true
+	}
+	if room == nil {
+		writeError(w, http.StatusForbidden, ErrNotAdmin)
+		return false
+	}
+	if claims.Subject == "" || claims.Subject != room.Policy.owner() {
+		writeError(w, http.StatusForbidden, ErrNotOwner)
+		return false
+	}
+	return true
+}
+
+// listRooms returns a summary of every room, sorted by name.
+func listRooms() []roomSummary {
+	roomsMapMutex.Lock()
+	rooms := make([]*Room, 0, len(roomsMap))
+	for _, room := range roomsMap {
+		rooms = append(rooms, room)
+	}
+	roomsMapMutex.Unlock()
+
+	summaries := make([]roomSummary, 0, len(rooms))
+	for _, room := range rooms {
+		summaries = append(summaries, summarizeRoom(room))
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Name < summaries[j].Name })
+	return summaries
+}
+
+// summarizeRoom returns a summary of a room.
+func summarizeRoom(room *Room) roomSummary {
+	roomsMapMutex.Lock()
+	name := room.Name
+	roomsMapMutex.Unlock()
+
+	room.Clients.mu.RLock()
+	clients := len(room.Clients.list)
+	room.Clients.mu.RUnlock()
+
+	return roomSummary{Name: name, ID: room.ID, Clients: clients, Protected: room.password != nil}
+}
+
+// describeRoom returns the details of a room.
+func describeRoom(room *Room) roomDetails {
+	details := roomDetails{
+		roomSummary:  summarizeRoom(room),
+		Participants: []participant{},
+		Text:         room.text(),
+	}
+
+	for client := range room.Clients.getAll() {
+		client.mu.Lock()
+		details.Participants = append(details.Participants, participant{
+			ID:       client.id,
+			Username: client.Username,
+			SiteID:   client.SiteID,
+			Role:     client.role,
+		})
+		client.mu.Unlock()
+	}
+	sort.Slice(details.Participants, func(i, j int) bool {
+		return details.Participants[i].Username < details.Participants[j].Username
+	})
+
+	return details
+}
+
+// statusFor returns the HTTP status for an error returned by the room functions.
+func statusFor(err error) int {
+	switch {
+	case errors.Is(err, ErrRoomNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrRoomExists):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeJSON writes v as a JSON response with the given status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.WithError(err).Error("Failed to write response")
+	}
+}
+
+// writeError writes err as a JSON error response with the given status.
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// methodNotAllowed responds with 405 Method Not Allowed, listing the allowed methods.
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+}
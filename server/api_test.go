@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danii7514/codpen/commons"
+	"github.com/danii7514/codpen/crdt"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// apiRequest sends a request to the API of server and decodes the JSON response into v, if not nil.
+func apiRequest(t *testing.T, server *httptest.Server, method, path string, body interface{}, v interface{}) int {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatalf("Failed to encode request: %v", err)
+		}
+	}
+
+	req, err := http.NewRequest(method, server.URL+path, &buf)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// withOpenAPI opens the room management API while authentication is disabled,
+// until the test ends.
+func withOpenAPI(t *testing.T) {
+	original := openAPI
+	openAPI = true
+	t.Cleanup(func() { openAPI = original })
+}
+
+// readUntil reads messages from conn until one has the given type.
+func readUntil(t *testing.T, conn *websocket.Conn, msgType commons.MessageType) commons.Message {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var msg commons.Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("Failed to read %s message: %v", msgType, err)
+		}
+		if msg.Type == msgType {
+			return msg
+		}
+	}
+}
+
+func TestRoomsAPI(t *testing.T) {
+	withOpenAPI(t)
+	drainChannels(t)
+
+	server := httptest.NewServer(newMux())
+	defer server.Close()
+
+	name := uuid.New().String()
+	newName := uuid.New().String()
+
+	var created roomDetails
+	if status := apiRequest(t, server, http.MethodPost, "/rooms", createRoomRequest{Name: name, Content: "héllo\nworld"}, &created); status != http.StatusCreated {
+		t.Fatalf("Expected status %d creating room, got %d", http.StatusCreated, status)
+	}
+	if created.Name != name || created.Text != "héllo\nworld" {
+		t.Errorf("Unexpected room created: %+v", created)
+	}
+
+	if status := apiRequest(t, server, http.MethodPost, "/rooms", createRoomRequest{Name: name}, nil); status != http.StatusConflict {
+		t.Errorf("Expected status %d creating an existing room, got %d", http.StatusConflict, status)
+	}
+
+	// A client joining the room gets its initial content from the server.
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:]+"/ws?room="+name, nil)
+	if err != nil {
+		t.Fatalf("Failed to establish WebSocket connection: %v", err)
+	}
+	defer conn.Close()
+	if msg := readUntil(t, conn, commons.DocSyncMessage); crdt.Content(msg.Document) != "héllo\nworld" {
+		t.Errorf("Expected the room's content to be synced, got %q", crdt.Content(msg.Document))
+	}
+
+	var list struct {
+		Rooms []roomSummary `json:"rooms"`
+	}
+	apiRequest(t, server, http.MethodGet, "/rooms", nil, &list)
+	found := false
+	for _, room := range list.Rooms {
+		if room.Name == name {
+			found = true
+			if room.Clients != 1 {
+				t.Errorf("Expected 1 client in the room, got %d", room.Clients)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Expected room %s to be listed, got %+v", name, list.Rooms)
+	}
+
+	var renamed roomDetails
+	if status := apiRequest(t, server, http.MethodPatch, "/rooms/"+name, renameRoomRequest{Name: newName}, &renamed); status != http.StatusOK {
+		t.Fatalf("Expected status %d renaming room, got %d", http.StatusOK, status)
+	}
+	if status := apiRequest(t, server, http.MethodGet, "/rooms/"+name, nil, nil); status != http.StatusNotFound {
+		t.Errorf("Expected status %d for the old name, got %d", http.StatusNotFound, status)
+	}
+	if len(renamed.Participants) != 1 {
+		t.Fatalf("Expected 1 participant, got %+v", renamed.Participants)
+	}
+
+	// Kick the participant.
+	clientPath := "/rooms/" + newName + "/clients/" + renamed.Participants[0].ID.String()
+	if status := apiRequest(t, server, http.MethodDelete, clientPath, nil, nil); status != http.StatusNoContent {
+		t.Errorf("Expected status %d kicking client, got %d", http.StatusNoContent, status)
+	}
+	if ce := readCloseError(t, conn); ce.Text != kickedReason {
+		t.Errorf("Expected close reason %q, got %q", kickedReason, ce.Text)
+	}
+	if status := apiRequest(t, server, http.MethodDelete, clientPath, nil, nil); status != http.StatusNotFound {
+		t.Errorf("Expected status %d kicking a missing client, got %d", http.StatusNotFound, status)
+	}
+
+	if status := apiRequest(t, server, http.MethodDelete, "/rooms/"+newName, nil, nil); status != http.StatusNoContent {
+		t.Errorf("Expected status %d deleting room, got %d", http.StatusNoContent, status)
+	}
+	if status := apiRequest(t, server, http.MethodGet, "/rooms/"+newName, nil, nil); status != http.StatusNotFound {
+		t.Errorf("Expected status %d for a deleted room, got %d", http.StatusNotFound, status)
+	}
+}
+
+// TestRoomsAPIDelete checks that deleting a room disconnects its clients.
+func TestRoomsAPIDelete(t *testing.T) {
+	drainChannels(t)
+	withOpenAPI(t)
+
+	server := httptest.NewServer(newMux())
+	defer server.Close()
+
+	name := uuid.New().String()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:]+"/ws?room="+name, nil)
+	if err != nil {
+		t.Fatalf("Failed to establish WebSocket connection: %v", err)
+	}
+	defer conn.Close()
+	readUntil(t, conn, commons.RoleMessage)
+
+	if status := apiRequest(t, server, http.MethodDelete, "/rooms/"+name, nil, nil); status != http.StatusNoContent {
+		t.Fatalf("Expected status %d deleting room, got %d", http.StatusNoContent, status)
+	}
+	if ce := readCloseError(t, conn); ce.Text != roomDeletedReason {
+		t.Errorf("Expected close reason %q, got %q", roomDeletedReason, ce.Text)
+	}
+}
+
+func TestRoomsAPIAuth(t *testing.T) {
+	authSecret = []byte("secret")
+	defer func() { authSecret = nil }()
+
+	admin, _ := signToken(Claims{Subject: "root", Admin: true}, authSecret)
+	user, _ := signToken(Claims{Subject: "alice", Rooms: []string{"*"}}, authSecret)
+
+	tests := []struct {
+		description string
+		token       string
+		status      int
+	}{
+		{description: "no token", status: http.StatusUnauthorized},
+		{description: "not an admin", token: user, status: http.StatusForbidden},
+		{description: "admin", token: admin, status: http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/rooms", nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		rec := httptest.NewRecorder()
+		newMux().ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("(%s) expected status %d, got %d", tc.description, tc.status, rec.Code)
+		}
+	}
+}
+
+// TestRoomsAPIOpen checks who may use the API while authentication is disabled,
+// and that it only takes JSON bodies.
+func TestRoomsAPIOpen(t *testing.T) {
+	tests := []struct {
+		description string
+		open        bool
+		trusted     bool
+		method      string
+		contentType string
+		status      int
+	}{
+		{description: "closed", method: http.MethodGet, status: http.StatusForbidden},
+		{description: "admin socket", trusted: true, method: http.MethodGet, status: http.StatusOK},
+		{description: "opened", open: true, method: http.MethodGet, status: http.StatusOK},
+		{description: "closed creation", method: http.MethodPost, contentType: "application/json", status: http.StatusForbidden},
+		{description: "plain text creation", open: true, method: http.MethodPost, contentType: "text/plain", status: http.StatusUnsupportedMediaType},
+		{description: "form creation", trusted: true, method: http.MethodPost, contentType: "application/x-www-form-urlencoded", status: http.StatusUnsupportedMediaType},
+		{description: "JSON creation", open: true, method: http.MethodPost, contentType: "application/json; charset=utf-8", status: http.StatusCreated},
+	}
+
+	for _, tc := range tests {
+		openAPI = tc.open
+		name := uuid.New().String()
+		req := httptest.NewRequest(tc.method, "/rooms", strings.NewReader(`{"name":"`+name+`"}`))
+		if tc.contentType != "" {
+			req.Header.Set("Content-Type", tc.contentType)
+		}
+		if tc.trusted {
+			req = req.WithContext(context.WithValue(req.Context(), trustedKey{}, true))
+		}
+		rec := httptest.NewRecorder()
+		newMux().ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("(%s) expected status %d, got %d", tc.description, tc.status, rec.Code)
+		}
+		if tc.method == http.MethodPost && tc.status != http.StatusCreated && findRoom(name) != nil {
+			t.Errorf("(%s) expected the room not to be created", tc.description)
+		}
+		_ = deleteRoom(name, "")
+	}
+	openAPI = false
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/danii7514/codpen/commons"
+	"github.com/danii7514/codpen/crdt"
+)
+
+// Every change to a room's document is appended to the room's audit log, a file
+// of JSON lines in the audit directory named after the room. An entry records
+// who made the change and when, and the characters it inserted or deleted, with
+// their IDs in the server's document. Since the log holds every change in the
+// order it was applied, replaying it tells which user wrote each character of
+// the text, see contributions.
+//
+// The log of a room is kept across the room's lives: a room closed and later
+// opened again under the same name appends to the same log. A renamed room
+// notes the rename in its old log, and starts its new log with its text.
+//
+// The log is queried through the room management API:
+//
+//	GET /rooms/{room}/audit                      returns entries, filtered by ?user=, ?since= and ?until=
+//	GET /rooms/{room}/audit/contributions?user=  returns what a user wrote that is still in the text
+
+// Types of audit log entries, besides the "insert" and "delete" operations.
+const (
+	// auditReplace replaces the whole text of the room, for example when it is
+	// created or its content is uploaded.
+	auditReplace = "replace"
+
+	// auditRename ends the log of a room renamed to the entry's text.
+	auditRename = "rename"
+)
+
+// maxAuditEntries bounds the entries returned by a query.
+const maxAuditEntries = 10000
+
+var (
+	// auditDir is the directory audit logs are written to. Auditing is disabled
+	// if it is empty.
+	auditDir string
+
+	ErrNoAuditDir = errors.New("auditing is disabled: no audit directory is configured")
+)
+
+// AuditConfig holds the settings of audit logs.
+type AuditConfig struct {
+	// Dir is the directory audit logs are written to. Auditing is disabled if it is empty.
+	Dir string `yaml:"dir"`
+}
+
+// An auditEntry records a change to a room's document.
+type auditEntry struct {
+	Time time.Time `json:"time"`
+
+	// Seq is the number of the operation in the room, see Room.record.
+	Seq uint64 `json:"seq"`
+
+	// User is the name of the user who made the change. It is empty for changes
+	// received from Node, another server of the cluster.
+	User   string `json:"user,omitempty"`
+	Client string `json:"client,omitempty"`
+	Site   string `json:"site,omitempty"`
+	Node   string `json:"node,omitempty"`
+
+	// Type is "insert", "delete", "replace" or "rename".
+	Type     string `json:"type"`
+	Position int    `json:"position,omitempty"`
+
+	// Character is the ID of the character inserted or deleted, and Text its
+	// value. Text is the new text of a replace entry, and the new name of the
+	// room of a rename entry.
+	Character string `json:"character,omitempty"`
+	Text      string `json:"text"`
+}
+
+// An auditFilter selects audit log entries. Its zero value selects them all.
+type auditFilter struct {
+	User         string
+	Since, Until time.Time
+}
+
+// A contribution is what a user wrote in a room.
+type contribution struct {
+	User string `json:"user"`
+
+	// Inserted and Deleted count the characters the user inserted and deleted.
+	Inserted int `json:"inserted"`
+	Deleted  int `json:"deleted"`
+
+	// Text holds the characters the user wrote that are still in the room's
+	// text, in order. Characters set by replacing the text belong to the user
+	// who replaced it.
+	Text string `json:"text"`
+}
+
+// An auditLog appends to a room's audit log.
+type auditLog struct {
+	mu sync.Mutex
+
+	// f is the open log file of the room named name.
+	f    *os.File
+	name string
+}
+
+// auditFileName returns the name of the audit log of a room.
+func auditFileName(room string) string {
+	return url.PathEscape(room) + ".audit.jsonl"
+}
+
+// audit appends an entry to the room's audit log, if auditing is enabled.
+// relayMu must be held, so that entries are written in the order the changes
+// are applied. roomsMapMutex must not be held.
+func (r *Room) audit(e auditEntry) {
+	if auditDir == "" {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if e.Seq == 0 {
+		e.Seq = r.seq
+	}
+
+	r.auditLog.mu.Lock()
+	defer r.auditLog.mu.Unlock()
+	if r.auditLog.f == nil {
+		r.auditLog.name = r.name()
+	}
+	if err := r.auditLog.write(e); err != nil {
+		r.log().WithError(err).Error("Failed to write to the audit log")
+	}
+}
+
+// write appends an entry to the log, opening it if needed. l.mu must be held.
+func (l *auditLog) write(e auditEntry) error {
+	if l.f == nil {
+		if err := os.MkdirAll(auditDir, 0o700); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(filepath.Join(auditDir, auditFileName(l.name)), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return err
+		}
+		l.f = f
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = l.f.Write(append(line, '\n'))
+	return err
+}
+
+// close closes the log file, if open.
+func (l *auditLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		l.f.Close()
+		l.f = nil
+	}
+}
+
+// auditText records that user set the room's text, for example when creating it.
+func (r *Room) auditText(user string) {
+	r.relayMu.Lock()
+	defer r.relayMu.Unlock()
+	r.audit(auditEntry{User: user, Type: auditReplace, Text: r.text()})
+}
+
+// auditRename moves the room's audit log after it was renamed from oldName by user.
+func (r *Room) auditRename(oldName, user string) {
+	if auditDir == "" {
+		return
+	}
+	r.relayMu.Lock()
+	defer r.relayMu.Unlock()
+
+	newName := r.name()
+	r.auditLog.mu.Lock()
+	if r.auditLog.f == nil {
+		r.auditLog.name = oldName
+	}
+	err := r.auditLog.write(auditEntry{Time: time.Now().UTC(), Seq: r.seq, User: user, Type: auditRename, Text: newName})
+	if r.auditLog.f != nil {
+		r.auditLog.f.Close()
+		r.auditLog.f = nil
+	}
+	r.auditLog.mu.Unlock()
+	if err != nil {
+		r.log().WithError(err).Error("Failed to write to the audit log")
+	}
+
+	r.audit(auditEntry{User: user, Type: auditReplace, Text: r.text()})
+}
+
+// auditOperation records an operation which inserted or deleted char at
+// position, made by the user described by e. Operations which changed nothing
+// aren't recorded. relayMu must be held.
+func (r *Room) auditOperation(e auditEntry, op commons.Operation, char crdt.Character) {
+	if char.ID == "" {
+		return
+	}
+	e.Type, e.Position, e.Character, e.Text = op.Type, op.Position, char.ID, char.Value
+	r.audit(e)
+}
+
+// readAudit returns the entries of a room's audit log selected by filter, up to
+// limit of them.
+func readAudit(room string, filter auditFilter, limit int) ([]auditEntry, error) {
+	f, err := os.Open(filepath.Join(auditDir, auditFileName(room)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []auditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<30)
+	for scanner.Scan() && len(entries) < limit {
+		var e auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("corrupt audit log: %w", err)
+		}
+		if filter.matches(e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// matches reports whether the filter selects an entry.
+func (f auditFilter) matches(e auditEntry) bool {
+	return (f.User == "" || e.User == f.User) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until))
+}
+
+// contributions replays audit log entries, and returns what user contributed to
+// the text they lead to.
+func contributions(entries []auditEntry, user string) contribution {
+	// authored holds the text's characters and who wrote them.
+	type authoredChar struct {
+		id, user, value string
+	}
+	var authored []authoredChar
+	c := contribution{User: user}
+
+	for _, e := range entries {
+		switch e.Type {
+		case auditReplace:
+			authored = authored[:0]
+			for _, r := range e.Text {
+				authored = append(authored, authoredChar{user: e.User, value: string(r)})
+			}
+
+		case "insert":
+			// Like crdt.Document.Insert, position counts from 1 and inserts
+			// past the end append.
+			i := e.Position - 1
+			if i < 0 {
+				i = 0
+			}
+			if i > len(authored) {
+				i = len(authored)
+			}
+			authored = append(authored, authoredChar{})
+			copy(authored[i+1:], authored[i:])
+			authored[i] = authoredChar{id: e.Character, user: e.User, value: e.Text}
+			if e.User == user {
+				c.Inserted++
+			}
+
+		case "delete":
+			if e.Character == "" {
+				continue
+			}
+			i := -1
+			for j, char := range authored {
+				if char.id == e.Character {
+					i = j
+					break
+				}
+			}
+			if i < 0 && e.Position >= 1 && e.Position <= len(authored) {
+				i = e.Position - 1
+			}
+			if i >= 0 {
+				authored = append(authored[:i], authored[i+1:]...)
+			}
+			if e.User == user {
+				c.Deleted++
+			}
+		}
+	}
+
+	for _, char := range authored {
+		if char.user == user {
+			c.Text += char.value
+		}
+	}
+	return c
+}
+
+// handleRoomAudit serves /rooms/{room}/audit and /rooms/{room}/audit/contributions.
+// rest holds the path segments after "audit".
+func handleRoomAudit(w http.ResponseWriter, r *http.Request, name string, rest []string) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	if auditDir == "" {
+		writeError(w, http.StatusNotImplemented, ErrNoAuditDir)
+		return
+	}
+
+	query := r.URL.Query()
+	if len(rest) == 1 && rest[0] == "contributions" {
+		user := query.Get("user")
+		if user == "" {
+			writeError(w, http.StatusBadRequest, errors.New("a user is required"))
+			return
+		}
+		entries, err := readAudit(name, auditFilter{}, int(^uint(0)>>1))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, contributions(entries, user))
+		return
+	}
+	if len(rest) > 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	filter := auditFilter{User: query.Get("user")}
+	for _, bound := range []struct {
+		param string
+		t     *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		if s := query.Get(bound.param); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid %s time %q: expected RFC 3339", bound.param, s))
+				return
+			}
+			*bound.t = t
+		}
+	}
+	limit := maxAuditEntries
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxAuditEntries {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q: expected 1 to %d", s, maxAuditEntries))
+			return
+		}
+		limit = n
+	}
+
+	entries, err := readAudit(name, filter, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if entries == nil {
+		entries = []auditEntry{}
+	}
+	writeJSON(w, http.StatusOK, map[string][]auditEntry{"entries": entries})
+}
+
+// requestUser returns the name of the user making an API request, for the audit
+// log: the subject of their access token, or "admin" on the admin socket.
+func requestUser(r *http.Request) string {
+	if isTrusted(r) {
+		return "admin"
+	}
+	if secret := currentAuthSecret(); len(secret) > 0 {
+		if claims, err := parseToken(tokenFromRequest(r), secret); err == nil {
+			return claims.Subject
+		}
+	}
+	return ""
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestContributions(t *testing.T) {
+	entries := []auditEntry{
+		{Type: auditReplace, User: "admin", Text: "hi"},
+		{Type: "insert", User: "alice", Position: 3, Character: "0.1", Text: "!"},
+		{Type: "insert", User: "bob", Position: 1, Character: "0.2", Text: ">"},
+		{Type: "insert", User: "alice", Position: 100, Character: "0.3", Text: "?"},
+		{Type: "delete", User: "bob", Position: 4, Character: "0.1", Text: "!"},
+		{Type: "delete", User: "alice", Position: 2, Character: "", Text: ""},
+		{Type: "insert", User: "alice", Position: 0, Character: "0.4", Text: "<"},
+	}
+
+	tests := []struct {
+		user string
+		want contribution
+	}{
+		{user: "alice", want: contribution{User: "alice", Inserted: 3, Text: "<?"}},
+		{user: "bob", want: contribution{User: "bob", Inserted: 1, Deleted: 1, Text: ">"}},
+		{user: "admin", want: contribution{User: "admin", Text: "hi"}},
+		{user: "eve", want: contribution{User: "eve"}},
+	}
+
+	for _, tc := range tests {
+		if got := contributions(entries, tc.user); got != tc.want {
+			t.Errorf("(%s) expected %+v, got %+v", tc.user, tc.want, got)
+		}
+	}
+}
+
+func TestAuditAPI(t *testing.T) {
+	withOpenAPI(t)
+	auditDir = t.TempDir()
+	defer func() { auditDir = "" }()
+
+	server := httptest.NewServer(newMux())
+	defer server.Close()
+
+	name := uuid.New().String()
+	room, _, err := joinRoom(name, "")
+	if err != nil {
+		t.Fatalf("Failed to join room: %v", err)
+	}
+	defer leaveRoom(room)
+	start := time.Now().UTC()
+	if err := room.mergeText("hello world", "alice"); err != nil {
+		t.Fatalf("Failed to merge text: %v", err)
+	}
+	if err := room.mergeText("hello brave world", "bob"); err != nil {
+		t.Fatalf("Failed to merge text: %v", err)
+	}
+	if err := room.mergeText("hello brave", "carol"); err != nil {
+		t.Fatalf("Failed to merge text: %v", err)
+	}
+
+	var resp struct {
+		Entries []auditEntry `json:"entries"`
+	}
+	if status := apiRequest(t, server, http.MethodGet, "/rooms/"+name+"/audit?user=bob&since="+url.QueryEscape(start.Format(time.RFC3339)), nil, &resp); status != http.StatusOK {
+		t.Fatalf("Expected status %d querying the audit log, got %d", http.StatusOK, status)
+	}
+	var inserted string
+	doc := room.document()
+	for _, e := range resp.Entries {
+		if e.User != "bob" || e.Type != "insert" || doc.Find(e.Character).Value != e.Text {
+			t.Errorf("Unexpected entry: %+v", e)
+		}
+		inserted += e.Text
+	}
+	if inserted != "brave " {
+		t.Errorf("Expected bob to have inserted %q, got %q", "brave ", inserted)
+	}
+
+	apiRequest(t, server, http.MethodGet, "/rooms/"+name+"/audit?until="+url.QueryEscape(start.Add(-time.Hour).Format(time.RFC3339)), nil, &resp)
+	if len(resp.Entries) != 0 {
+		t.Errorf("Expected no entries before the room was created, got %d", len(resp.Entries))
+	}
+
+	tests := []struct {
+		user string
+		want contribution
+	}{
+		{user: "alice", want: contribution{User: "alice", Inserted: 11, Text: "hello "}},
+		{user: "bob", want: contribution{User: "bob", Inserted: 6, Text: "brave"}},
+		{user: "carol", want: contribution{User: "carol", Deleted: 6}},
+	}
+	for _, tc := range tests {
+		var got contribution
+		apiRequest(t, server, http.MethodGet, "/rooms/"+name+"/audit/contributions?user="+tc.user, nil, &got)
+		if got != tc.want {
+			t.Errorf("(%s) expected %+v, got %+v", tc.user, tc.want, got)
+		}
+	}
+
+	// A renamed room's log starts over with its text, and the rest of the
+	// history stays under the old name.
+	newName := uuid.New().String()
+	apiRequest(t, server, http.MethodPatch, "/rooms/"+name, renameRoomRequest{Name: newName}, nil)
+	defer deleteRoom(newName, "")
+	if err := room.mergeText("hello brave new", "alice"); err != nil {
+		t.Fatalf("Failed to merge text: %v", err)
+	}
+	var got contribution
+	apiRequest(t, server, http.MethodGet, "/rooms/"+newName+"/audit/contributions?user=alice", nil, &got)
+	if got.Text != " new" {
+		t.Errorf("Expected alice's contribution after the rename to be %q, got %q", " new", got.Text)
+	}
+	apiRequest(t, server, http.MethodGet, "/rooms/"+name+"/audit", nil, &resp)
+	if last := resp.Entries[len(resp.Entries)-1]; last.Type != auditRename || last.Text != newName {
+		t.Errorf("Expected the old log to end with the rename, got %+v", last)
+	}
+
+	if status := apiRequest(t, server, http.MethodGet, "/rooms/"+name+"/audit?since=yesterday", nil, nil); status != http.StatusBadRequest {
+		t.Errorf("Expected status %d for an invalid time, got %d", http.StatusBadRequest, status)
+	}
+	if !strings.HasSuffix(auditFileName("a/b"), ".audit.jsonl") || strings.Contains(auditFileName("../a/b"), "/") {
+		t.Errorf("Expected room names to be escaped in file names, got %q", auditFileName("../a/b"))
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/danii7514/codpen/commons"
+)
+
+// Claims are the claims of a codpen access token. Tokens are JWTs signed with HS256
+// using the secret the server was started with.
+type Claims struct {
+	// Subject is the name of the user the token was issued to.
+	Subject string `json:"sub"`
+
+	// Rooms lists the rooms the user may join. "*" allows every room.
+	Rooms []string `json:"rooms"`
+
+	// Role is the role of the user in the rooms it may join. If empty, the
+	// room's policy decides.
+	Role commons.Role `json:"role,omitempty"`
+
+	// Admin grants access to the room management API.
+	Admin bool `json:"admin,omitempty"`
+
+	// ExpiresAt is the expiry time of the token as a Unix timestamp. Zero means the token doesn't expire.
+	ExpiresAt int64 `json:"exp,omitempty"`
+}
+
+// tokenHeader is the JOSE header of every token codpen issues and accepts.
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+var (
+	// authSecret is the secret used to verify access tokens. Authentication is
+	// disabled when it is empty. It is protected by settingsMu, see currentAuthSecret.
+	authSecret []byte
+
+	// openAPI lets anyone use the room management API while authentication is
+	// disabled. It is protected by settingsMu, see currentOpenAPI.
+	openAPI bool
+
+	ErrNoToken          = errors.New("no access token provided")
+	ErrMalformedToken   = errors.New("malformed access token")
+	ErrInvalidSignature = errors.New("invalid access token signature")
+	ErrTokenExpired     = errors.New("access token expired")
+	ErrRoomNotAllowed   = errors.New("access token doesn't allow joining this room")
+)
+
+// signToken returns a signed token carrying the given claims.
+func signToken(claims Claims, secret []byte) (string, error) {
+	header, err := json.Marshal(tokenHeader{Alg: "HS256", Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sign(unsigned, secret)), nil
+}
+
+// parseToken verifies a token's signature and expiry, and returns its claims.
+func parseToken(token string, secret []byte) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+
+	var header tokenHeader
+	if err := decodeSegment(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return nil, ErrMalformedToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+	if !hmac.Equal(signature, sign(parts[0]+"."+parts[1], secret)) {
+		return nil, ErrInvalidSignature
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrMalformedToken
+	}
+	if claims.ExpiresAt != 0 && time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrTokenExpired
+	}
+
+	return &claims, nil
+}
+
+// sign returns the HMAC-SHA256 of s.
+func sign(s string, secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+// decodeSegment decodes a base64url-encoded JSON token segment into v.
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// canJoin reports whether the claims allow joining the given room.
+func (c *Claims) canJoin(roomID string) bool {
+	for _, room := range c.Rooms {
+		if room == "*" || room == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenFromRequest returns the access token of a request, taken from a bearer
+// Authorization header or, failing that, the token query parameter.
+func tokenFromRequest(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return r.URL.Query().Get("token")
+}
+
+// authenticate checks that a request carries a valid token allowing it to join
+// the given room. It returns the token's claims, or nil if authentication is
+// disabled. On failure, it also returns the HTTP status to respond with.
+func authenticate(r *http.Request, roomID string) (*Claims, int, error) {
+	secret := currentAuthSecret()
+	if len(secret) == 0 {
+		return nil, http.StatusOK, nil
+	}
+
+	token := tokenFromRequest(r)
+	if token == "" {
+		return nil, http.StatusUnauthorized, ErrNoToken
+	}
+
+	claims, err := parseToken(token, secret)
+	if err != nil {
+		return nil, http.StatusUnauthorized, err
+	}
+
+	if !claims.canJoin(roomID) {
+		return nil, http.StatusForbidden, ErrRoomNotAllowed
+	}
+
+	return claims, http.StatusOK, nil
+}
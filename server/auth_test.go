@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// TestParseToken checks token verification.
+func TestParseToken(t *testing.T) {
+	secret := []byte("secret")
+
+	valid, _ := signToken(Claims{Subject: "alice", Rooms: []string{"a"}}, secret)
+	expired, _ := signToken(Claims{Subject: "alice", ExpiresAt: time.Now().Add(-time.Minute).Unix()}, secret)
+	otherSecret, _ := signToken(Claims{Subject: "alice"}, []byte("other"))
+
+	// Swap the payload for one granting every room, keeping the signature.
+	parts := strings.Split(valid, ".")
+	forgedPayload, _ := signToken(Claims{Subject: "alice", Rooms: []string{"*"}}, []byte("other"))
+	forged := parts[0] + "." + strings.Split(forgedPayload, ".")[1] + "." + parts[2]
+
+	tests := []struct {
+		description string
+		token       string
+		err         error
+	}{
+		{description: "valid token", token: valid},
+		{description: "expired token", token: expired, err: ErrTokenExpired},
+		{description: "signed with another secret", token: otherSecret, err: ErrInvalidSignature},
+		{description: "tampered payload", token: forged, err: ErrInvalidSignature},
+		{description: "not a token", token: "garbage", err: ErrMalformedToken},
+	}
+
+	for _, tc := range tests {
+		claims, err := parseToken(tc.token, secret)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("(%s) expected error %v, got %v", tc.description, tc.err, err)
+			continue
+		}
+		if err == nil && claims.Subject != "alice" {
+			t.Errorf("(%s) expected subject alice, got %q", tc.description, claims.Subject)
+		}
+	}
+}
+
+// TestHandleConnAuth checks that upgrades are refused without a token allowing the room.
+func TestHandleConnAuth(t *testing.T) {
+	authSecret = []byte("secret")
+	defer func() { authSecret = nil }()
+
+	server := httptest.NewServer(http.HandlerFunc(handleConn))
+	defer server.Close()
+
+	roomID := uuid.New().String()
+	allowed, _ := signToken(Claims{Subject: "alice", Rooms: []string{roomID}}, authSecret)
+	wildcard, _ := signToken(Claims{Subject: "bob", Rooms: []string{"*"}}, authSecret)
+	otherRoom, _ := signToken(Claims{Subject: "alice", Rooms: []string{"elsewhere"}}, authSecret)
+	wrongSecret, _ := signToken(Claims{Subject: "alice", Rooms: []string{roomID}}, []byte("other"))
+
+	tests := []struct {
+		description string
+		header      string
+		query       string
+		status      int
+	}{
+		{description: "no token", status: http.StatusUnauthorized},
+		{description: "invalid token", header: wrongSecret, status: http.StatusUnauthorized},
+		{description: "room not allowed", header: otherRoom, status: http.StatusForbidden},
+		{description: "token in header", header: allowed, status: http.StatusSwitchingProtocols},
+		{description: "token in query", query: wildcard, status: http.StatusSwitchingProtocols},
+	}
+
+	for _, tc := range tests {
+		url := "ws" + server.URL[4:] + "?room=" + roomID
+		if tc.query != "" {
+			url += "&token=" + tc.query
+		}
+		header := http.Header{}
+		if tc.header != "" {
+			header.Set("Authorization", "Bearer "+tc.header)
+		}
+
+		conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+		if conn != nil {
+			conn.Close()
+		}
+		if resp == nil {
+			t.Errorf("(%s) expected a response, got error %v", tc.description, err)
+			continue
+		}
+		if resp.StatusCode != tc.status {
+			t.Errorf("(%s) expected status %d, got %d", tc.description, tc.status, resp.StatusCode)
+		}
+	}
+}
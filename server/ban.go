@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+)
+
+// A room's owner can kick its participants, and ban users by username, access
+// token subject or remote address, for a while or for good. Bans are kept with
+// the room on the node they were made on: a room with bans still in effect isn't
+// closed when idle, so that they outlive its participants.
+
+// maxCloseReason is the longest reason a close frame can carry, in bytes.
+const maxCloseReason = 123
+
+var (
+	ErrEmptyBan       = errors.New("a ban needs a username, subject or address")
+	ErrInvalidAddress = errors.New("invalid address: expected an IP address or a CIDR range")
+	ErrBanNotFound    = errors.New("ban not found")
+)
+
+// A Ban keeps matching users out of a room.
+type Ban struct {
+	ID string `json:"id"`
+
+	// Username, Subject and Address select the users banned: those with the
+	// given name, access token subject, or remote address, which is an IP address
+	// or a CIDR range. A user matching any of the set fields is banned.
+	Username string `json:"username,omitempty"`
+	Subject  string `json:"subject,omitempty"`
+	Address  string `json:"address,omitempty"`
+
+	// Reason is shown to the banned users.
+	Reason string `json:"reason,omitempty"`
+
+	Created time.Time `json:"created"`
+
+	// Expires is when the ban ends. A ban without it is permanent.
+	Expires *time.Time `json:"expires,omitempty"`
+
+	// network is the parsed Address.
+	network *net.IPNet
+}
+
+// A banList holds the bans of a room. Its zero value is an empty list.
+type banList struct {
+	mu   sync.Mutex
+	bans []Ban
+}
+
+// A banRequest is the body of a POST /rooms/{room}/bans request.
+type banRequest struct {
+	Username string `json:"username"`
+	Subject  string `json:"subject"`
+	Address  string `json:"address"`
+	Reason   string `json:"reason"`
+
+	// Duration is how long the ban lasts, like "2h". The ban is permanent if it
+	// is empty.
+	Duration string `json:"duration"`
+}
+
+// A banResponse answers a POST /rooms/{room}/bans request.
+type banResponse struct {
+	Ban
+
+	// Kicked is how many participants were kicked by the ban.
+	Kicked int `json:"kicked"`
+}
+
+// newBan returns a ban of the given users, lasting for d, or for good if d is 0.
+func newBan(username, subject, address, reason string, d time.Duration) (Ban, error) {
+	if username == "" && subject == "" && address == "" {
+		return Ban{}, ErrEmptyBan
+	}
+	if d < 0 {
+		return Ban{}, fmt.Errorf("invalid ban duration %s", d)
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return Ban{}, err
+	}
+	ban := Ban{
+		ID:       hex.EncodeToString(b),
+		Username: username,
+		Subject:  subject,
+		Address:  address,
+		Reason:   reason,
+		Created:  time.Now().UTC(),
+	}
+	if d > 0 {
+		expires := ban.Created.Add(d)
+		ban.Expires = &expires
+	}
+
+	if address != "" {
+		var err error
+		if ban.network, err = parseNetwork(address); err != nil {
+			return Ban{}, err
+		}
+	}
+	return ban, nil
+}
+
+// parseNetwork parses an IP address or a CIDR range into a network.
+func parseNetwork(address string) (*net.IPNet, error) {
+	if _, network, err := net.ParseCIDR(address); err == nil {
+		return network, nil
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, ErrInvalidAddress
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// active reports whether the ban is in effect at t.
+func (b *Ban) active(t time.Time) bool {
+	return b.Expires == nil || t.Before(*b.Expires)
+}
+
+// matches reports whether the ban applies to a user with the given name, access
+// token subject and remote address. Empty values match nothing.
+func (b *Ban) matches(username, subject, addr string) bool {
+	if b.Username != "" && b.Username == username {
+		return true
+	}
+	if b.Subject != "" && b.Subject == subject {
+		return true
+	}
+	if b.network != nil {
+		if ip := net.ParseIP(addr); ip != nil && b.network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// message returns the text telling a banned user why they can't join, which
+// fits in a close frame.
+func (b *Ban) message() string {
+	msg := "banned from the room"
+	if b.Expires != nil {
+		msg += " until " + b.Expires.Format("2006-01-02 15:04 UTC")
+	}
+	if b.Reason != "" {
+		msg += ": " + b.Reason
+	}
+	return truncateReason(msg)
+}
+
+// add adds a ban to the list.
+func (l *banList) add(ban Ban) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bans = append(l.bans, ban)
+}
+
+// remove lifts the ban with the given ID, and reports whether there was one.
+func (l *banList) remove(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i, ban := range l.bans {
+		if ban.ID == id {
+			l.bans = append(l.bans[:i], l.bans[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// active returns the bans in effect, oldest first, and forgets the expired ones.
+func (l *banList) active() []Ban {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	kept := l.bans[:0]
+	for _, ban := range l.bans {
+		if ban.active(now) {
+			kept = append(kept, ban)
+		}
+	}
+	l.bans = kept
+
+	bans := append([]Ban{}, kept...)
+	sort.SliceStable(bans, func(i, j int) bool { return bans[i].Created.Before(bans[j].Created) })
+	return bans
+}
+
+// match returns the ban in effect applying to a user with the given name,
+// access token subject and remote address, or nil if there is none.
+func (l *banList) match(username, subject, addr string) *Ban {
+	for _, ban := range l.active() {
+		if ban.matches(username, subject, addr) {
+			return &ban
+		}
+	}
+	return nil
+}
+
+// banned returns the ban in effect applying to the client, or nil if there is none.
+func (r *Room) banned(c *client) *Ban {
+	c.mu.Lock()
+	username, subject, addr := c.Username, c.subject, c.addr
+	c.mu.Unlock()
+	return r.bans.match(username, subject, addr)
+}
+
+// ban adds a ban to the room, and kicks the participants it applies to. It
+// returns how many were kicked.
+func (r *Room) ban(ban Ban) int {
+	r.bans.add(ban)
+
+	kicked := 0
+	for client := range r.Clients.getAll() {
+		if b := r.banned(client); b != nil && r.kick(client.id, b.message()) {
+			kicked++
+		}
+	}
+	return kicked
+}
+
+// handleRoomBans serves /rooms/{room}/bans and /rooms/{room}/bans/{id}. rest
+// holds the path segments after "bans".
+func handleRoomBans(w http.ResponseWriter, r *http.Request, room *Room, rest []string) {
+	if len(rest) == 1 {
+		if r.Method != http.MethodDelete {
+			methodNotAllowed(w, http.MethodDelete)
+			return
+		}
+		if !room.bans.remove(rest[0]) {
+			writeError(w, http.StatusNotFound, ErrBanNotFound)
+			return
+		}
+		room.log().WithField("ban", rest[0]).Info("Lifted ban via the API")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string][]Ban{"bans": room.bans.active()})
+
+	case http.MethodPost:
+		var req banRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("invalid ban"))
+			return
+		}
+		var d time.Duration
+		if req.Duration != "" {
+			var err error
+			if d, err = time.ParseDuration(req.Duration); err != nil || d <= 0 {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid ban duration %q", req.Duration))
+				return
+			}
+		}
+		ban, err := newBan(req.Username, req.Subject, req.Address, req.Reason, d)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		kicked := room.ban(ban)
+		room.log().WithFields(logrus.Fields{
+			"ban":      ban.ID,
+			"username": ban.Username,
+			"subject":  ban.Subject,
+			"address":  ban.Address,
+			"duration": d,
+			"kicked":   kicked,
+		}).Info("Banned users via the API")
+		writeJSON(w, http.StatusCreated, banResponse{Ban: ban, Kicked: kicked})
+
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+// truncateReason shortens a close reason to fit in a close frame.
+func truncateReason(reason string) string {
+	if len(reason) <= maxCloseReason {
+		return reason
+	}
+	reason = reason[:maxCloseReason]
+	for !utf8.ValidString(reason) {
+		reason = reason[:len(reason)-1]
+	}
+	return reason
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danii7514/codpen/commons"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+func TestBanMatches(t *testing.T) {
+	tests := []struct {
+		description string
+		username    string
+		subject     string
+		address     string
+		user        [3]string
+		want        bool
+	}{
+		{description: "username", username: "mallory", user: [3]string{"mallory", "", "10.0.0.1"}, want: true},
+		{description: "other username", username: "mallory", user: [3]string{"alice", "", "10.0.0.1"}},
+		{description: "subject", subject: "mallory", user: [3]string{"", "mallory", "10.0.0.1"}, want: true},
+		{description: "empty subject", subject: "mallory", user: [3]string{"", "", "10.0.0.1"}},
+		{description: "address", address: "10.0.0.1", user: [3]string{"alice", "", "10.0.0.1"}, want: true},
+		{description: "other address", address: "10.0.0.1", user: [3]string{"alice", "", "10.0.0.2"}},
+		{description: "range", address: "10.0.0.0/24", user: [3]string{"alice", "", "10.0.0.200"}, want: true},
+		{description: "outside range", address: "10.0.0.0/24", user: [3]string{"alice", "", "10.0.1.1"}},
+		{description: "IPv6", address: "2001:db8::/32", user: [3]string{"alice", "", "2001:db8::1"}, want: true},
+	}
+
+	for _, tc := range tests {
+		ban, err := newBan(tc.username, tc.subject, tc.address, "", 0)
+		if err != nil {
+			t.Fatalf("(%s) failed to create ban: %v", tc.description, err)
+		}
+		if got := ban.matches(tc.user[0], tc.user[1], tc.user[2]); got != tc.want {
+			t.Errorf("(%s) expected %t, got %t", tc.description, tc.want, got)
+		}
+	}
+
+	if _, err := newBan("", "", "", "", 0); err != ErrEmptyBan {
+		t.Errorf("Expected %v for a ban of nobody, got %v", ErrEmptyBan, err)
+	}
+	if _, err := newBan("", "", "not an address", "", 0); err != ErrInvalidAddress {
+		t.Errorf("Expected %v for an invalid address, got %v", ErrInvalidAddress, err)
+	}
+}
+
+func TestBanList(t *testing.T) {
+	var l banList
+	expired, _ := newBan("old", "", "", "", time.Nanosecond)
+	permanent, _ := newBan("mallory", "", "", "spam", 0)
+	l.add(expired)
+	l.add(permanent)
+	time.Sleep(time.Millisecond)
+
+	if bans := l.active(); len(bans) != 1 || bans[0].ID != permanent.ID {
+		t.Errorf("Expected only the permanent ban to be active, got %+v", bans)
+	}
+	if l.match("old", "", "") != nil {
+		t.Errorf("Expected an expired ban not to match")
+	}
+	if ban := l.match("mallory", "", ""); ban == nil || ban.message() != "banned from the room: spam" {
+		t.Errorf("Expected the permanent ban to match, got %+v", ban)
+	}
+	if !l.remove(permanent.ID) || l.remove(permanent.ID) {
+		t.Errorf("Expected the ban to be removed once")
+	}
+	if l.match("mallory", "", "") != nil {
+		t.Errorf("Expected a lifted ban not to match")
+	}
+
+	long := strings.Repeat("é", 100)
+	if reason := truncateReason(long); len(reason) > maxCloseReason || !strings.HasPrefix(long, reason) {
+		t.Errorf("Expected the reason to be cut at a character boundary, got %q", reason)
+	}
+}
+
+// TestBanAPI checks that banning kicks the matching participants and keeps them out.
+func TestBanAPI(t *testing.T) {
+	drainChannels(t)
+	withOpenAPI(t)
+
+	server := httptest.NewServer(newMux())
+	defer server.Close()
+
+	name := uuid.New().String()
+	dial := func() (*websocket.Conn, *http.Response, error) {
+		return websocket.DefaultDialer.Dial("ws"+server.URL[4:]+"/ws?room="+name, nil)
+	}
+
+	conn, _, err := dial()
+	if err != nil {
+		t.Fatalf("Failed to establish WebSocket connection: %v", err)
+	}
+	defer conn.Close()
+	// handleMsg isn't running, so the name is set as it would on joining.
+	findRoom(name).Clients.updateName(readUntil(t, conn, commons.RoleMessage).ID, "mallory")
+
+	var created banResponse
+	if status := apiRequest(t, server, http.MethodPost, "/rooms/"+name+"/bans", banRequest{Username: "mallory", Reason: "spam", Duration: "1h"}, &created); status != http.StatusCreated {
+		t.Fatalf("Expected status %d banning, got %d", http.StatusCreated, status)
+	}
+	if created.Kicked != 1 || created.Expires == nil {
+		t.Errorf("Expected a ban kicking 1 participant for an hour, got %+v", created)
+	}
+	if ce := readCloseError(t, conn); !strings.HasPrefix(ce.Text, "banned from the room until ") || !strings.HasSuffix(ce.Text, ": spam") {
+		t.Errorf("Expected the ban as close reason, got %q", ce.Text)
+	}
+
+	// A banned name is refused once the user joins with it.
+	conn, _, err = dial()
+	if err != nil {
+		t.Fatalf("Failed to establish WebSocket connection: %v", err)
+	}
+	defer conn.Close()
+	readUntil(t, conn, commons.RoleMessage)
+	_ = conn.WriteJSON(commons.Message{Type: commons.JoinMessage, Username: "mallory"})
+	if ce := readCloseError(t, conn); ce.Code != websocket.ClosePolicyViolation {
+		t.Errorf("Expected a banned name to be kicked, got %+v", ce)
+	}
+
+	// A banned address is refused before connecting.
+	if status := apiRequest(t, server, http.MethodPost, "/rooms/"+name+"/bans", banRequest{Address: "127.0.0.0/8"}, nil); status != http.StatusCreated {
+		t.Fatalf("Expected status %d banning an address, got %d", http.StatusCreated, status)
+	}
+	if _, resp, err := dial(); err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected a banned address to be refused, got %v", err)
+	}
+
+	var list struct {
+		Bans []Ban `json:"bans"`
+	}
+	apiRequest(t, server, http.MethodGet, "/rooms/"+name+"/bans", nil, &list)
+	if len(list.Bans) != 2 {
+		t.Fatalf("Expected 2 bans, got %+v", list.Bans)
+	}
+	for _, ban := range list.Bans {
+		if status := apiRequest(t, server, http.MethodDelete, "/rooms/"+name+"/bans/"+ban.ID, nil, nil); status != http.StatusNoContent {
+			t.Errorf("Expected status %d lifting a ban, got %d", http.StatusNoContent, status)
+		}
+	}
+	conn, _, err = dial()
+	if err != nil {
+		t.Fatalf("Expected to connect once the bans are lifted: %v", err)
+	}
+	conn.Close()
+
+	if status := apiRequest(t, server, http.MethodPost, "/rooms/"+name+"/bans", banRequest{Username: "x", Duration: "soon"}, nil); status != http.StatusBadRequest {
+		t.Errorf("Expected status %d for an invalid duration, got %d", http.StatusBadRequest, status)
+	}
+}
+
+func TestBanAPIOwner(t *testing.T) {
+	authSecret = []byte("secret")
+	defer func() { authSecret = nil }()
+
+	name := uuid.New().String()
+	room, err := createRoom(name, "")
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	defer deleteRoom(name, "")
+	room.Policy.assign("alice", "", "")
+
+	owner, _ := signToken(Claims{Subject: "alice", Rooms: []string{"*"}}, authSecret)
+	other, _ := signToken(Claims{Subject: "bob", Rooms: []string{"*"}}, authSecret)
+	admin, _ := signToken(Claims{Subject: "root", Admin: true}, authSecret)
+
+	tests := []struct {
+		description string
+		path        string
+		token       string
+		status      int
+	}{
+		{description: "owner", path: "/rooms/" + name + "/bans", token: owner, status: http.StatusOK},
+		{description: "admin", path: "/rooms/" + name + "/bans", token: admin, status: http.StatusOK},
+		{description: "other user", path: "/rooms/" + name + "/bans", token: other, status: http.StatusForbidden},
+		{description: "no token", path: "/rooms/" + name + "/bans", status: http.StatusUnauthorized},
+		{description: "owner on the room", path: "/rooms/" + name, token: owner, status: http.StatusForbidden},
+		{description: "missing room", path: "/rooms/" + uuid.New().String() + "/bans", token: owner, status: http.StatusForbidden},
+	}
+
+	for _, tc := range tests {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		rec := httptest.NewRecorder()
+		newMux().ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("(%s) expected status %d, got %d", tc.description, tc.status, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/danii7514/codpen/commons"
+	"github.com/danii7514/codpen/crdt"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Several server nodes can serve the same rooms behind a load balancer. Each node
+// keeps its own copy of the rooms its clients joined, and a Broker relays their
+// operations, documents and users between the nodes.
+//
+// When a node opens a room, it says hello, and the other nodes answer with their
+// users and document, so that the room's first client gets the latest text. Rooms
+// are known by name across nodes, so renaming, deleting a room or kicking a client
+// through the API only affects the node serving the request.
+
+// ClusterConfig holds the settings of the broker relaying rooms between nodes.
+type ClusterConfig struct {
+	// RedisAddr is the address of the Redis server used as the broker. The server
+	// runs alone if it is empty.
+	RedisAddr string `yaml:"redis_addr"`
+
+	// RedisPassword is the password of the Redis server, if it requires one.
+	RedisPassword string `yaml:"redis_password"`
+}
+
+// A Broker fans messages out between server nodes.
+type Broker interface {
+	// Publish sends data to every subscriber of a room, on every node.
+	Publish(room string, data []byte) error
+
+	// Subscribe calls handler with the data published to a room, in order, until
+	// unsubscribe is called.
+	Subscribe(room string, handler func(data []byte)) (unsubscribe func(), err error)
+
+	// Close releases the broker's resources.
+	Close() error
+}
+
+var (
+	// broker relays room events between nodes. It is nil when the server runs alone.
+	broker Broker
+
+	// nodeID identifies this node in the events it publishes.
+	nodeID = uuid.New().String()
+
+	ErrBrokerClosed = errors.New("broker closed")
+)
+
+// The kinds of cluster events.
+const (
+	// eventOperation carries an operation made on a node.
+	eventOperation = "operation"
+
+	// eventDocument carries a document replacing the room's document.
+	eventDocument = "document"
+
+	// eventSnapshot carries a node's document, in answer to eventHello. It is
+	// only used by nodes which don't have the room's text yet.
+	eventSnapshot = "snapshot"
+
+	// eventPresence carries the users connected to a node.
+	eventPresence = "presence"
+
+	// eventHello announces that a node opened the room.
+	eventHello = "hello"
+
+	// eventBye announces that a node closed the room.
+	eventBye = "bye"
+)
+
+// A clusterEvent is an event about a room, sent between nodes.
+type clusterEvent struct {
+	// Node is the ID of the node which sent the event.
+	Node string `json:"node"`
+
+	Kind      string             `json:"kind"`
+	Operation *commons.Operation `json:"operation,omitempty"`
+	Document  *crdt.Document     `json:"document,omitempty"`
+	Users     []string           `json:"users,omitempty"`
+}
+
+// joinCluster subscribes the room to the events of the other nodes and says hello.
+// It does nothing when the server runs alone.
+func (r *Room) joinCluster() {
+	if broker == nil {
+		return
+	}
+
+	name := r.name()
+	unsubscribe, err := broker.Subscribe(name, r.handleClusterEvent)
+	if err != nil {
+		r.log().WithError(err).Error("Failed to subscribe to the room's cluster events")
+		return
+	}
+
+	r.clusterMu.Lock()
+	r.unsubscribe, r.channel = unsubscribe, name
+	r.clusterMu.Unlock()
+
+	r.publish(clusterEvent{Kind: eventHello})
+}
+
+// leaveCluster says goodbye to the other nodes and unsubscribes from their events.
+func (r *Room) leaveCluster() {
+	r.clusterMu.Lock()
+	unsubscribe, channel := r.unsubscribe, r.channel
+	r.unsubscribe, r.channel = nil, ""
+	r.clusterMu.Unlock()
+
+	if unsubscribe == nil {
+		return
+	}
+	r.publishTo(channel, clusterEvent{Kind: eventBye})
+	unsubscribe()
+}
+
+// rejoinCluster moves a renamed room from the events of its old name to those of
+// its new one, if it is in the cluster.
+func (r *Room) rejoinCluster() {
+	r.clusterMu.Lock()
+	joined := r.unsubscribe != nil
+	r.clusterMu.Unlock()
+	if !joined {
+		return
+	}
+
+	r.leaveCluster()
+	r.clusterMu.Lock()
+	r.remoteUsers, r.lastPresence = nil, ""
+	r.clusterMu.Unlock()
+	r.joinCluster()
+	r.updatePresence()
+}
+
+// publish sends an event about the room to the other nodes.
+func (r *Room) publish(event clusterEvent) {
+	r.clusterMu.Lock()
+	channel := r.channel
+	r.clusterMu.Unlock()
+	if channel == "" {
+		channel = r.name()
+	}
+	r.publishTo(channel, event)
+}
+
+// publishTo sends an event about the room to the other nodes, under the given channel.
+func (r *Room) publishTo(channel string, event clusterEvent) {
+	if broker == nil {
+		return
+	}
+
+	event.Node = nodeID
+	data, err := json.Marshal(event)
+	if err != nil {
+		r.log().WithError(err).Error("Failed to encode cluster event")
+		return
+	}
+	if err := broker.Publish(channel, data); err != nil {
+		r.log().WithError(err).WithField("kind", event.Kind).Error("Failed to publish cluster event")
+	}
+}
+
+// handleClusterEvent applies an event published by another node to the room.
+func (r *Room) handleClusterEvent(data []byte) {
+	var event clusterEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		r.log().WithError(err).Warn("Ignoring malformed cluster event")
+		return
+	}
+	if event.Node == nodeID {
+		return
+	}
+
+	entry := r.log().WithFields(logrus.Fields{"node": event.Node, "kind": event.Kind})
+	entry.Debug("Received cluster event")
+
+	switch event.Kind {
+	case eventOperation:
+		if event.Operation == nil {
+			return
+		}
+		r.relayMu.Lock()
+		char, err := r.apply(*event.Operation)
+		if err != nil {
+			entry.WithError(err).Error("Failed to apply operation to the room's document")
+		}
+		seq := r.record(*event.Operation, "")
+		r.auditOperation(auditEntry{Node: event.Node}, *event.Operation, char)
+		msg := commons.Message{Type: commons.OperationMessage, Operation: *event.Operation, Seq: seq}
+		r.recordOperation(uuid.Nil, "", "", msg)
+		r.Clients.broadcastAllExcept(msg, uuid.Nil, r.ID)
+		r.relayMu.Unlock()
+		operationsRelayed.inc()
+
+	case eventDocument, eventSnapshot:
+		if event.Document == nil || len(event.Document.Characters) < 2 {
+			return
+		}
+		r.relayMu.Lock()
+		if event.Kind == eventDocument || r.documentLength() <= 2 {
+			r.setDocument(*event.Document)
+			r.resetHistory()
+			r.audit(auditEntry{Node: event.Node, Type: auditReplace, Text: crdt.Content(*event.Document)})
+			r.recordDocument(uuid.Nil, *event.Document)
+			r.Clients.broadcastAllExcept(commons.Message{Type: commons.DocSyncMessage, Document: *event.Document, Seq: r.seq}, uuid.Nil, r.ID)
+		}
+		r.relayMu.Unlock()
+
+	case eventHello:
+		r.publish(clusterEvent{Kind: eventPresence, Users: r.localUsernames()})
+		if doc := r.document(); len(doc.Characters) > 2 {
+			r.publish(clusterEvent{Kind: eventSnapshot, Document: &doc})
+		}
+
+	case eventPresence, eventBye:
+		r.clusterMu.Lock()
+		if r.remoteUsers == nil {
+			r.remoteUsers = make(map[string][]string)
+		}
+		if event.Kind == eventPresence && len(event.Users) > 0 {
+			r.remoteUsers[event.Node] = event.Users
+		} else {
+			delete(r.remoteUsers, event.Node)
+		}
+		r.clusterMu.Unlock()
+
+		// sendUsernames waits for handleSync, which mustn't hold up the next events.
+		go r.Clients.sendUsernames()
+	}
+}
+
+// updatePresence tells the other nodes about the room's users on this node, if
+// they changed since the last time.
+func (r *Room) updatePresence() {
+	if broker == nil {
+		return
+	}
+
+	users := r.localUsernames()
+	key := strings.Join(users, ",")
+
+	r.clusterMu.Lock()
+	changed := key != r.lastPresence
+	r.lastPresence = key
+	r.clusterMu.Unlock()
+
+	if changed {
+		r.publish(clusterEvent{Kind: eventPresence, Users: users})
+	}
+}
+
+// localUsernames returns the sorted names of the room's users on this node.
+func (r *Room) localUsernames() []string {
+	var users []string
+	for client := range r.Clients.getAll() {
+		client.mu.Lock()
+		users = append(users, client.Username)
+		client.mu.Unlock()
+	}
+	sort.Strings(users)
+	return users
+}
+
+// remoteUsernames returns the names of the room's users on other nodes, in the
+// format of the users message.
+func (r *Room) remoteUsernames() string {
+	r.clusterMu.Lock()
+	defer r.clusterMu.Unlock()
+
+	nodes := make([]string, 0, len(r.remoteUsers))
+	for node := range r.remoteUsers {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	var users string
+	for _, node := range nodes {
+		for _, user := range r.remoteUsers[node] {
+			users += user + ","
+		}
+	}
+	return users
+}
+
+// A memoryBroker is a Broker relaying messages within the process, for tests.
+type memoryBroker struct {
+	// mu protects the fields below.
+	mu     sync.Mutex
+	subs   map[string]map[*memorySubscription]struct{}
+	closed bool
+}
+
+// A memorySubscription delivers the messages of a room to a handler.
+type memorySubscription struct {
+	messages chan []byte
+	done     chan struct{}
+}
+
+// newMemoryBroker returns a Broker relaying messages within the process.
+func newMemoryBroker() *memoryBroker {
+	return &memoryBroker{subs: make(map[string]map[*memorySubscription]struct{})}
+}
+
+// Publish sends data to every subscriber of a room.
+func (b *memoryBroker) Publish(room string, data []byte) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrBrokerClosed
+	}
+	subs := make([]*memorySubscription, 0, len(b.subs[room]))
+	for sub := range b.subs[room] {
+		subs = append(subs, sub)
+	}
+	b.mu.Unlock()
+
+	for _, sub := range subs {
+		select {
+		case sub.messages <- append([]byte(nil), data...):
+		case <-sub.done:
+		}
+	}
+	return nil
+}
+
+// Subscribe calls handler with the data published to a room, until unsubscribe is called.
+func (b *memoryBroker) Subscribe(room string, handler func(data []byte)) (func(), error) {
+	sub := &memorySubscription{messages: make(chan []byte, 256), done: make(chan struct{})}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrBrokerClosed
+	}
+	if b.subs[room] == nil {
+		b.subs[room] = make(map[*memorySubscription]struct{})
+	}
+	b.subs[room][sub] = struct{}{}
+
+	go func() {
+		for {
+			select {
+			case data := <-sub.messages:
+				handler(data)
+			case <-sub.done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if _, ok := b.subs[room][sub]; !ok {
+				// The broker was closed, and sub with it.
+				return
+			}
+			delete(b.subs[room], sub)
+			if len(b.subs[room]) == 0 {
+				delete(b.subs, room)
+			}
+			close(sub.done)
+		})
+	}, nil
+}
+
+// Close stops delivering messages.
+func (b *memoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for _, subs := range b.subs {
+		for sub := range subs {
+			close(sub.done)
+		}
+	}
+	b.subs = nil
+	return nil
+}
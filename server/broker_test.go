@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/danii7514/codpen/commons"
+	"github.com/danii7514/codpen/crdt"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// withBroker sets broker for the duration of a test, and closes it afterwards.
+func withBroker(t *testing.T, b Broker) {
+	original := broker
+	broker = b
+	t.Cleanup(func() {
+		broker = original
+		b.Close()
+	})
+}
+
+// receive returns the next message of ch, failing the test if none arrives in time.
+func receive(t *testing.T, ch chan []byte) []byte {
+	t.Helper()
+	select {
+	case data := <-ch:
+		return data
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timed out waiting for a message")
+		return nil
+	}
+}
+
+// A fakeNode stands in for another server node, subscribed to a room through a broker.
+type fakeNode struct {
+	t      *testing.T
+	room   string
+	events chan clusterEvent
+}
+
+// newFakeNode subscribes a fake node to a room's events published by this node.
+func newFakeNode(t *testing.T, b Broker, room string) *fakeNode {
+	n := &fakeNode{t: t, room: room, events: make(chan clusterEvent, 64)}
+	unsubscribe, err := b.Subscribe(room, func(data []byte) {
+		var event clusterEvent
+		if err := json.Unmarshal(data, &event); err == nil && event.Node == nodeID {
+			n.events <- event
+		}
+	})
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	t.Cleanup(unsubscribe)
+	return n
+}
+
+// publish publishes an event as the fake node.
+func (n *fakeNode) publish(event clusterEvent) {
+	n.t.Helper()
+	event.Node = "remote"
+	data, err := json.Marshal(event)
+	if err != nil {
+		n.t.Fatalf("Failed to encode event: %v", err)
+	}
+	if err := broker.Publish(n.room, data); err != nil {
+		n.t.Fatalf("Failed to publish event: %v", err)
+	}
+}
+
+// expect returns the next event of the given kind published by this node.
+func (n *fakeNode) expect(kind string) clusterEvent {
+	n.t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case event := <-n.events:
+			if event.Kind == kind {
+				return event
+			}
+		case <-timeout:
+			n.t.Fatalf("Timed out waiting for a %s event", kind)
+		}
+	}
+}
+
+func TestMemoryBroker(t *testing.T) {
+	b := newMemoryBroker()
+
+	a1, a2, other := make(chan []byte, 8), make(chan []byte, 8), make(chan []byte, 8)
+	unsubscribe1, err := b.Subscribe("a", func(data []byte) { a1 <- data })
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	if _, err := b.Subscribe("a", func(data []byte) { a2 <- data }); err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	if _, err := b.Subscribe("b", func(data []byte) { other <- data }); err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+
+	for _, msg := range []string{"one", "two"} {
+		if err := b.Publish("a", []byte(msg)); err != nil {
+			t.Fatalf("Failed to publish: %v", err)
+		}
+	}
+	for _, ch := range []chan []byte{a1, a2} {
+		for _, want := range []string{"one", "two"} {
+			if got := string(receive(t, ch)); got != want {
+				t.Errorf("Expected %q, got %q", want, got)
+			}
+		}
+	}
+
+	unsubscribe1()
+	unsubscribe1()
+	if err := b.Publish("a", []byte("three")); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+	if got := string(receive(t, a2)); got != "three" {
+		t.Errorf("Expected %q, got %q", "three", got)
+	}
+	select {
+	case data := <-a1:
+		t.Errorf("Expected no message after unsubscribing, got %q", data)
+	case data := <-other:
+		t.Errorf("Expected no message for another room, got %q", data)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	if err := b.Publish("a", []byte("four")); !errors.Is(err, ErrBrokerClosed) {
+		t.Errorf("Expected %v publishing after Close, got %v", ErrBrokerClosed, err)
+	}
+	if _, err := b.Subscribe("a", func([]byte) {}); !errors.Is(err, ErrBrokerClosed) {
+		t.Errorf("Expected %v subscribing after Close, got %v", ErrBrokerClosed, err)
+	}
+}
+
+// TestClusterRoom checks that a room exchanges its operations, document and users
+// with another node.
+func TestClusterRoom(t *testing.T) {
+	drainChannels(t)
+	withOpenAPI(t)
+	withBroker(t, newMemoryBroker())
+
+	server := httptest.NewServer(newMux())
+	defer server.Close()
+
+	name := uuid.New().String()
+	remote := newFakeNode(t, broker, name)
+
+	// Creating the room says hello to the other nodes.
+	if status, _ := contentRequest(t, server, http.MethodPut, name, "", "hello"); status != http.StatusCreated {
+		t.Fatalf("Expected status %d creating a room, got %d", http.StatusCreated, status)
+	}
+	remote.expect(eventHello)
+	room := findRoom(name)
+
+	// Local operations are published.
+	if status, _ := contentRequest(t, server, http.MethodPut, name, "", "hello!"); status != http.StatusNoContent {
+		t.Fatalf("Expected status %d merging content, got %d", http.StatusNoContent, status)
+	}
+	want := diffOperations([]rune("hello"), []rune("hello!"))[0]
+	if op := remote.expect(eventOperation).Operation; op == nil || *op != want {
+		t.Errorf("Expected operation %+v to be published, got %+v", want, op)
+	}
+
+	// Remote operations are applied, and relayed to local clients.
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:]+"/ws?room="+name, nil)
+	if err != nil {
+		t.Fatalf("Failed to establish WebSocket connection: %v", err)
+	}
+	defer conn.Close()
+	readUntil(t, conn, commons.DocSyncMessage)
+
+	op := diffOperations([]rune("hello!"), []rune("hello!?"))[0]
+	remote.publish(clusterEvent{Kind: eventOperation, Operation: &op})
+	if msg := readUntil(t, conn, commons.OperationMessage); msg.Operation != op {
+		t.Errorf("Expected operation %+v to be relayed, got %+v", op, msg.Operation)
+	}
+	if got := room.text(); got != "hello!?" {
+		t.Errorf("Expected the room's text to be %q, got %q", "hello!?", got)
+	}
+
+	// A remote document replaces the room's.
+	doc, err := newDocument("replaced")
+	if err != nil {
+		t.Fatalf("Failed to create document: %v", err)
+	}
+	remote.publish(clusterEvent{Kind: eventDocument, Document: &doc})
+	if got := crdt.Content(readUntil(t, conn, commons.DocSyncMessage).Document); got != "replaced" {
+		t.Errorf("Expected the client to be sent %q, got %q", "replaced", got)
+	}
+
+	// A snapshot doesn't replace a room which has text.
+	snapshot, _ := newDocument("stale")
+	remote.publish(clusterEvent{Kind: eventSnapshot, Document: &snapshot})
+
+	// Another node saying hello is sent the room's document.
+	remote.publish(clusterEvent{Kind: eventHello})
+	remote.expect(eventPresence)
+	if got := crdt.Content(*remote.expect(eventSnapshot).Document); got != "replaced" {
+		t.Errorf("Expected a snapshot of %q, got %q", "replaced", got)
+	}
+	if got := room.text(); got != "replaced" {
+		t.Errorf("Expected the snapshot to be ignored, got %q", got)
+	}
+
+	// Remote users are listed until their node says goodbye.
+	remote.publish(clusterEvent{Kind: eventPresence, Users: []string{"bob", "carol"}})
+	if !waitFor(2*time.Second, func() bool { return room.remoteUsernames() == "bob,carol," }) {
+		t.Errorf("Expected the remote users to be listed, got %q", room.remoteUsernames())
+	}
+	remote.publish(clusterEvent{Kind: eventBye})
+	if !waitFor(2*time.Second, func() bool { return room.remoteUsernames() == "" }) {
+		t.Errorf("Expected no remote users after bye, got %q", room.remoteUsernames())
+	}
+}
+
+// TestClusterRoomSnapshot checks that a new room takes the text of the nodes
+// already serving it.
+func TestClusterRoomSnapshot(t *testing.T) {
+	withBroker(t, newMemoryBroker())
+
+	name := uuid.New().String()
+	doc, err := newDocument("from another node")
+	if err != nil {
+		t.Fatalf("Failed to create document: %v", err)
+	}
+
+	// The other node answers hello with its document.
+	snapshot, err := json.Marshal(clusterEvent{Node: "remote", Kind: eventSnapshot, Document: &doc})
+	if err != nil {
+		t.Fatalf("Failed to encode event: %v", err)
+	}
+	unsubscribe, err := broker.Subscribe(name, func(data []byte) {
+		var event clusterEvent
+		if err := json.Unmarshal(data, &event); err == nil && event.Node == nodeID && event.Kind == eventHello {
+			_ = broker.Publish(name, snapshot)
+		}
+	})
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	defer unsubscribe()
+
+	room, _, err := joinRoom(name, "")
+	if err != nil {
+		t.Fatalf("Failed to join room: %v", err)
+	}
+	defer leaveRoom(room)
+	defer deleteRoom(name, "")
+	if !waitFor(2*time.Second, func() bool { return room.text() == "from another node" }) {
+		t.Errorf("Expected the room to take the other node's text, got %q", room.text())
+	}
+}
+
+// TestClusterRoomRename checks that a renamed room moves to the events of its new name.
+func TestClusterRoomRename(t *testing.T) {
+	withBroker(t, newMemoryBroker())
+
+	oldName, newName := uuid.New().String(), uuid.New().String()
+	before, after := newFakeNode(t, broker, oldName), newFakeNode(t, broker, newName)
+
+	room, _, err := joinRoom(oldName, "")
+	if err != nil {
+		t.Fatalf("Failed to join room: %v", err)
+	}
+	defer leaveRoom(room)
+	before.expect(eventHello)
+	if _, err := renameRoom(oldName, newName); err != nil {
+		t.Fatalf("Failed to rename room: %v", err)
+	}
+	defer deleteRoom(newName, "")
+	before.expect(eventBye)
+	after.expect(eventHello)
+
+	// Local operations go out under the new name.
+	if err := room.mergeText("hi", ""); err != nil {
+		t.Fatalf("Failed to merge text: %v", err)
+	}
+	if op := after.expect(eventOperation).Operation; op == nil || op.Value != "h" {
+		t.Errorf("Expected the first operation to be published under the new name, got %+v", op)
+	}
+
+	// Remote operations come in under the new name.
+	op := commons.Operation{Type: "insert", Position: 3, Value: "!"}
+	after.publish(clusterEvent{Kind: eventOperation, Operation: &op})
+	if !waitFor(2*time.Second, func() bool { return room.text() == "hi!" }) {
+		t.Errorf("Expected the remote operation to be applied, got %q", room.text())
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/danii7514/codpen/commons"
+	"github.com/gorilla/websocket"
+)
+
+// Every connection costs the server a read loop and a few goroutines, so the
+// number of connections per room and per server can be limited. Connections
+// over capacity are refused during the WebSocket handshake with a 503 status,
+// and a Retry-After header. Browsers don't let pages see the response to a
+// refused handshake, so they are told why in a close frame instead.
+
+// retryAfterFull is how long clients refused for lack of capacity are told to
+// wait before trying again, in seconds.
+const retryAfterFull = 30
+
+var (
+	// openConns counts the WebSocket connections being served.
+	openConns int64
+
+	// connectionsRefused counts the connections refused for lack of capacity.
+	connectionsRefused counter
+
+	ErrRoomFull = errors.New(commons.RoomFullReason)
+)
+
+// acquireConn reserves one of max connections for the server, and reports
+// whether there was one left. A max of zero means no limit. Every successful
+// call must be paired with a call to releaseConn.
+func acquireConn(max int) bool {
+	for {
+		n := atomic.LoadInt64(&openConns)
+		if max > 0 && n >= int64(max) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&openConns, n, n+1) {
+			return true
+		}
+	}
+}
+
+// releaseConn frees a connection reserved by acquireConn.
+func releaseConn() {
+	atomic.AddInt64(&openConns, -1)
+}
+
+// fullReason returns the reason a connection is refused when reason's limit of
+// max connections is reached.
+func fullReason(reason string, max int) string {
+	return fmt.Sprintf("%s: %d connections at most, try again later", reason, max)
+}
+
+// refuseConn turns a connection down for lack of capacity, explaining why.
+func refuseConn(w http.ResponseWriter, r *http.Request, reason string) {
+	connectionsRefused.inc()
+
+	if r.Header.Get("Origin") != "" {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// Upgrade has responded with an error.
+			return
+		}
+		defer conn.Close()
+		_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, reason), time.Now().Add(time.Second))
+		return
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterFull))
+	http.Error(w, reason, http.StatusServiceUnavailable)
+}
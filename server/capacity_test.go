@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danii7514/codpen/commons"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// dialRoom opens a WebSocket to a room of server, with the given headers.
+func dialRoom(server *httptest.Server, room string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	return websocket.DefaultDialer.Dial("ws"+server.URL[4:]+"/ws?room="+room, header)
+}
+
+// expectFull checks that a connection was refused with the given reason.
+func expectFull(t *testing.T, description string, resp *http.Response, err error, reason string) {
+	t.Helper()
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("(%s) expected status %d, got %v", description, http.StatusServiceUnavailable, err)
+		return
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.HasPrefix(string(body), reason) || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("(%s) expected %q and a Retry-After header, got %q", description, reason, body)
+	}
+}
+
+func TestRoomCapacity(t *testing.T) {
+	drainChannels(t)
+	withLimits(t, Limits{MaxMessageSize: 1 << 20, MaxRoomClients: 2})
+
+	server := httptest.NewServer(newMux())
+	defer server.Close()
+
+	name := uuid.New().String()
+	for i := 0; i < 2; i++ {
+		conn, _, err := dialRoom(server, name, nil)
+		if err != nil {
+			t.Fatalf("Failed to establish WebSocket connection %d: %v", i, err)
+		}
+		defer conn.Close()
+	}
+
+	_, resp, err := dialRoom(server, name, nil)
+	expectFull(t, "full room", resp, err, commons.RoomFullReason)
+
+	// Browsers get the reason in a close frame.
+	conn, _, err := dialRoom(server, name, http.Header{"Origin": {server.URL}})
+	if err != nil {
+		t.Fatalf("Expected the handshake to succeed for a browser: %v", err)
+	}
+	defer conn.Close()
+	if ce := readCloseError(t, conn); ce.Code != websocket.CloseTryAgainLater || !strings.HasPrefix(ce.Text, commons.RoomFullReason) {
+		t.Errorf("Expected the room to be full, got %+v", ce)
+	}
+
+	// Other rooms are still open.
+	other, _, err := dialRoom(server, uuid.New().String(), nil)
+	if err != nil {
+		t.Fatalf("Expected to join another room: %v", err)
+	}
+	other.Close()
+}
+
+func TestServerCapacity(t *testing.T) {
+	drainChannels(t)
+	withLimits(t, Limits{MaxMessageSize: 1 << 20, MaxConnections: 1})
+
+	server := httptest.NewServer(newMux())
+	defer server.Close()
+
+	conn, _, err := dialRoom(server, uuid.New().String(), nil)
+	if err != nil {
+		t.Fatalf("Failed to establish WebSocket connection: %v", err)
+	}
+	readUntil(t, conn, commons.RoleMessage)
+
+	_, resp, err := dialRoom(server, uuid.New().String(), nil)
+	expectFull(t, "full server", resp, err, commons.ServerFullReason)
+
+	// The connection is freed once its client hangs up.
+	conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, _, err := dialRoom(server, uuid.New().String(), nil)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a connection to be accepted once another closed: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// The server's settings come from, in increasing order of precedence: their
+// defaults, a YAML config file named by -config or CODPEN_CONFIG, CODPEN_*
+// environment variables, and command line flags. Every flag has a matching
+// environment variable: -room-ttl is CODPEN_ROOM_TTL, and so on.
+//
+// On SIGHUP, the configuration is loaded again. The logging options, limits,
+// room TTL, allowed origins, auth secret, snapshot directory, webhooks and
+// shutdown timeout take effect immediately; changing the other settings
+// requires a restart. So does enabling or disabling TLS, or changing the client
+// CA, though the certificate and key are reloaded.
+
+// envPrefix is the prefix of the environment variables setting the server's options.
+const envPrefix = "CODPEN_"
+
+// Config holds the server's settings.
+type Config struct {
+	// Addr is the server's network address.
+	Addr string `yaml:"addr"`
+
+	// ShutdownTimeout is how long to wait for clients to disconnect when shutting down.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	HTTP      HTTPConfig      `yaml:"http"`
+	WebSocket WebSocketConfig `yaml:"websocket"`
+	Origins   OriginsConfig   `yaml:"origins"`
+	Rooms     RoomsConfig     `yaml:"rooms"`
+	Limits    Limits          `yaml:"limits"`
+	Auth      AuthConfig      `yaml:"auth"`
+	TLS       TLSConfig       `yaml:"tls"`
+	Cluster   ClusterConfig   `yaml:"cluster"`
+	Admin     AdminConfig     `yaml:"admin"`
+	Webhooks  WebhooksConfig  `yaml:"webhooks"`
+	Audit     AuditConfig     `yaml:"audit"`
+	Recording RecordingConfig `yaml:"recording"`
+	Log       LogConfig       `yaml:"log"`
+}
+
+// HTTPConfig holds the settings of the HTTP server. See http.Server.
+type HTTPConfig struct {
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+}
+
+// WebSocketConfig holds the settings used to upgrade connections. See websocket.Upgrader.
+type WebSocketConfig struct {
+	HandshakeTimeout time.Duration `yaml:"handshake_timeout"`
+	ReadBufferSize   int           `yaml:"read_buffer_size"`
+	WriteBufferSize  int           `yaml:"write_buffer_size"`
+}
+
+// RoomsConfig holds the settings of rooms.
+type RoomsConfig struct {
+	// TTL is how long an empty room is kept before it is closed.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+// AuthConfig holds the authentication settings.
+type AuthConfig struct {
+	// SecretFile is the file containing the secret used to verify access tokens.
+	// Authentication is disabled if it is empty.
+	SecretFile string `yaml:"secret_file"`
+	// OpenAPI opens the room management API to every client while authentication
+	// is disabled. Otherwise only the admin socket may use it then.
+	OpenAPI bool `yaml:"open_api"`
+	// PublicMetrics serves /metrics to every client. Otherwise only the clients
+	// which may use the room management API may read them.
+	PublicMetrics bool `yaml:"public_metrics"`
+}
+
+// LogConfig holds the logging settings.
+type LogConfig struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+}
+
+var (
+	// settingsMu protects the settings that can be reloaded while the server runs:
+	// limits, roomTTL, allowedOrigins, allowMissingOrigin, authSecret, openAPI,
+	// publicMetrics, snapshotDir, webhooks, webhookSecret and serverCert.
+	settingsMu sync.RWMutex
+
+	ErrEmptySecret = errors.New("auth secret file is empty")
+)
+
+// defaultConfig returns the server's default configuration.
+func defaultConfig() Config {
+	return Config{
+		Addr:            ":8084",
+		ShutdownTimeout: 10 * time.Second,
+		HTTP: HTTPConfig{
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		},
+		WebSocket: WebSocketConfig{
+			ReadBufferSize:  4096,
+			WriteBufferSize: 4096,
+		},
+		Origins:  OriginsConfig{AllowMissing: true},
+		Rooms:    RoomsConfig{TTL: defaultRoomTTL},
+		Limits:   defaultLimits,
+		Webhooks: WebhooksConfig{MaxAttempts: defaultWebhookAttempts},
+		Log:      LogConfig{Level: "info", Format: logFormatAuto},
+	}
+}
+
+// loadConfig returns the server's configuration, given its command line arguments
+// and a function looking up environment variables.
+func loadConfig(args []string, getenv func(string) string) (Config, error) {
+	// A first pass over the arguments finds the config file, which the other
+	// arguments override.
+	path := getenv(envPrefix + "CONFIG")
+	scratch := defaultConfig()
+	if err := newFlagSet(&scratch, &path, os.Stderr).Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	cfg := defaultConfig()
+	if path != "" {
+		if err := cfg.readFile(path); err != nil {
+			return Config{}, err
+		}
+	}
+
+	fs := newFlagSet(&cfg, &path, io.Discard)
+	if err := applyEnv(fs, getenv); err != nil {
+		return Config{}, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	return cfg, cfg.validate()
+}
+
+// newFlagSet returns the server's command line flags, which set the fields of cfg
+// and the path of the config file. Usage and errors are written to out.
+func newFlagSet(cfg *Config, path *string, out io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(out)
+
+	fs.StringVar(path, "config", *path, "YAML file to read the configuration from")
+	fs.StringVar(&cfg.Addr, "addr", cfg.Addr, "Server's network address")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "How long to wait for clients to disconnect when shutting down")
+	fs.DurationVar(&cfg.HTTP.ReadTimeout, "read-timeout", cfg.HTTP.ReadTimeout, "Maximum duration for reading a request (0 for no timeout)")
+	fs.DurationVar(&cfg.HTTP.WriteTimeout, "write-timeout", cfg.HTTP.WriteTimeout, "Maximum duration for writing a response (0 for no timeout)")
+	fs.DurationVar(&cfg.HTTP.IdleTimeout, "idle-timeout", cfg.HTTP.IdleTimeout, "How long to keep idle keep-alive connections open (0 to use the read timeout)")
+	fs.DurationVar(&cfg.WebSocket.HandshakeTimeout, "handshake-timeout", cfg.WebSocket.HandshakeTimeout, "Maximum duration of a WebSocket handshake (0 for no timeout)")
+	fs.IntVar(&cfg.WebSocket.ReadBufferSize, "read-buffer-size", cfg.WebSocket.ReadBufferSize, "Size of a connection's read buffer, in bytes")
+	fs.IntVar(&cfg.WebSocket.WriteBufferSize, "write-buffer-size", cfg.WebSocket.WriteBufferSize, "Size of a connection's write buffer, in bytes")
+	fs.Var((*stringList)(&cfg.Origins.Allowed), "allowed-origins", "Comma-separated origins allowed to open WebSockets besides the server's own, like https://*.example.com")
+	fs.BoolVar(&cfg.Origins.AllowMissing, "allow-missing-origin", cfg.Origins.AllowMissing, "Allow WebSockets without an Origin header, as opened by the terminal client")
+	fs.DurationVar(&cfg.Rooms.TTL, "room-ttl", cfg.Rooms.TTL, "How long an empty room is kept before it is closed")
+	fs.Int64Var(&cfg.Limits.MaxMessageSize, "max-message-size", cfg.Limits.MaxMessageSize, "The largest message a client may send, in bytes")
+	fs.Float64Var(&cfg.Limits.MessagesPerSecond, "rate-messages", cfg.Limits.MessagesPerSecond, "Messages per second a client may send (0 for no limit)")
+	fs.IntVar(&cfg.Limits.MessageBurst, "rate-messages-burst", cfg.Limits.MessageBurst, "Messages a client may send at once")
+	fs.Float64Var(&cfg.Limits.BytesPerSecond, "rate-bytes", cfg.Limits.BytesPerSecond, "Bytes per second a client may send (0 for no limit)")
+	fs.IntVar(&cfg.Limits.ByteBurst, "rate-bytes-burst", cfg.Limits.ByteBurst, "Bytes a client may send at once")
+	fs.IntVar(&cfg.Limits.MaxRoomClients, "max-room-clients", cfg.Limits.MaxRoomClients, "Connections a room may have (0 for no limit)")
+	fs.IntVar(&cfg.Limits.MaxConnections, "max-connections", cfg.Limits.MaxConnections, "Connections the server may have (0 for no limit)")
+	fs.StringVar(&cfg.Auth.SecretFile, "auth-secret-file", cfg.Auth.SecretFile, "File containing the secret used to verify access tokens. Authentication is disabled if empty")
+	fs.BoolVar(&cfg.Auth.OpenAPI, "open-api", cfg.Auth.OpenAPI, "Let anyone use the room management API while authentication is disabled, instead of only the admin socket")
+	fs.BoolVar(&cfg.Auth.PublicMetrics, "public-metrics", cfg.Auth.PublicMetrics, "Serve /metrics, which name every room, to anyone. Otherwise they take an admin token, the admin socket or -open-api")
+	fs.StringVar(&cfg.TLS.CertFile, "tls-cert", cfg.TLS.CertFile, "PEM file holding the server's certificate chain. TLS is disabled if empty")
+	fs.StringVar(&cfg.TLS.KeyFile, "tls-key", cfg.TLS.KeyFile, "PEM file holding the server's private key")
+	fs.StringVar(&cfg.TLS.ClientCAFile, "tls-client-ca", cfg.TLS.ClientCAFile, "PEM file holding the CAs client certificates must be signed by, to require them")
+	fs.BoolVar(&cfg.TLS.SelfSigned, "tls-self-signed", cfg.TLS.SelfSigned, "Serve TLS with a generated self-signed certificate, for development")
+	fs.StringVar(&cfg.Cluster.RedisAddr, "redis-addr", cfg.Cluster.RedisAddr, "Address of the Redis server relaying rooms between server nodes. The server runs alone if empty")
+	fs.StringVar(&cfg.Cluster.RedisPassword, "redis-password", cfg.Cluster.RedisPassword, "Password of the Redis server, preferably set with "+envPrefix+"REDIS_PASSWORD")
+	fs.StringVar(&cfg.Admin.Socket, "admin-socket", cfg.Admin.Socket, "Path of the Unix socket serving the room management API without access tokens. It is disabled if empty")
+	fs.StringVar(&cfg.Admin.SnapshotDir, "snapshot-dir", cfg.Admin.SnapshotDir, "Directory room snapshots are written to. Snapshots are disabled if empty")
+	fs.StringVar(&cfg.Audit.Dir, "audit-dir", cfg.Audit.Dir, "Directory the audit logs of rooms are written to. Auditing is disabled if empty")
+	fs.StringVar(&cfg.Recording.Dir, "record-dir", cfg.Recording.Dir, "Directory the sessions of rooms are recorded to, for codpen-replay. Recording is disabled if empty")
+	fs.Var((*stringList)(&cfg.Webhooks.URLs), "webhook-urls", "Comma-separated URLs room events are POSTed to. Webhooks are disabled if empty")
+	fs.StringVar(&cfg.Webhooks.SecretFile, "webhook-secret-file", cfg.Webhooks.SecretFile, "File containing the secret signing webhook requests")
+	fs.IntVar(&cfg.Webhooks.MaxAttempts, "webhook-max-attempts", cfg.Webhooks.MaxAttempts, "How many times a webhook delivery is attempted before giving up")
+	fs.StringVar(&cfg.Webhooks.DeadLetterFile, "webhook-dead-letter-file", cfg.Webhooks.DeadLetterFile, "File webhook deliveries that failed for good are appended to, as JSON lines")
+	fs.StringVar(&cfg.Log.Level, "log-level", cfg.Log.Level, "Minimum level of logged lines: debug, info, warn or error")
+	fs.StringVar(&cfg.Log.Format, "log-format", cfg.Log.Format, "Format of logged lines: auto (coloured on a terminal, logfmt otherwise), pretty, logfmt or json")
+
+	return fs
+}
+
+// readFile reads the YAML config file at path into cfg. Settings missing from the
+// file are left untouched, and unknown settings are an error.
+func (cfg *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// applyEnv sets the flags of fs from their environment variables.
+func applyEnv(fs *flag.FlagSet, getenv func(string) string) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Name == "config" {
+			return
+		}
+		name := envName(f.Name)
+		if value := getenv(name); value != "" {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %w", value, name, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// envName returns the name of the environment variable matching a flag.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// validate checks the configuration, reporting every problem found.
+func (cfg Config) validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(cfg.Addr != "", "addr must not be empty")
+	check(cfg.ShutdownTimeout > 0, "shutdown_timeout must be positive, got %s", cfg.ShutdownTimeout)
+	check(cfg.HTTP.ReadTimeout >= 0, "http.read_timeout must not be negative, got %s", cfg.HTTP.ReadTimeout)
+	check(cfg.HTTP.WriteTimeout >= 0, "http.write_timeout must not be negative, got %s", cfg.HTTP.WriteTimeout)
+	check(cfg.HTTP.IdleTimeout >= 0, "http.idle_timeout must not be negative, got %s", cfg.HTTP.IdleTimeout)
+	check(cfg.WebSocket.HandshakeTimeout >= 0, "websocket.handshake_timeout must not be negative, got %s", cfg.WebSocket.HandshakeTimeout)
+	check(cfg.WebSocket.ReadBufferSize >= 0, "websocket.read_buffer_size must not be negative, got %d", cfg.WebSocket.ReadBufferSize)
+	check(cfg.WebSocket.WriteBufferSize >= 0, "websocket.write_buffer_size must not be negative, got %d", cfg.WebSocket.WriteBufferSize)
+	check(cfg.Rooms.TTL > 0, "rooms.ttl must be positive, got %s", cfg.Rooms.TTL)
+
+	if err := cfg.Limits.validate(); err != nil {
+		problems = append(problems, "limits: "+err.Error())
+	}
+	if _, err := compileOrigins(cfg.Origins); err != nil {
+		problems = append(problems, "origins.allowed: "+err.Error())
+	}
+	problems = append(problems, cfg.TLS.validate()...)
+	problems = append(problems, cfg.Webhooks.validate()...)
+	if _, err := logrus.ParseLevel(cfg.Log.Level); err != nil {
+		problems = append(problems, "log.level: "+err.Error())
+	}
+	if _, err := newFormatter(cfg.Log.Format); err != nil {
+		problems = append(problems, "log.format: "+err.Error())
+	}
+	if cfg.Auth.SecretFile != "" {
+		if _, err := readSecret(cfg.Auth.SecretFile); err != nil {
+			problems = append(problems, "auth.secret_file: "+err.Error())
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n\t%s", strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
+
+// apply puts the settings that can change while the server runs into effect.
+func (cfg Config) apply() error {
+	if err := setupLogger(os.Stderr, cfg.Log.Level, cfg.Log.Format); err != nil {
+		return err
+	}
+
+	var secret []byte
+	if cfg.Auth.SecretFile != "" {
+		var err error
+		if secret, err = readSecret(cfg.Auth.SecretFile); err != nil {
+			return err
+		}
+	}
+
+	var hookSecret []byte
+	if cfg.Webhooks.SecretFile != "" {
+		var err error
+		if hookSecret, err = readSecret(cfg.Webhooks.SecretFile); err != nil {
+			return err
+		}
+	}
+
+	origins, err := compileOrigins(cfg.Origins)
+	if err != nil {
+		return err
+	}
+
+	var cert *tls.Certificate
+	if cfg.TLS.CertFile != "" {
+		pair, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			return err
+		}
+		cert = &pair
+	}
+
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+
+	limits = cfg.Limits
+	roomTTL = cfg.Rooms.TTL
+	allowedOrigins, allowMissingOrigin = origins, cfg.Origins.AllowMissing
+	authSecret, openAPI, publicMetrics = secret, cfg.Auth.OpenAPI, cfg.Auth.PublicMetrics
+	snapshotDir = cfg.Admin.SnapshotDir
+	webhooks, webhookSecret = cfg.Webhooks, hookSecret
+	if cert != nil {
+		serverCert = cert
+	}
+	return nil
+}
+
+// restartRequired returns the sections of the configuration which differ from
+// running, and only take effect when the server restarts.
+func (cfg Config) restartRequired(running Config) []string {
+	var changed []string
+	if cfg.Addr != running.Addr {
+		changed = append(changed, "addr")
+	}
+	if cfg.HTTP != running.HTTP {
+		changed = append(changed, "http")
+	}
+	if cfg.WebSocket != running.WebSocket {
+		changed = append(changed, "websocket")
+	}
+	if cfg.TLS.enabled() != running.TLS.enabled() || cfg.TLS.SelfSigned != running.TLS.SelfSigned || cfg.TLS.ClientCAFile != running.TLS.ClientCAFile {
+		changed = append(changed, "tls")
+	}
+	if cfg.Cluster != running.Cluster {
+		changed = append(changed, "cluster")
+	}
+	if cfg.Admin.Socket != running.Admin.Socket {
+		changed = append(changed, "admin.socket")
+	}
+	if cfg.Audit != running.Audit {
+		changed = append(changed, "audit")
+	}
+	if cfg.Recording != running.Recording {
+		changed = append(changed, "recording")
+	}
+	return changed
+}
+
+// reloadConfig loads the configuration again and applies the settings that can
+// change while the server runs. It returns the configuration now in effect, which
+// is running if the new configuration is invalid.
+func reloadConfig(running Config, args []string) Config {
+	cfg, err := loadConfig(args, os.Getenv)
+	if err != nil {
+		logger.WithError(err).Error("Failed to reload configuration, keeping the current one")
+		return running
+	}
+
+	for _, section := range cfg.restartRequired(running) {
+		logger.WithField("setting", section).Warn("Setting changed, restart the server to apply it")
+		if section == "tls" {
+			cfg.TLS = running.TLS
+		}
+	}
+	cfg.Addr, cfg.HTTP, cfg.WebSocket, cfg.Cluster = running.Addr, running.HTTP, running.WebSocket, running.Cluster
+	cfg.Admin.Socket, cfg.Audit, cfg.Recording = running.Admin.Socket, running.Audit, running.Recording
+
+	if err := cfg.apply(); err != nil {
+		logger.WithError(err).Error("Failed to reload configuration, keeping the current one")
+		if err := running.apply(); err != nil {
+			logger.WithError(err).Error("Failed to restore the previous configuration")
+		}
+		return running
+	}
+
+	logger.Info("Reloaded configuration")
+	return cfg
+}
+
+// readSecret reads an auth secret from a file, ignoring surrounding whitespace.
+func readSecret(path string) ([]byte, error) {
+	secret, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secret = bytes.TrimSpace(secret)
+	if len(secret) == 0 {
+		return nil, ErrEmptySecret
+	}
+	return secret, nil
+}
+
+// currentLimits returns the limits applied to new connections.
+func currentLimits() Limits {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return limits
+}
+
+// currentRoomTTL returns how long empty rooms are kept.
+func currentRoomTTL() time.Duration {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return roomTTL
+}
+
+// currentAuthSecret returns the secret used to verify access tokens, which is
+// empty when authentication is disabled.
+func currentAuthSecret() []byte {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return authSecret
+}
+
+// currentOpenAPI reports whether anyone may use the room management API while
+// authentication is disabled.
+func currentOpenAPI() bool {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return openAPI
+}
+
+// currentPublicMetrics reports whether anyone may read the server's metrics.
+func currentPublicMetrics() bool {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return publicMetrics
+}
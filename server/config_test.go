@@ -0,0 +1,197 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// env returns a getenv function looking variables up in vars.
+func env(vars map[string]string) func(string) string {
+	return func(name string) string { return vars[name] }
+}
+
+// writeFile writes content to a file in a temporary directory and returns its path.
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeFile(t, "codpen.yaml", `
+addr: ":9000"
+http:
+  read_timeout: 5s
+rooms:
+  ttl: 2m
+limits:
+  messages_per_second: 10
+  message_burst: 20
+log:
+  level: debug
+`)
+
+	cfg, err := loadConfig(
+		[]string{"-config", path, "-rate-messages", "30"},
+		env(map[string]string{"CODPEN_ROOM_TTL": "3m", "CODPEN_RATE_MESSAGES": "20"}),
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		description string
+		got, want   interface{}
+	}{
+		{description: "file", got: cfg.Addr, want: ":9000"},
+		{description: "file", got: cfg.HTTP.ReadTimeout, want: 5 * time.Second},
+		{description: "file", got: cfg.Log.Level, want: "debug"},
+		{description: "default", got: cfg.HTTP.WriteTimeout, want: 10 * time.Second},
+		{description: "default", got: cfg.Limits.MaxMessageSize, want: defaultLimits.MaxMessageSize},
+		{description: "environment over file", got: cfg.Rooms.TTL, want: 3 * time.Minute},
+		{description: "flag over environment", got: cfg.Limits.MessagesPerSecond, want: 30.0},
+	}
+
+	for _, tc := range tests {
+		if tc.got != tc.want {
+			t.Errorf("(%s) expected %v, got %v", tc.description, tc.want, tc.got)
+		}
+	}
+}
+
+func TestLoadConfigFromEnv(t *testing.T) {
+	path := writeFile(t, "codpen.yaml", "addr: \":9001\"\n")
+
+	cfg, err := loadConfig(nil, env(map[string]string{"CODPEN_CONFIG": path}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.Addr != ":9001" {
+		t.Errorf("Expected the config file named by CODPEN_CONFIG to be read, got addr %q", cfg.Addr)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	secret := writeFile(t, "secret", "  \n")
+
+	tests := []struct {
+		description string
+		file        string
+		args        []string
+		env         map[string]string
+		want        []string
+	}{
+		{
+			description: "unknown setting",
+			file:        "limits:\n  max_mesage_size: 10\n",
+			want:        []string{"max_mesage_size"},
+		},
+		{
+			description: "invalid YAML",
+			file:        "addr: [\n",
+			want:        []string{"parsing config file"},
+		},
+		{
+			description: "invalid environment variable",
+			env:         map[string]string{"CODPEN_ROOM_TTL": "soon"},
+			want:        []string{"CODPEN_ROOM_TTL"},
+		},
+		{
+			description: "invalid flag",
+			args:        []string{"-read-buffer-size", "big"},
+			want:        []string{"read-buffer-size"},
+		},
+		{
+			description: "every problem is reported",
+			args:        []string{"-room-ttl", "0", "-max-message-size", "0", "-log-format", "xml", "-log-level", "loud"},
+			want:        []string{"rooms.ttl", "limits:", "log.format", "log.level"},
+		},
+		{
+			description: "invalid origin",
+			env:         map[string]string{"CODPEN_ALLOWED_ORIGINS": "https://ok.example, https://bad.example/path"},
+			want:        []string{"origins.allowed", "bad.example/path"},
+		},
+		{
+			description: "empty secret",
+			args:        []string{"-auth-secret-file", secret},
+			want:        []string{"auth.secret_file", ErrEmptySecret.Error()},
+		},
+		{
+			description: "unsigned webhooks",
+			args:        []string{"-webhook-urls", "https://hooks.example/codpen,ftp://hooks.example", "-webhook-max-attempts", "0"},
+			want:        []string{"webhooks.urls", "ftp://hooks.example", "webhooks.secret_file", "webhooks.max_attempts"},
+		},
+		{
+			description: "missing file",
+			args:        []string{"-config", filepath.Join(t.TempDir(), "missing.yaml")},
+			want:        []string{"reading config file"},
+		},
+	}
+
+	for _, tc := range tests {
+		args := tc.args
+		if tc.file != "" {
+			args = append([]string{"-config", writeFile(t, "codpen.yaml", tc.file)}, args...)
+		}
+
+		_, err := loadConfig(args, env(tc.env))
+		if err == nil {
+			t.Errorf("(%s) expected an error", tc.description)
+			continue
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("(%s) expected the error to mention %q, got %q", tc.description, want, err)
+			}
+		}
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	defer func() { _ = defaultConfig().apply() }()
+
+	secret := writeFile(t, "secret", "s3cret\n")
+	path := writeFile(t, "codpen.yaml", "addr: \":9002\"\nrooms:\n  ttl: 5m\n")
+	args := []string{"-config", path, "-auth-secret-file", secret}
+
+	running, err := loadConfig(args, env(nil))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := running.apply(); err != nil {
+		t.Fatalf("Failed to apply configuration: %v", err)
+	}
+	if string(currentAuthSecret()) != "s3cret" || currentRoomTTL() != 5*time.Minute {
+		t.Fatalf("Expected the configuration to be applied")
+	}
+
+	// Live settings change, the others wait for a restart.
+	if err := os.WriteFile(path, []byte("addr: \":9003\"\nrooms:\n  ttl: 7m\nlimits:\n  max_message_size: 1024\n  byte_burst: 1024\n"), 0o600); err != nil {
+		t.Fatalf("Failed to update config file: %v", err)
+	}
+	reloaded := reloadConfig(running, args)
+	if currentRoomTTL() != 7*time.Minute || currentLimits().MaxMessageSize != 1024 {
+		t.Errorf("Expected the live settings to be reloaded, got TTL %s and limits %+v", currentRoomTTL(), currentLimits())
+	}
+	if reloaded.Addr != ":9002" {
+		t.Errorf("Expected addr to keep its running value, got %q", reloaded.Addr)
+	}
+	if changed := reloaded.restartRequired(running); len(changed) != 0 {
+		t.Errorf("Expected the reloaded configuration to match the running server, got changes to %v", changed)
+	}
+
+	// An invalid configuration is ignored.
+	if err := os.WriteFile(path, []byte("rooms:\n  ttl: -1m\n"), 0o600); err != nil {
+		t.Fatalf("Failed to update config file: %v", err)
+	}
+	if got := reloadConfig(reloaded, args); !reflect.DeepEqual(got, reloaded) || currentRoomTTL() != 7*time.Minute {
+		t.Errorf("Expected an invalid configuration to be ignored")
+	}
+}
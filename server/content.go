@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/danii7514/codpen/commons"
+	"github.com/danii7514/codpen/crdt"
+	"github.com/google/uuid"
+)
+
+// A room's content can be exported and imported over HTTP:
+//
+//	GET /rooms/{room}/content   returns the room's text, or its CRDT document with ?format=json
+//	PUT /rooms/{room}/content   merges text into the room, or replaces it with ?mode=replace
+//
+// PUT accepts a CRDT document instead of text with ?format=json, which always
+// replaces the room's document. Rooms that don't exist are created by PUT. See
+// authorizeRoom for who may read and write rooms.
+
+var ErrNotAllowed = errors.New("access token doesn't allow this")
+
+// handleRoomContent serves /rooms/{room}/content.
+func handleRoomContent(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case http.MethodGet:
+		if !authorizeRoom(w, r, name, false) {
+			return
+		}
+		room := findRoom(name)
+		if room == nil {
+			writeError(w, http.StatusNotFound, ErrRoomNotFound)
+			return
+		}
+		if r.URL.Query().Get("format") == "json" {
+			writeJSON(w, http.StatusOK, room.document())
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = io.WriteString(w, room.text())
+
+	case http.MethodPut:
+		if !authorizeRoom(w, r, name, true) {
+			return
+		}
+		putRoomContent(w, r, name)
+
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPut)
+	}
+}
+
+// putRoomContent imports the body of a PUT /rooms/{room}/content request into a room.
+func putRoomContent(w http.ResponseWriter, r *http.Request, name string) {
+	body := http.MaxBytesReader(w, r.Body, currentLimits().MaxMessageSize)
+	query := r.URL.Query()
+
+	var doc *crdt.Document
+	var text string
+	if query.Get("format") == "json" {
+		doc = &crdt.Document{}
+		if err := json.NewDecoder(body).Decode(doc); err != nil || len(doc.Characters) < 2 {
+			writeError(w, http.StatusBadRequest, errors.New("invalid document"))
+			return
+		}
+	} else {
+		b, err := io.ReadAll(body)
+		if err != nil {
+			writeError(w, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		text = string(b)
+	}
+
+	room := findRoom(name)
+	if room == nil {
+		var err error
+		if room, err = createRoom(name, text); err != nil {
+			writeError(w, statusFor(err), err)
+			return
+		}
+		if doc != nil {
+			room.relayMu.Lock()
+			room.setDocument(*doc)
+			room.recordDocument(uuid.Nil, *doc)
+			room.relayMu.Unlock()
+		}
+		room.auditText(requestUser(r))
+		room.log().Info("Created room from uploaded content")
+		room.emitEvent(eventContentSaved, map[string]string{"source": "upload"})
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	switch {
+	case doc != nil:
+		room.replaceDocument(*doc, requestUser(r))
+	case query.Get("mode") == "replace":
+		newDoc, err := newDocument(text)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		room.replaceDocument(newDoc, requestUser(r))
+	default:
+		if err := room.mergeText(text, requestUser(r)); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	room.log().Info("Updated room content")
+	room.emitEvent(eventContentSaved, map[string]string{"source": "upload"})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authorizeRoom checks that a request may read, or write if write is set, the
+// content of a room, responding with an error if it may not. Admins may access
+// every room, and other users the rooms their token lets them join. Without
+// authentication, anyone may read a room, as anyone may join it, but only the
+// admin socket may write to it, unless the API is opened with -open-api.
+func authorizeRoom(w http.ResponseWriter, r *http.Request, name string, write bool) bool {
+	if isTrusted(r) {
+		return true
+	}
+	secret := currentAuthSecret()
+	if len(secret) == 0 {
+		if !write || currentOpenAPI() {
+			return true
+		}
+		writeError(w, http.StatusForbidden, ErrAPIClosed)
+		return false
+	}
+
+	claims, err := parseToken(tokenFromRequest(r), secret)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="codpen"`)
+		writeError(w, http.StatusUnauthorized, err)
+		return false
+	}
+
+	if claims.Admin {
+		return true
+	}
+	if !claims.canJoin(name) || (write && claims.Role != "" && !claims.Role.CanEdit()) {
+		writeError(w, http.StatusForbidden, ErrNotAllowed)
+		return false
+	}
+
+	return true
+}
+
+// replaceDocument replaces the room's document on behalf of user, and sends the
+// new document to every client in the room.
+func (r *Room) replaceDocument(doc crdt.Document, user string) {
+	r.relayMu.Lock()
+	defer r.relayMu.Unlock()
+
+	r.setDocument(doc)
+	r.resetHistory()
+	r.audit(auditEntry{User: user, Type: auditReplace, Text: crdt.Content(doc)})
+	r.recordDocument(uuid.Nil, doc)
+	r.Clients.broadcastAllExcept(commons.Message{Type: commons.DocSyncMessage, Document: doc, Seq: r.seq}, uuid.Nil, r.ID)
+	r.publish(clusterEvent{Kind: eventDocument, Document: &doc})
+}
+
+// mergeText turns the room's text into text with as few insertions and deletions
+// as possible, applying them to the room's document on behalf of user and
+// relaying them to every client in the room like any other operation.
+func (r *Room) mergeText(text string, user string) error {
+	r.relayMu.Lock()
+	defer r.relayMu.Unlock()
+
+	for _, op := range diffOperations([]rune(r.text()), []rune(text)) {
+		char, err := r.apply(op)
+		if err != nil {
+			return err
+		}
+		seq := r.record(op, "")
+		r.auditOperation(auditEntry{User: user}, op, char)
+		msg := commons.Message{Type: commons.OperationMessage, Operation: op, Seq: seq}
+		r.recordOperation(uuid.Nil, "", user, msg)
+		r.Clients.broadcastAllExcept(msg, uuid.Nil, r.ID)
+		r.publish(clusterEvent{Kind: eventOperation, Operation: &op})
+		operationsRelayed.inc()
+	}
+	return nil
+}
+
+// diffOperations returns the insert and delete operations turning a into b.
+// Positions follow the conventions of crdt.Document's Insert and Delete.
+func diffOperations(a, b []rune) []commons.Operation {
+	var ops []commons.Operation
+
+	// pos is the number of characters before the next edit.
+	pos := 0
+	for _, e := range diff(a, b) {
+		switch e.kind {
+		case editKeep:
+			pos++
+		case editDelete:
+			ops = append(ops, commons.Operation{Type: "delete", Position: pos + 1, Value: string(e.r)})
+		case editInsert:
+			ops = append(ops, commons.Operation{Type: "insert", Position: pos + 1, Value: string(e.r)})
+			pos++
+		}
+	}
+
+	return ops
+}
+
+// The kinds of edits in an edit script.
+const (
+	editKeep = iota
+	editDelete
+	editInsert
+)
+
+// An edit is a step of an edit script.
+type edit struct {
+	kind int
+	r    rune
+}
+
+// maxDiffEdits bounds the length of the edit scripts diff looks for. Texts
+// further apart are replaced whole, so that diffing unrelated texts costs
+// neither much time nor memory.
+const maxDiffEdits = 2048
+
+// diff returns a shortest edit script turning a into b, using the linear space
+// variant of Myers' algorithm ("An O(ND) Difference Algorithm and Its
+// Variations", 1986). If that script would take more than maxDiffEdits edits, it
+// deletes whatever differs in a and inserts whatever differs in b instead.
+func diff(a, b []rune) []edit {
+	// Common prefixes and suffixes are kept as is, which is cheap and usually most of the text.
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	edits := make([]edit, 0, len(a)+len(b)-prefix-suffix)
+	edits = keep(edits, a[:prefix])
+	a2, b2 := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if s := middleSnake(a2, b2, maxDiffEdits); s.d <= maxDiffEdits {
+		edits = myersSplit(edits, a2, b2, s)
+	} else {
+		edits = replace(edits, a2, b2)
+	}
+	return keep(edits, a[len(a)-suffix:])
+}
+
+// myers appends a shortest edit script turning a into b to edits, knowing it
+// takes at most max edits.
+func myers(edits []edit, a, b []rune, max int) []edit {
+	if len(a) == 0 || len(b) == 0 {
+		return replace(edits, a, b)
+	}
+	return myersSplit(edits, a, b, middleSnake(a, b, max))
+}
+
+// myersSplit appends a shortest edit script turning a into b to edits, given
+// the middle snake of one.
+func myersSplit(edits []edit, a, b []rune, s snake) []edit {
+	if s.d > 1 {
+		// Either half takes at most half of the edits, rounded up.
+		edits = myers(edits, a[:s.x], b[:s.y], (s.d+1)/2)
+		edits = keep(edits, a[s.x:s.u])
+		return myers(edits, a[s.u:], b[s.v:], (s.d+1)/2)
+	}
+
+	// The longer text is the shorter one with at most one more character.
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	edits = keep(edits, a[:i])
+	switch {
+	case len(a) > len(b):
+		edits = append(edits, edit{editDelete, a[i]})
+		return keep(edits, a[i+1:])
+	case len(b) > len(a):
+		edits = append(edits, edit{editInsert, b[i]})
+		return keep(edits, b[i+1:])
+	}
+	return edits
+}
+
+// A snake is the middle snake of a shortest edit script: the diagonal run
+// from (x, y) to (u, v) which the script of d edits goes through halfway.
+type snake struct {
+	d, x, y, u, v int
+}
+
+// middleSnake returns the middle snake of a shortest edit script turning a into
+// b, searching forwards from the start of the texts and backwards from their end
+// at once, which takes space linear in max. If the script takes more than max
+// edits, it gives up and returns a snake with d > max.
+func middleSnake(a, b []rune, max int) snake {
+	n, m := len(a), len(b)
+	delta := n - m
+	odd := delta%2 != 0
+
+	dmax := (n + m + 1) / 2
+	if (max+1)/2 < dmax {
+		dmax = (max + 1) / 2
+	}
+	// forward[k] is the furthest x reached on diagonal k = x-y from the start,
+	// and backward[c] the same from the end of the texts, with x and y counted
+	// from there.
+	offset := dmax + 1
+	forward := make([]int, 2*dmax+3)
+	backward := make([]int, 2*dmax+3)
+
+	for d := 0; d <= dmax; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+			y := x - k
+			x0, y0 := x, y
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			forward[offset+k] = x
+			if c := delta - k; odd && c >= -(d-1) && c <= d-1 && x+backward[offset+c] >= n {
+				return snake{d: 2*d - 1, x: x0, y: y0, u: x, v: y}
+			}
+		}
+
+		for c := -d; c <= d; c += 2 {
+			var x int
+			if c == -d || (c != d && backward[offset+c-1] < backward[offset+c+1]) {
+				x = backward[offset+c+1]
+			} else {
+				x = backward[offset+c-1] + 1
+			}
+			y := x - c
+			x0, y0 := x, y
+			for x < n && y < m && a[n-1-x] == b[m-1-y] {
+				x++
+				y++
+			}
+			backward[offset+c] = x
+			if k := delta - c; !odd && k >= -d && k <= d && x+forward[offset+k] >= n {
+				return snake{d: 2 * d, x: n - x, y: m - y, u: n - x0, v: m - y0}
+			}
+		}
+	}
+	return snake{d: max + 1}
+}
+
+// keep appends edits keeping the runes of s to edits.
+func keep(edits []edit, s []rune) []edit {
+	for _, r := range s {
+		edits = append(edits, edit{editKeep, r})
+	}
+	return edits
+}
+
+// replace appends edits deleting the runes of a and inserting those of b to edits.
+func replace(edits []edit, a, b []rune) []edit {
+	for _, r := range a {
+		edits = append(edits, edit{editDelete, r})
+	}
+	for _, r := range b {
+		edits = append(edits, edit{editInsert, r})
+	}
+	return edits
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/danii7514/codpen/commons"
+	"github.com/danii7514/codpen/crdt"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+func TestDiffOperations(t *testing.T) {
+	tests := []struct {
+		description string
+		from, to    string
+		ops         int
+	}{
+		{description: "identical", from: "hello", to: "hello", ops: 0},
+		{description: "from empty", from: "", to: "abc", ops: 3},
+		{description: "to empty", from: "abc", to: "", ops: 3},
+		{description: "insertion", from: "helo", to: "hello", ops: 1},
+		{description: "deletion", from: "hello world", to: "hello", ops: 6},
+		{description: "replacement", from: "cat", to: "cut", ops: 2},
+		{description: "interleaved", from: "abcabba", to: "cbabac", ops: 5},
+		{description: "multibyte", from: "héllo\nwörld", to: "hällo\nworld!", ops: 5},
+	}
+
+	for _, tc := range tests {
+		doc, err := newDocument(tc.from)
+		if err != nil {
+			t.Fatalf("(%s) failed to create document: %v", tc.description, err)
+		}
+
+		ops := diffOperations([]rune(tc.from), []rune(tc.to))
+		if len(ops) != tc.ops {
+			t.Errorf("(%s) expected %d operations, got %d: %+v", tc.description, tc.ops, len(ops), ops)
+		}
+
+		for _, op := range ops {
+			switch op.Type {
+			case "insert":
+				if _, err := doc.Insert(op.Position, op.Value); err != nil {
+					t.Fatalf("(%s) failed to apply %+v: %v", tc.description, op, err)
+				}
+			case "delete":
+				doc.Delete(op.Position)
+			}
+		}
+		if got := crdt.Content(doc); got != tc.to {
+			t.Errorf("(%s) expected %q after applying operations, got %q", tc.description, tc.to, got)
+		}
+	}
+}
+
+func TestDiffLargeTexts(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := func(n int) []rune {
+		s := make([]rune, n)
+		for i := range s {
+			s[i] = rune('a' + rng.Intn(26))
+		}
+		return s
+	}
+	text := random(1 << 18)
+	edited := append([]rune(nil), text...)
+	for i := 0; i < 500; i++ {
+		edited[rng.Intn(len(edited))] = '!'
+	}
+
+	tests := []struct {
+		description string
+		from, to    []rune
+		maxEdits    int
+	}{
+		{description: "unrelated texts", from: random(1 << 18), to: random(1 << 18), maxEdits: 1 << 19},
+		{description: "scattered edits", from: text, to: edited, maxEdits: 1000},
+	}
+
+	for _, tc := range tests {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		edits := diff(tc.from, tc.to)
+		runtime.ReadMemStats(&after)
+		if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 64<<20 {
+			t.Errorf("(%s) expected the diff to allocate at most 64 MiB, it allocated %d MiB", tc.description, alloc>>20)
+		}
+
+		var from, to []rune
+		n := 0
+		for _, e := range edits {
+			if e.kind != editInsert {
+				from = append(from, e.r)
+			}
+			if e.kind != editDelete {
+				to = append(to, e.r)
+			}
+			if e.kind != editKeep {
+				n++
+			}
+		}
+		if string(from) != string(tc.from) || string(to) != string(tc.to) {
+			t.Errorf("(%s) expected the edit script to turn one text into the other", tc.description)
+		}
+		if n > tc.maxEdits {
+			t.Errorf("(%s) expected at most %d edits, got %d", tc.description, tc.maxEdits, n)
+		}
+	}
+}
+
+// contentRequest sends a request to the content endpoint of a room and returns the response status and body.
+func contentRequest(t *testing.T, server *httptest.Server, method, room, query, body string) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, server.URL+"/rooms/"+room+"/content"+query, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+func TestRoomContent(t *testing.T) {
+	withOpenAPI(t)
+	drainChannels(t)
+
+	server := httptest.NewServer(newMux())
+	defer server.Close()
+
+	name := uuid.New().String()
+
+	if status, _ := contentRequest(t, server, http.MethodGet, name, "", ""); status != http.StatusNotFound {
+		t.Errorf("Expected status %d for a missing room, got %d", http.StatusNotFound, status)
+	}
+	if status, _ := contentRequest(t, server, http.MethodPut, name, "", "hello world\n"); status != http.StatusCreated {
+		t.Fatalf("Expected status %d creating a room, got %d", http.StatusCreated, status)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:]+"/ws?room="+name, nil)
+	if err != nil {
+		t.Fatalf("Failed to establish WebSocket connection: %v", err)
+	}
+	defer conn.Close()
+	doc := readUntil(t, conn, commons.DocSyncMessage).Document
+
+	// Merging sends the connected client the operations turning its text into the new one.
+	want := "hello, wide world\n"
+	if status, _ := contentRequest(t, server, http.MethodPut, name, "", want); status != http.StatusNoContent {
+		t.Fatalf("Expected status %d merging content, got %d", http.StatusNoContent, status)
+	}
+	for _, op := range diffOperations([]rune("hello world\n"), []rune(want)) {
+		msg := readUntil(t, conn, commons.OperationMessage)
+		if msg.Operation != op {
+			t.Fatalf("Expected operation %+v, got %+v", op, msg.Operation)
+		}
+		switch op.Type {
+		case "insert":
+			_, _ = doc.Insert(op.Position, op.Value)
+		case "delete":
+			doc.Delete(op.Position)
+		}
+	}
+	if got := crdt.Content(doc); got != want {
+		t.Errorf("Expected the client's text to be %q, got %q", want, got)
+	}
+	if status, body := contentRequest(t, server, http.MethodGet, name, "", ""); status != http.StatusOK || body != want {
+		t.Errorf("Expected %q, got %d %q", want, status, body)
+	}
+
+	// Replacing sends the client the new document.
+	if status, _ := contentRequest(t, server, http.MethodPut, name, "?mode=replace", "replaced"); status != http.StatusNoContent {
+		t.Fatalf("Expected status %d replacing content, got %d", http.StatusNoContent, status)
+	}
+	if got := crdt.Content(readUntil(t, conn, commons.DocSyncMessage).Document); got != "replaced" {
+		t.Errorf("Expected the client to be sent %q, got %q", "replaced", got)
+	}
+
+	status, body := contentRequest(t, server, http.MethodGet, name, "?format=json", "")
+	var exported crdt.Document
+	if err := json.Unmarshal([]byte(body), &exported); status != http.StatusOK || err != nil {
+		t.Fatalf("Expected a JSON document, got %d %q", status, body)
+	}
+	if got := crdt.Content(exported); got != "replaced" {
+		t.Errorf("Expected the exported document to contain %q, got %q", "replaced", got)
+	}
+
+	if status, _ := contentRequest(t, server, http.MethodPut, name, "?format=json", "{}"); status != http.StatusBadRequest {
+		t.Errorf("Expected status %d for an invalid document, got %d", http.StatusBadRequest, status)
+	}
+}
+
+func TestRoomContentAuth(t *testing.T) {
+	authSecret = []byte("secret")
+	defer func() { authSecret = nil }()
+
+	name := uuid.New().String()
+	if _, err := createRoom(name, "secret plans"); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	defer func() { _ = deleteRoom(name, roomDeletedReason) }()
+
+	member, _ := signToken(Claims{Subject: "alice", Rooms: []string{name}}, authSecret)
+	viewer, _ := signToken(Claims{Subject: "bob", Rooms: []string{name}, Role: commons.RoleViewer}, authSecret)
+	stranger, _ := signToken(Claims{Subject: "eve", Rooms: []string{"other"}}, authSecret)
+	admin, _ := signToken(Claims{Subject: "root", Admin: true}, authSecret)
+
+	tests := []struct {
+		description string
+		method      string
+		token       string
+		status      int
+	}{
+		{description: "no token", method: http.MethodGet, status: http.StatusUnauthorized},
+		{description: "stranger", method: http.MethodGet, token: stranger, status: http.StatusForbidden},
+		{description: "member reading", method: http.MethodGet, token: member, status: http.StatusOK},
+		{description: "viewer reading", method: http.MethodGet, token: viewer, status: http.StatusOK},
+		{description: "viewer writing", method: http.MethodPut, token: viewer, status: http.StatusForbidden},
+		{description: "member writing", method: http.MethodPut, token: member, status: http.StatusNoContent},
+		{description: "admin writing", method: http.MethodPut, token: admin, status: http.StatusNoContent},
+	}
+
+	for _, tc := range tests {
+		req := httptest.NewRequest(tc.method, "/rooms/"+name+"/content", strings.NewReader("secret plans"))
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		rec := httptest.NewRecorder()
+		newMux().ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("(%s) expected status %d, got %d", tc.description, tc.status, rec.Code)
+		}
+	}
+}
+
+// TestRoomContentOpen checks who may read and write rooms while authentication
+// is disabled.
+func TestRoomContentOpen(t *testing.T) {
+	name := uuid.New().String()
+	if _, err := createRoom(name, "notes"); err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	defer func() { _ = deleteRoom(name, roomDeletedReason) }()
+
+	tests := []struct {
+		description string
+		method      string
+		query       string
+		open        bool
+		trusted     bool
+		status      int
+	}{
+		{description: "reading", method: http.MethodGet, status: http.StatusOK},
+		{description: "replacing", method: http.MethodPut, query: "?mode=replace", status: http.StatusForbidden},
+		{description: "merging", method: http.MethodPut, status: http.StatusForbidden},
+		{description: "replacing on the admin socket", method: http.MethodPut, query: "?mode=replace", trusted: true, status: http.StatusNoContent},
+		{description: "replacing with the API opened", method: http.MethodPut, query: "?mode=replace", open: true, status: http.StatusNoContent},
+	}
+
+	for _, tc := range tests {
+		openAPI = tc.open
+		req := httptest.NewRequest(tc.method, "/rooms/"+name+"/content"+tc.query, strings.NewReader("notes"))
+		if tc.trusted {
+			req = req.WithContext(context.WithValue(req.Context(), trustedKey{}, true))
+		}
+		rec := httptest.NewRecorder()
+		newMux().ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("(%s) expected status %d, got %d", tc.description, tc.status, rec.Code)
+		}
+	}
+	openAPI = false
+
+	room := findRoom(name)
+	if room == nil || room.text() != "notes" {
+		t.Errorf("Expected the room to keep its text")
+	}
+
+	other := uuid.New().String()
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/rooms/"+other+"/content", strings.NewReader("spam")))
+	if rec.Code != http.StatusForbidden || findRoom(other) != nil {
+		t.Errorf("Expected status %d and no room created, got %d", http.StatusForbidden, rec.Code)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// healthCheckTimeout bounds how long a single readiness check may take.
+const healthCheckTimeout = time.Second
+
+var (
+	// readinessChecks are run by /readyz. Each check returns an error if the part
+	// of the server it covers can't serve clients.
+	readinessChecks = map[string]func() error{
+		"rooms":   checkRoomHub,
+		"storage": checkStorage,
+		"cluster": checkCluster,
+	}
+
+	// storageCheck reports whether the storage backend, if any, is reachable. It
+	// is nil when the server runs without storage.
+	storageCheck func() error
+
+	ErrCheckTimeout = errors.New("check timed out")
+	ErrDraining     = errors.New("server is shutting down")
+)
+
+// handleRoot serves "/" and the paths no other handler serves. WebSocket
+// upgrades are accepted on "/" for clients predating the "/ws" path; anything
+// else is the web client, see serveWebClient.
+func handleRoot(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/" && websocket.IsWebSocketUpgrade(r) {
+		handleConn(w, r)
+		return
+	}
+	serveWebClient(w, r)
+}
+
+// handleHealthz reports whether the server process is alive.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// A readinessReport is the body of a /readyz response.
+type readinessReport struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// handleReadyz reports whether the server is ready to accept clients. It responds
+// with 503 Service Unavailable if the server is shutting down or any check fails.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	report := readinessReport{Status: "ok", Checks: make(map[string]string)}
+
+	if isDraining() {
+		report.Status = ErrDraining.Error()
+	}
+
+	names := make([]string, 0, len(readinessChecks))
+	for name := range readinessChecks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := runCheck(readinessChecks[name]); err != nil {
+			report.Checks[name] = err.Error()
+			report.Status = "unavailable"
+			continue
+		}
+		report.Checks[name] = "ok"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// runCheck runs a check, giving up after healthCheckTimeout.
+func runCheck(check func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- check()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(healthCheckTimeout):
+		return ErrCheckTimeout
+	}
+}
+
+// checkRoomHub checks that the rooms map isn't stuck, and that the monitor of
+// every room answers requests.
+func checkRoomHub() error {
+	roomsMapMutex.Lock()
+	rooms := make([]*Room, 0, len(roomsMap))
+	for _, room := range roomsMap {
+		rooms = append(rooms, room)
+	}
+	roomsMapMutex.Unlock()
+
+	var wg sync.WaitGroup
+	for _, room := range rooms {
+		wg.Add(1)
+		go func(room *Room) {
+			defer wg.Done()
+			<-room.Clients.get(uuid.Nil)
+		}(room)
+	}
+	wg.Wait()
+
+	return nil
+}
+
+// checkStorage checks the storage backend, if any.
+func checkStorage() error {
+	if storageCheck == nil {
+		return nil
+	}
+	return storageCheck()
+}
+
+// checkCluster checks the broker relaying rooms between nodes, if any.
+func checkCluster() error {
+	if p, ok := broker.(interface{ Ping() error }); ok {
+		return p.Ping()
+	}
+	return nil
+}
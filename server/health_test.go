@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestHandleRoot(t *testing.T) {
+	defer func(assets fs.FS) { webAssets = assets }(webAssets)
+	webAssets = fstest.MapFS{
+		"index.html":       {Data: []byte("<!DOCTYPE html>client")},
+		"logo.svg":         {Data: []byte("<svg/>")},
+		"assets/index.js":  {Data: []byte("console.log()")},
+		"assets/empty/.ok": {},
+	}
+
+	tests := []struct {
+		description string
+		method      string
+		path        string
+		upgrade     bool
+		status      int
+		body        string
+		cache       string
+	}{
+		// Without a room, handleConn refuses the upgrade, which shows the request reached it.
+		{description: "upgrade on /", path: "/", upgrade: true, status: http.StatusBadRequest},
+		{description: "plain request on /", path: "/", status: http.StatusOK, body: "<!DOCTYPE html>client", cache: "no-cache"},
+		{description: "upgrade elsewhere", path: "/elsewhere", upgrade: true, status: http.StatusOK, body: "<!DOCTYPE html>client"},
+		{description: "client route", path: "/edit?room=notes&username=alice", status: http.StatusOK, body: "<!DOCTYPE html>client", cache: "no-cache"},
+		{description: "file", path: "/logo.svg", status: http.StatusOK, body: "<svg/>"},
+		{description: "bundled asset", path: "/assets/index.js", status: http.StatusOK, body: "console.log()", cache: "public, max-age=31536000, immutable"},
+		{description: "directory", path: "/assets/empty", status: http.StatusOK, body: "<!DOCTYPE html>client"},
+		{description: "missing file", path: "/assets/missing.js", status: http.StatusNotFound},
+		{description: "escaping the assets", path: "/../go.mod", status: http.StatusNotFound},
+		{description: "wrong method", method: http.MethodPost, path: "/edit", status: http.StatusMethodNotAllowed},
+	}
+
+	for _, tc := range tests {
+		method := tc.method
+		if method == "" {
+			method = http.MethodGet
+		}
+		req := httptest.NewRequest(method, tc.path, nil)
+		if tc.upgrade {
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "websocket")
+		}
+		rec := httptest.NewRecorder()
+		handleRoot(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("(%s) expected status %d, got %d", tc.description, tc.status, rec.Code)
+		}
+		if tc.body != "" && rec.Body.String() != tc.body {
+			t.Errorf("(%s) expected body %q, got %q", tc.description, tc.body, rec.Body.String())
+		}
+		if got := rec.Header().Get("Cache-Control"); tc.cache != "" && got != tc.cache {
+			t.Errorf("(%s) expected Cache-Control %q, got %q", tc.description, tc.cache, got)
+		}
+	}
+
+	// A server built without the web client says how to build it.
+	webAssets = fstest.MapFS{}
+	rec := httptest.NewRecorder()
+	handleRoot(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "yarn build") {
+		t.Errorf("Expected a page explaining how to build the web client, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHandleReadyz(t *testing.T) {
+	tests := []struct {
+		description string
+		storage     func() error
+		draining    bool
+		status      int
+		storageMsg  string
+	}{
+		{description: "ready", status: http.StatusOK, storageMsg: "ok"},
+		{description: "storage down", storage: func() error { return errors.New("disk full") }, status: http.StatusServiceUnavailable, storageMsg: "disk full"},
+		{description: "draining", draining: true, status: http.StatusServiceUnavailable, storageMsg: "ok"},
+	}
+
+	for _, tc := range tests {
+		storageCheck = tc.storage
+		if tc.draining {
+			setDraining(true)
+		}
+
+		rec := httptest.NewRecorder()
+		handleReadyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+		storageCheck = nil
+		setDraining(false)
+
+		if rec.Code != tc.status {
+			t.Errorf("(%s) expected status %d, got %d", tc.description, tc.status, rec.Code)
+		}
+
+		var report readinessReport
+		if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+			t.Fatalf("(%s) failed to decode report: %v", tc.description, err)
+		}
+		if report.Checks["storage"] != tc.storageMsg || report.Checks["rooms"] != "ok" {
+			t.Errorf("(%s) unexpected checks %v", tc.description, report.Checks)
+		}
+	}
+}
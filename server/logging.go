@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/sirupsen/logrus"
+)
+
+// logger is the server's logger. Lines about a room or a client carry its
+// fields: see (*Room).log and (*client).log.
+var logger = logrus.New()
+
+// The log formats the server supports.
+const (
+	// logFormatAuto writes coloured lines when writing to a terminal, and logfmt otherwise.
+	logFormatAuto = "auto"
+
+	// logFormatPretty always writes coloured, human-readable lines, for local development.
+	logFormatPretty = "pretty"
+
+	// logFormatLogfmt writes key=value lines (https://brandur.org/logfmt).
+	logFormatLogfmt = "logfmt"
+
+	// logFormatJSON writes a JSON object per line.
+	logFormatJSON = "json"
+)
+
+// setupLogger configures logger to write lines at or above level to out, in the given format.
+func setupLogger(out io.Writer, level, format string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	formatter, err := newFormatter(format)
+	if err != nil {
+		return err
+	}
+
+	logger.SetOutput(out)
+	logger.SetLevel(lvl)
+	logger.SetFormatter(formatter)
+	return nil
+}
+
+// newFormatter returns the formatter writing lines in the given format.
+func newFormatter(format string) (logrus.Formatter, error) {
+	switch format {
+	case logFormatAuto:
+		return &logrus.TextFormatter{FullTimestamp: true}, nil
+	case logFormatPretty:
+		return &logrus.TextFormatter{FullTimestamp: true, ForceColors: true}, nil
+	case logFormatLogfmt:
+		return &logrus.TextFormatter{FullTimestamp: true, DisableColors: true}, nil
+	case logFormatJSON:
+		return &logrus.JSONFormatter{}, nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+// log returns a log entry carrying the room's fields. roomsMapMutex must not be held.
+func (r *Room) log() *logrus.Entry {
+	return logger.WithFields(logrus.Fields{"room": r.name(), "room_id": r.ID})
+}
+
+// log returns a log entry carrying the client's fields, and those of its room once
+// it has joined one.
+func (c *client) log() *logrus.Entry {
+	if c.entry != nil {
+		return c.entry
+	}
+	return logger.WithFields(logrus.Fields{"client": c.id, "site": c.SiteID})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// withLogOutput makes the logger write to a buffer for the duration of a test.
+func withLogOutput(t *testing.T, level, format string) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := setupLogger(&buf, level, format); err != nil {
+		t.Fatalf("Failed to set up logger: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = setupLogger(os.Stderr, "info", logFormatAuto)
+	})
+	return &buf
+}
+
+func TestSetupLogger(t *testing.T) {
+	tests := []struct {
+		description string
+		level       string
+		format      string
+		valid       bool
+	}{
+		{description: "defaults", level: "info", format: logFormatAuto, valid: true},
+		{description: "debug json", level: "debug", format: logFormatJSON, valid: true},
+		{description: "warn logfmt", level: "warn", format: logFormatLogfmt, valid: true},
+		{description: "error pretty", level: "error", format: logFormatPretty, valid: true},
+		{description: "unknown level", level: "loud", format: logFormatAuto},
+		{description: "unknown format", level: "info", format: "xml"},
+	}
+
+	for _, tc := range tests {
+		err := setupLogger(&bytes.Buffer{}, tc.level, tc.format)
+		if tc.valid && err != nil {
+			t.Errorf("(%s) unexpected error: %v", tc.description, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("(%s) expected an error", tc.description)
+		}
+	}
+	_ = setupLogger(os.Stderr, "info", logFormatAuto)
+}
+
+func TestLogFields(t *testing.T) {
+	buf := withLogOutput(t, "info", logFormatJSON)
+
+	room := NewRoom()
+	room.Name = "fields"
+	c := &client{id: uuid.New(), SiteID: "7"}
+	c.entry = room.log().WithFields(logrus.Fields{"client": c.id, "site": c.SiteID})
+
+	c.log().Info("hello")
+	c.log().Debug("not logged at info level")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected 1 line, got %q", buf.String())
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &fields); err != nil {
+		t.Fatalf("Expected a JSON line, got %q", lines[0])
+	}
+	want := map[string]interface{}{
+		"room":    "fields",
+		"room_id": room.ID,
+		"client":  c.id.String(),
+		"site":    "7",
+		"level":   "info",
+		"msg":     "hello",
+	}
+	for k, v := range want {
+		if fields[k] != v {
+			t.Errorf("Expected %s=%v, got %v", k, v, fields[k])
+		}
+	}
+}
@@ -1,17 +1,21 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
-	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/danii7514/codpen/commons"
-	"github.com/fatih/color"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
 )
 
 // Clients is used to store, reference, and update information about all connected clients.
@@ -33,6 +37,9 @@ type Clients struct {
 
 	// nameUpdateRequests is used to update a client with their username.
 	nameUpdateRequests chan nameUpdate
+
+	// done is closed to stop the monitor goroutine once the room is torn down.
+	done chan struct{}
 }
 
 // NewClients returns a new instance of a Clients struct.
@@ -44,6 +51,7 @@ func NewClients() *Clients {
 		readRequests:       make(chan readRequest, 10000),
 		addRequests:        make(chan *client),
 		nameUpdateRequests: make(chan nameUpdate),
+		done:               make(chan struct{}),
 	}
 }
 
@@ -60,34 +68,33 @@ type client struct {
 	mu sync.Mutex
 
 	Username string
-}
 
-// Room represents a chat room with its connected clients.
-type Room struct {
-	ID      string
-	Clients *Clients
-}
+	// subject is the user named by the client's access token. It is empty when
+	// authentication is disabled.
+	subject string
 
-// NewRoom creates a new room with a unique ID.
-func NewRoom() *Room {
-	return &Room{
-		ID:      uuid.New().String(),
-		Clients: NewClients(),
-	}
-}
+	// addr is the client's remote IP address.
+	addr string
 
-var (
-	// Monotonically increasing site ID, unique to each client.
-	siteID = 0
+	// role is the client's role in its room.
+	role commons.Role
 
-	// Mutex for protecting site ID increment operations.
-	mu sync.Mutex
+	// limiter limits the rate at which the client may send messages. A nil limiter
+	// doesn't limit anything.
+	limiter *rateLimiter
+
+	// entry carries the fields logged with every line about the client. It is set
+	// when the client joins a room.
+	entry *logrus.Entry
 
+	// session lets the client resume after its connection drops.
+	session *session
+}
+
+var (
 	// Upgrader instance to upgrade all HTTP connections to a WebSocket.
 	upgrader = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
+		CheckOrigin: checkOrigin,
 	}
 
 	// Channel for client messages.
@@ -102,11 +109,37 @@ var (
 )
 
 func main() {
-	addr := flag.String("addr", ":8084", "Server's network address")
-	flag.Parse()
+	cfg, err := loadConfig(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if err := cfg.apply(); err != nil {
+		logger.Fatal("Invalid configuration, exiting. ", err)
+	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", handleConn)
+	if cfg.TLS.SelfSigned {
+		if err := setupSelfSigned(); err != nil {
+			logger.Fatal("Error generating a self-signed certificate, exiting. ", err)
+		}
+	}
+
+	upgrader.HandshakeTimeout = cfg.WebSocket.HandshakeTimeout
+	upgrader.ReadBufferSize = cfg.WebSocket.ReadBufferSize
+	upgrader.WriteBufferSize = cfg.WebSocket.WriteBufferSize
+
+	if cfg.Cluster.RedisAddr != "" {
+		rb := newRedisBroker(cfg.Cluster.RedisAddr, cfg.Cluster.RedisPassword)
+		broker, allocateSiteID = rb, rb.nextSiteID
+		logger.WithFields(logrus.Fields{"redis": cfg.Cluster.RedisAddr, "node": nodeID}).Info("Joining cluster")
+	}
+
+	auditDir = cfg.Audit.Dir
+	recordDir = cfg.Recording.Dir
+
+	mux := newMux()
 
 	// Handle incoming messages.
 	go handleMsg()
@@ -115,135 +148,401 @@ func main() {
 	go handleSync()
 
 	// Start the server.
-	log.Printf("Starting server on %s", *addr)
+	logger.WithFields(logrus.Fields{"addr": cfg.Addr, "tls": cfg.TLS.enabled()}).Info("Starting server")
 
 	server := &http.Server{
-		Addr:         *addr,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		Addr:         cfg.Addr,
+		ReadTimeout:  cfg.HTTP.ReadTimeout,
+		WriteTimeout: cfg.HTTP.WriteTimeout,
+		IdleTimeout:  cfg.HTTP.IdleTimeout,
 		Handler:      mux,
 	}
+	if cfg.TLS.enabled() {
+		if server.TLSConfig, err = newTLSConfig(cfg.TLS); err != nil {
+			logger.Fatal("Invalid TLS configuration, exiting. ", err)
+		}
+	}
+	tlsEnabled := cfg.TLS.enabled()
 
-	err := server.ListenAndServe()
-	if err != nil {
-		log.Fatal("Error starting server, exiting.", err)
+	var adminServer *http.Server
+	if cfg.Admin.Socket != "" {
+		l, err := listenAdmin(cfg.Admin.Socket)
+		if err != nil {
+			logger.Fatal("Error opening the admin socket, exiting. ", err)
+		}
+		adminServer = &http.Server{Handler: newAdminMux()}
+		go func() {
+			if err := adminServer.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.WithError(err).Error("Admin socket stopped")
+			}
+		}()
+		logger.WithField("socket", cfg.Admin.Socket).Info("Serving the admin socket")
 	}
+
+	// Reload the configuration on SIGHUP, and shut down gracefully on SIGINT and SIGTERM.
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	shutdownDone := make(chan struct{})
+	go func() {
+		for sig := range sigChan {
+			if sig == syscall.SIGHUP {
+				cfg = reloadConfig(cfg, os.Args[1:])
+				continue
+			}
+
+			logger.WithField("signal", sig).Info("Shutting down")
+			if adminServer != nil {
+				adminServer.Close()
+			}
+			if err := shutdown(server, commons.ServerRestartingReason, cfg.ShutdownTimeout); err != nil {
+				logger.WithError(err).Error("Error shutting down server")
+			}
+			close(shutdownDone)
+			return
+		}
+	}()
+
+	if tlsEnabled {
+		// The certificate comes from server.TLSConfig.
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Fatal("Error starting server, exiting. ", err)
+	}
+
+	<-shutdownDone
+	logger.Info("Server stopped")
+}
+
+// newMux returns the server's request router.
+func newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", handleConn)
+	mux.HandleFunc("/", handleRoot)
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/rooms", handleRooms)
+	mux.HandleFunc("/rooms/", handleRoom)
+	return mux
 }
 
 // handleConn handles incoming HTTP connections, assigns clients to rooms, and reads messages from the connection.
 func handleConn(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		color.Red("Error upgrading connection to websocket: %v\n", err)
-		conn.Close()
+	if !trackConn() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer untrackConn()
+
+	if !checkOrigin(r) {
+		logger.WithFields(logrus.Fields{"origin": r.Header.Get("Origin"), "remote": r.RemoteAddr}).Warn("Rejecting connection from a disallowed origin")
+		http.Error(w, "origin not allowed", http.StatusForbidden)
 		return
 	}
-	defer conn.Close()
 
-	clientID := uuid.New()
 	roomID := r.URL.Query().Get("room")
 	if roomID == "" {
-		color.Red("Room ID not provided.")
+		logger.WithField("remote", r.RemoteAddr).Warn("Rejecting connection: room not provided")
+		http.Error(w, "room not provided", http.StatusBadRequest)
 		return
 	}
 
-	room, exists := getOrCreateRoom(roomID)
+	connLog := logger.WithFields(logrus.Fields{"room": roomID, "remote": r.RemoteAddr})
 
-	if !exists {
-		go room.Clients.handle()
+	claims, status, err := authenticate(r, roomID)
+	if err != nil {
+		connLog.WithError(err).Warn("Rejecting connection")
+		if status == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="codpen"`)
+		}
+		http.Error(w, err.Error(), status)
+		return
 	}
 
-	mu.Lock()
-	siteID++
+	connLimits := currentLimits()
+	if !acquireConn(connLimits.MaxConnections) {
+		connLog.Warn("Rejecting connection: the server is full")
+		refuseConn(w, r, fullReason(commons.ServerFullReason, connLimits.MaxConnections))
+		return
+	}
+	defer releaseConn()
+
+	room, _, err := joinRoom(roomID, passwordFromRequest(r))
+	if errors.Is(err, ErrRoomFull) {
+		connLog.Warn("Rejecting connection: the room is full")
+		refuseConn(w, r, fullReason(commons.RoomFullReason, connLimits.MaxRoomClients))
+		return
+	}
+	if err != nil {
+		connLog.WithError(err).Error("Failed to join room")
+		http.Error(w, "failed to join room", http.StatusInternalServerError)
+		return
+	}
+	defer leaveRoom(room)
+
+	var subject string
+	if claims != nil {
+		subject = claims.Subject
+	}
+	// Authenticated users are named after their token, so their name is known already.
+	if ban := room.bans.match(subject, subject, remoteHost(r)); ban != nil {
+		connLog.WithField("ban", ban.ID).Warn("Rejecting connection from a banned user")
+		http.Error(w, ban.message(), http.StatusForbidden)
+		return
+	}
+
+	// Whoever creates a room checks the password they chose too, as a room closed
+	// while idle keeps the password it had.
+	if status, err := checkPassword(r, room); err != nil {
+		connLog.WithError(err).Warn("Rejecting connection")
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", strconv.Itoa(int(passwordThrottle.window.Seconds())))
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		connLog.WithError(err).Error("Error upgrading connection to websocket")
+		return
+	}
+	defer conn.Close()
+
+	// Larger messages make the connection fail with a "message too big" close frame.
+	conn.SetReadLimit(connLimits.MaxMessageSize)
+
+	clientID := uuid.New()
 	client := &client{
 		Conn:     conn,
-		SiteID:   strconv.Itoa(siteID),
 		id:       clientID,
 		writeMu:  sync.Mutex{},
 		mu:       sync.Mutex{},
 		Username: "", // Username will be set later when the client joins the room.
+		subject:  subject,
+		addr:     remoteHost(r),
+		limiter:  newRateLimiter(connLimits),
 	}
-	mu.Unlock()
 
+	var granted commons.Role
+	if claims != nil {
+		granted = claims.Role
+	}
+
+	// A client coming back after its connection dropped keeps its site ID, name and role.
+	sess := resumeSession(r.Header.Get(sessionHeader), room, client.subject)
+	resumed := sess != nil
+	if resumed {
+		client.SiteID, client.Username, client.role = sess.siteID, sess.username, sess.role
+	} else {
+		if client.SiteID, err = newSiteID(); err != nil {
+			connLog.WithError(err).Error("Failed to allocate site ID")
+			return
+		}
+		client.role = room.Policy.assign(client.subject, granted, commons.Role(r.URL.Query().Get("role")))
+
+		if sess, err = newSession(room, client); err != nil {
+			connLog.WithError(err).Error("Failed to start session")
+			return
+		}
+	}
+	client.session = sess
+	client.entry = room.log().WithFields(logrus.Fields{"client": clientID, "site": client.SiteID})
+
+	// A resumed session brings the client's name, which may have been banned since.
+	if ban := room.banned(client); ban != nil {
+		client.log().WithField("ban", ban.ID).Warn("Rejecting session of a banned user")
+		sess.forget()
+		if err := client.sendClose(websocket.ClosePolicyViolation, ban.message(), time.Now().Add(time.Second)); err != nil {
+			client.log().WithError(err).Error("Failed to send close frame")
+		}
+		return
+	}
+	defer func() {
+		client.mu.Lock()
+		name := client.Username
+		client.mu.Unlock()
+		sess.release(name)
+	}()
+
+	// Until the client knows the number of the room's last operation, no other
+	// operation may be relayed, so that it gets each of the following ones once.
+	room.relayMu.Lock()
 	room.Clients.add(client)
+	room.recordClient(commons.RecordConnect, client, nil, nil)
+	defer room.recordClient(commons.RecordDisconnect, client, nil, nil)
 
 	siteIDMsg := commons.Message{Type: commons.SiteIDMessage, Text: client.SiteID, ID: clientID}
 	room.Clients.broadcastOne(siteIDMsg, clientID)
 
-	docReq := commons.Message{Type: commons.DocReqMessage, ID: clientID}
-	log.Printf("sending docReq with %v", docReq)
-	room.Clients.broadcastOneExcept(docReq, clientID)
+	roleMsg := commons.Message{Type: commons.RoleMessage, Text: string(client.role), ID: clientID}
+	room.Clients.broadcastOne(roleMsg, clientID)
+
+	sessionMsg := commons.Message{Type: commons.SessionMessage, Text: sess.token, Seq: room.seq, ID: clientID}
+	room.Clients.broadcastOne(sessionMsg, clientID)
+
+	if resumed {
+		client.log().WithField("user", client.Username).Info("Session resumed")
+		resumeMsg := room.resumeMessage(parseLastSeq(r.Header.Get(lastSeqHeader)), client.SiteID)
+		resumeMsg.ID = clientID
+		room.Clients.broadcastOne(resumeMsg, clientID)
+	}
+	room.relayMu.Unlock()
+
+	// Once the last client has left, no users message tells the other nodes.
+	defer room.updatePresence()
+
+	if !resumed {
+		docReq := commons.Message{Type: commons.DocReqMessage, ID: clientID}
+		client.log().Debug("Requesting the document from another client")
+		if !room.Clients.broadcastOneExcept(docReq, clientID) {
+			// Nobody else is here to ask, so the server's copy of the document is the latest.
+			room.relayMu.Lock()
+			if doc := room.document(); len(doc.Characters) > 2 {
+				docSync := commons.Message{Type: commons.DocSyncMessage, Document: doc, Seq: room.seq, ID: clientID}
+				room.recordDocument(clientID, doc)
+				room.Clients.broadcastOne(docSync, clientID)
+			}
+			room.relayMu.Unlock()
+		}
+	}
 
 	room.Clients.sendUsernames()
 
 	for {
 		var msg commons.Message
 		if err := client.read(&msg); err != nil {
-			color.Red("Failed to read message. closing client connection with %s. Error: %s", client.Username, err)
+			client.log().WithError(err).Info("Closing connection")
 			return
 		}
 
-		if msg.Type == commons.DocSyncMessage {
-			syncChan <- msg
+		if perr := validateMessage(msg); perr != nil {
+			client.reject(room, msg, perr)
 			continue
 		}
 
-		msg.ID = clientID
-		messageChan <- msg
-	}
-}
+		// Documents may only be sent to clients of the same room.
+		if msg.Type == commons.DocSyncMessage && <-room.Clients.get(msg.ID) == nil {
+			client.reject(room, msg, reject(commons.ErrorInvalidMessage, "invalid docSync: no client %s in the room", msg.ID))
+			continue
+		}
 
-func getOrCreateRoom(roomID string) (*Room, bool) {
-	roomsMapMutex.Lock()
-	defer roomsMapMutex.Unlock()
+		// Viewers may not change the document, nor send one, which would replace the room's.
+		if (msg.Type == commons.OperationMessage || msg.Type == commons.DocSyncMessage) && !client.role.CanEdit() {
+			client.reject(room, msg, reject(commons.ErrorReadOnly, "read-only: viewers can't edit this room"))
+			continue
+		}
 
-	if room, ok := roomsMap[roomID]; ok {
-		return room, false
-	}
+		// Operations are recorded in the order the room applies them, by handleMsg.
+		if msg.Type != commons.OperationMessage {
+			room.recordClient(commons.RecordMessage, client, &msg, nil)
+		}
 
-	room := NewRoom()
-	go room.Clients.handle()
-	roomsMap[roomID] = room
+		if msg.Type == commons.DocSyncMessage {
+			syncChan <- msg
+			continue
+		}
 
-	return room, true
-}
+		// A client which found characters from its site in its document asks for another.
+		if msg.Type == commons.SiteIDMessage {
+			if err := client.changeSite(); err != nil {
+				client.log().WithError(err).Error("Failed to change site ID")
+			}
+			continue
+		}
 
-func getRoomByClientID(clientID uuid.UUID) *Room {
-	roomsMapMutex.Lock()
-	defer roomsMapMutex.Unlock()
+		// Authenticated users are known by the name in their token.
+		if msg.Type == commons.JoinMessage && client.subject != "" {
+			msg.Username = client.subject
+		}
 
-	for _, room := range roomsMap {
-		if _, exists := room.Clients.list[clientID]; exists {
-			return room
+		// Other users are only known by name once they have joined.
+		if msg.Type == commons.JoinMessage {
+			if ban := room.bans.match(msg.Username, client.subject, client.addr); ban != nil {
+				client.log().WithFields(logrus.Fields{"ban": ban.ID, "user": msg.Username}).Warn("Kicking banned user")
+				room.kick(clientID, ban.message())
+				return
+			}
 		}
-	}
 
-	return nil
+		msg.ID = clientID
+		messageChan <- msg
+	}
 }
 
 // handleMsg listens to the messageChan channel and broadcasts messages to other clients in the same room.
 func handleMsg() {
 	for {
-		msg := <-messageChan
+		relayMessage(<-messageChan)
+	}
+}
 
-		t := time.Now().Format(time.ANSIC)
-		if msg.Type == commons.JoinMessage {
-			room := getRoomByClientID(msg.ID)
-			room.Clients.updateName(msg.ID, msg.Username)
-			color.Green("%s >> %s %s (ID: %s) in room %s\n", t, msg.Username, msg.Text, msg.ID, room.ID)
-			room.Clients.sendUsernames()
-		} else if msg.Type == "operation" {
-			color.Green("operation >> %+v from ID=%s\n", msg.Operation, msg.ID)
-		} else {
-			color.Green("%s >> unknown message type:  %v\n", t, msg)
-			room := getRoomByClientID(msg.ID)
-			room.Clients.sendUsernames()
-			continue
+// relayMessage handles a message read by handleConn: it names a joining client,
+// or applies an operation to the room's document, and relays the message to the
+// other clients of the sender's room.
+func relayMessage(msg commons.Message) {
+	room := getRoomByClientID(msg.ID)
+	if room == nil {
+		// The sender left, and possibly took the room with it.
+		return
+	}
+	msgLog := room.log().WithField("client", msg.ID)
+
+	if msg.Type == commons.JoinMessage {
+		room.join(msg.ID, msg.Username)
+	} else if msg.Type == commons.OperationMessage {
+		msgLog.WithFields(logrus.Fields{
+			"op":       msg.Operation.Type,
+			"position": msg.Operation.Position,
+		}).Debug("Relaying operation")
+	} else {
+		// handleConn only passes on the messages above.
+		msgLog.WithField("type", msg.Type).Warn("Unexpected message type")
+		return
+	}
+
+	if msg.Type == commons.OperationMessage {
+		entry := auditEntry{Client: msg.ID.String()}
+		if sender := <-room.Clients.get(msg.ID); sender != nil {
+			entry.Site = sender.site()
+			sender.mu.Lock()
+			entry.User = sender.Username
+			sender.mu.Unlock()
 		}
 
-		room := getRoomByClientID(msg.ID)
+		room.relayMu.Lock()
+		if perr := room.checkOperation(msg.Operation); perr != nil {
+			room.rejectOperation(msg, perr)
+			room.relayMu.Unlock()
+			return
+		}
+		char, err := room.apply(msg.Operation)
+		if err != nil {
+			msgLog.WithError(err).Error("Failed to apply operation to the room's document")
+		}
+		msg.Seq = room.record(msg.Operation, entry.Site)
+		room.auditOperation(entry, msg.Operation, char)
+		room.recordOperation(msg.ID, entry.Site, entry.User, msg)
 		room.Clients.broadcastAllExcept(msg, msg.ID, room.ID)
+		room.publish(clusterEvent{Kind: eventOperation, Operation: &msg.Operation})
+		room.relayMu.Unlock()
+		operationsRelayed.inc()
+		return
 	}
+
+	room.Clients.broadcastAllExcept(msg, msg.ID, room.ID)
+}
+
+// join names a client which joined the room, and lets the others, and the
+// webhooks, know.
+func (r *Room) join(id uuid.UUID, username string) {
+	r.Clients.updateName(id, username)
+	r.log().WithFields(logrus.Fields{"client": id, "user": username}).Info("User joined")
+	r.Clients.sendUsernames()
+	r.emitEvent(eventUserJoined, map[string]string{"username": username, "client": id.String()})
 }
 
 // handleSync reads from the syncChan and sends the message to the appropriate user(s) in the same room.
@@ -253,11 +552,16 @@ func handleSync() {
 		switch syncMsg.Type {
 		case commons.DocSyncMessage:
 			room := getRoomByClientID(syncMsg.ID)
-			room.Clients.broadcastOne(syncMsg, syncMsg.ID)
+			if room != nil {
+				room.setDocument(syncMsg.Document)
+				room.Clients.broadcastOne(syncMsg, syncMsg.ID)
+			}
 		case commons.UsersMessage:
 			room := getRoomByClientID(syncMsg.ID)
 			if room != nil {
-				color.Blue("usernames in room %s: %s", room.ID, syncMsg.Text)
+				room.updatePresence()
+				syncMsg.Text += room.remoteUsernames()
+				room.log().WithField("users", syncMsg.Text).Debug("Sending usernames")
 				room.Clients.broadcastAll(syncMsg, room.ID)
 			}
 		}
@@ -288,13 +592,23 @@ func (c *Clients) handle() {
 			c.list[client.id] = client
 			c.mu.Unlock()
 		case n := <-c.nameUpdateRequests:
-			c.list[n.id].mu.Lock()
-			c.list[n.id].Username = n.newName
-			c.list[n.id].mu.Unlock()
+			if client, ok := c.list[n.id]; ok {
+				client.mu.Lock()
+				client.Username = n.newName
+				client.mu.Unlock()
+			}
+		case <-c.done:
+			return
 		}
 	}
 }
 
+// stop terminates the monitor goroutine. Requests made after stop are ignored, and
+// reads return no clients.
+func (c *Clients) stop() {
+	close(c.done)
+}
+
 // A deleteRequest is used to delete clients from the list of clients.
 type deleteRequest struct {
 	// id is the ID of the client to be deleted.
@@ -322,21 +636,42 @@ func (c *Clients) getAll() chan *client {
 	c.mu.RLock()
 	resp := make(chan *client, len(c.list))
 	c.mu.RUnlock()
-	c.readRequests <- readRequest{readAll: true, resp: resp}
+	select {
+	case c.readRequests <- readRequest{readAll: true, resp: resp}:
+	case <-c.done:
+		close(resp)
+	}
 	return resp
 }
 
 // get requests a client with the given id, and returns a channel containing the client. If
-// the client doesn't exist, the channel will be empty
+// the client doesn't exist, the channel will contain nil. get waits for the monitor to
+// answer, so the returned channel is ready to be read from.
 func (c *Clients) get(id uuid.UUID) chan *client {
-	resp := make(chan *client)
-	c.readRequests <- readRequest{readAll: false, id: id, resp: resp}
-	return resp
+	resp := make(chan *client, 1)
+	ready := make(chan *client, 1)
+	select {
+	case c.readRequests <- readRequest{readAll: false, id: id, resp: resp}:
+	case <-c.done:
+		close(ready)
+		return ready
+	}
+
+	select {
+	case client := <-resp:
+		ready <- client
+	case <-c.done:
+	}
+	close(ready)
+	return ready
 }
 
 // add adds a client to the list of clients.
 func (c *Clients) add(client *client) {
-	c.addRequests <- client
+	select {
+	case c.addRequests <- client:
+	case <-c.done:
+	}
 }
 
 // A nameUpdate is used as a message to update the name of a client.
@@ -347,23 +682,35 @@ type nameUpdate struct {
 
 // updateName updates the name field of a client with the given id.
 func (c *Clients) updateName(id uuid.UUID, newName string) {
-	c.nameUpdateRequests <- nameUpdate{id, newName}
+	select {
+	case c.nameUpdateRequests <- nameUpdate{id, newName}:
+	case <-c.done:
+	}
 }
 
 // delete deletes a client from the list of active clients.
 func (c *Clients) delete(id uuid.UUID) {
-	req := deleteRequest{id, make(chan int)}
-	c.deleteRequests <- req
-	<-req.done
+	req := deleteRequest{id, make(chan int, 1)}
+	select {
+	case c.deleteRequests <- req:
+	case <-c.done:
+		return
+	}
+	select {
+	case <-req.done:
+	case <-c.done:
+		return
+	}
 	c.sendUsernames()
 }
 
 // broadcastAll sends a message to all active clients in the same room.
 func (c *Clients) broadcastAll(msg commons.Message, roomID string) {
-	color.Blue("sending message to all users in room %s. Text: %s", roomID, msg.Text)
+	defer observeBroadcast("all", time.Now())
 	for client := range c.getAll() {
 		if err := client.send(msg); err != nil {
-			color.Red("ERROR: %s", err)
+			client.log().WithError(err).Error("Failed to send message")
+			sendFailures.inc()
 			c.delete(client.id)
 		}
 	}
@@ -372,6 +719,7 @@ func (c *Clients) broadcastAll(msg commons.Message, roomID string) {
 // broadcastAllExcept sends a message to all clients except for the one whose ID
 // matches except in the same room.
 func (c *Clients) broadcastAllExcept(msg commons.Message, except uuid.UUID, roomID string) {
+	defer observeBroadcast("allExcept", time.Now())
 	for client := range c.getAll() {
 		if client == nil {
 			continue
@@ -380,7 +728,8 @@ func (c *Clients) broadcastAllExcept(msg commons.Message, except uuid.UUID, room
 			continue
 		}
 		if err := client.send(msg); err != nil {
-			color.Red("ERROR: %s", err)
+			client.log().WithError(err).Error("Failed to send message")
+			sendFailures.inc()
 			c.delete(client.id)
 		}
 	}
@@ -388,34 +737,38 @@ func (c *Clients) broadcastAllExcept(msg commons.Message, except uuid.UUID, room
 
 // broadcastOne sends a message to a single client with the ID matching dst.
 func (c *Clients) broadcastOne(msg commons.Message, dst uuid.UUID) {
+	defer observeBroadcast("one", time.Now())
 	client := <-c.get(dst)
 	if client != nil {
 		if err := client.send(msg); err != nil {
-			color.Red("ERROR: %s", err)
+			client.log().WithError(err).Error("Failed to send message")
+			sendFailures.inc()
 			c.delete(client.id)
 		}
 	}
 }
 
-// broadcastOneExcept sends a message to any one client whose ID does not match except.
-func (c *Clients) broadcastOneExcept(msg commons.Message, except uuid.UUID) {
-	log.Printf("except in broadcastOneExcept: %v", except)
+// broadcastOneExcept sends a message to any one client whose ID does not match except,
+// among those which may edit the document, since only they may answer a docReq.
+// It reports whether the message was sent.
+func (c *Clients) broadcastOneExcept(msg commons.Message, except uuid.UUID) bool {
+	defer observeBroadcast("oneExcept", time.Now())
 	for client := range c.getAll() {
 		if client == nil {
 			continue
 		}
-		if client.id == except {
+		if client.id == except || !client.role.CanEdit() {
 			continue
 		}
-		log.Printf("client in broadcastOneExcept: %v", client.id)
-
 		if err := client.send(msg); err != nil {
-			color.Red("ERROR: %s", err)
+			client.log().WithError(err).Error("Failed to send message")
+			sendFailures.inc()
 			c.delete(client.id)
 			continue
 		}
-		break
+		return true
 	}
+	return false
 }
 
 // close closes a WebSocket connection and removes it from the list of clients in a
@@ -425,13 +778,17 @@ func (c *Clients) close(id uuid.UUID) {
 	client, ok := c.list[id]
 	if ok {
 		if err := client.Conn.Close(); err != nil {
-			color.Red("Error closing connection: %s\n", err)
+			client.log().WithError(err).Error("Error closing connection")
 		}
 	} else {
-		color.Red("Couldn't close connection: client not in list")
+		c.mu.RUnlock()
+		logger.WithField("client", id).Debug("Couldn't close connection: client not in list")
 		return
 	}
-	color.Red("Removing %v from client list.\n", c.list[id].Username)
+	client.mu.Lock()
+	name := client.Username
+	client.mu.Unlock()
+	client.log().WithField("user", name).Info("Removing client")
 	c.mu.RUnlock()
 
 	c.mu.Lock()
@@ -441,8 +798,18 @@ func (c *Clients) close(id uuid.UUID) {
 }
 
 // read reads a message over the client Conn, and stores the result in msg.
+// Clients exceeding their rate limits are disconnected with a policy violation.
 func (c *client) read(msg *commons.Message) error {
-	err := c.Conn.ReadJSON(msg)
+	_, data, err := c.Conn.ReadMessage()
+	if err == nil && !c.limiter.allow(len(data)) {
+		err = ErrRateLimited
+		if closeErr := c.sendClose(websocket.ClosePolicyViolation, err.Error(), time.Now().Add(time.Second)); closeErr != nil {
+			c.log().WithError(closeErr).Error("Failed to send close frame")
+		}
+	}
+	if err == nil {
+		err = json.Unmarshal(data, msg)
+	}
 
 	c.mu.Lock()
 	name := c.Username
@@ -450,11 +817,12 @@ func (c *client) read(msg *commons.Message) error {
 
 	if err != nil {
 		if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-			color.Red("Failed to read message from client %s: %v", name, err)
+			c.log().WithError(err).Warn("Failed to read message")
+		}
+		c.log().WithField("user", name).Info("Client disconnected")
+		if room := getRoomByClientID(c.id); room != nil {
+			room.Clients.delete(c.id)
 		}
-		color.Red("client %v disconnected", name)
-		room := getRoomByClientID(c.id)
-		room.Clients.delete(c.id)
 		return err
 	}
 	return nil
@@ -473,9 +841,17 @@ func (c *client) send(v interface{}) error {
 // to the syncChan, to be broadcast to all clients and displayed in their editor.
 func (c *Clients) sendUsernames() {
 	var users string
+	var id uuid.UUID
 	for client := range c.getAll() {
+		client.mu.Lock()
 		users += client.Username + ","
+		client.mu.Unlock()
+		id = client.id
+	}
+	if id == uuid.Nil {
+		return
 	}
 
-	syncChan <- commons.Message{Text: users, Type: commons.UsersMessage}
+	// handleSync finds the room by the ID of one of its clients.
+	syncChan <- commons.Message{Text: users, Type: commons.UsersMessage, ID: id}
 }
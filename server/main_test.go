@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"net/http"
 	"net/http/httptest"
-	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -29,7 +28,11 @@ func TestHandleConn(t *testing.T) {
 
 	// Create a WebSocket connection to the test server with the generated roomID
 	url := "ws" + server.URL[4:] + "?room=" + roomID
-	room, _ := getOrCreateRoom(roomID)
+	room, _, err := joinRoom(roomID, "")
+	if err != nil {
+		t.Fatalf("Failed to join room: %v", err)
+	}
+	defer leaveRoom(room)
 	clientID := uuid.New()
 	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
 	if err != nil {
@@ -37,17 +40,18 @@ func TestHandleConn(t *testing.T) {
 	}
 	defer conn.Close()
 
-	mu.Lock()
-	siteID++
+	site, err := newSiteID()
+	if err != nil {
+		t.Fatalf("Failed to allocate site ID: %v", err)
+	}
 	client := &client{
 		Conn:     conn,
-		SiteID:   strconv.Itoa(siteID),
+		SiteID:   site,
 		id:       clientID,
 		writeMu:  sync.Mutex{},
 		mu:       sync.Mutex{},
 		Username: "", // Username will be set later when the client joins the room.
 	}
-	mu.Unlock()
 
 	room.Clients.add(client)
 
@@ -101,24 +105,29 @@ func TestHandleMsg(t *testing.T) {
 	roomID := uuid.New().String()
 
 	url := "ws" + server.URL[4:] + "?room=" + roomID
-	room, _ := getOrCreateRoom(roomID)
+	room, _, err := joinRoom(roomID, "")
+	if err != nil {
+		t.Fatalf("Failed to join room: %v", err)
+	}
+	defer leaveRoom(room)
 	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
 	if err != nil {
 		t.Fatalf("Failed to establish WebSocket connection: %v", err)
 	}
 	defer conn.Close()
 
-	mu.Lock()
-	siteID++
+	site, err := newSiteID()
+	if err != nil {
+		t.Fatalf("Failed to allocate site ID: %v", err)
+	}
 	client := &client{
 		Conn:     conn,
-		SiteID:   strconv.Itoa(siteID),
+		SiteID:   site,
 		id:       clientID,
 		writeMu:  sync.Mutex{},
 		mu:       sync.Mutex{},
 		Username: "TestUser",
 	}
-	mu.Unlock()
 
 	room.Clients.add(client)
 
@@ -183,7 +192,11 @@ func TestHandleSync(t *testing.T) {
 	defer func() { syncChan = originalSyncChan }()
 
 	// Create a test room
-	room, _ := getOrCreateRoom(roomID)
+	room, _, err := joinRoom(roomID, "")
+	if err != nil {
+		t.Fatalf("Failed to join room: %v", err)
+	}
+	defer leaveRoom(room)
 
 	// Simulate a DocSyncMessage being sent to syncChan
 	clientID := uuid.New()
@@ -194,17 +207,18 @@ func TestHandleSync(t *testing.T) {
 		Username: "TestUser",
 	}
 
-	mu.Lock()
-	siteID++
+	site, err := newSiteID()
+	if err != nil {
+		t.Fatalf("Failed to allocate site ID: %v", err)
+	}
 	client := &client{
 		Conn:     conn,
-		SiteID:   strconv.Itoa(siteID),
+		SiteID:   site,
 		id:       clientID,
 		writeMu:  sync.Mutex{},
 		mu:       sync.Mutex{},
 		Username: "TestUser",
 	}
-	mu.Unlock()
 	testSyncChan <- docSyncMessage
 
 	room.Clients.add(client)
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The server exposes its metrics in the Prometheus text exposition format
+// (https://prometheus.io/docs/instrumenting/exposition_formats/) on /metrics.
+
+var (
+	// publicMetrics serves the metrics to every client. It is protected by
+	// settingsMu, see currentPublicMetrics.
+	publicMetrics bool
+
+	// operationsRelayed counts the operations relayed to other clients.
+	operationsRelayed counter
+
+	// sendFailures counts the messages that couldn't be sent to a client.
+	sendFailures counter
+
+	// broadcastLatency tracks how long broadcasts take, by broadcast helper.
+	broadcastLatency = newHistogramVec([]float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5})
+)
+
+// A counter is a monotonically increasing value.
+type counter struct {
+	v uint64
+}
+
+// inc increments the counter by one.
+func (c *counter) inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+// value returns the current value of the counter.
+func (c *counter) value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+// A histogram counts observations in cumulative buckets.
+type histogram struct {
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	// bounds are the upper bounds of the buckets, in increasing order.
+	bounds []float64
+
+	// counts holds the number of observations in each bucket, not cumulated.
+	counts []uint64
+
+	sum   float64
+	count uint64
+}
+
+// newHistogram returns a histogram with the given bucket upper bounds.
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+// observe adds an observation to the histogram.
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	i := sort.SearchFloat64s(h.bounds, v)
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+// write writes the histogram's samples with the given name and label.
+func (h *histogram) write(w io.Writer, name, label string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", name, labelPrefix(label), formatFloat(bound), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labelPrefix(label), h.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, braces(label), formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, braces(label), h.count)
+}
+
+// A histogramVec is a set of histograms partitioned by the value of a label.
+type histogramVec struct {
+	// mu protects histograms.
+	mu sync.Mutex
+
+	bounds     []float64
+	histograms map[string]*histogram
+}
+
+// newHistogramVec returns a histogramVec whose histograms have the given bucket upper bounds.
+func newHistogramVec(bounds []float64) *histogramVec {
+	return &histogramVec{bounds: bounds, histograms: make(map[string]*histogram)}
+}
+
+// with returns the histogram for a label value, creating it if necessary.
+func (v *histogramVec) with(value string) *histogram {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	h, ok := v.histograms[value]
+	if !ok {
+		h = newHistogram(v.bounds)
+		v.histograms[value] = h
+	}
+	return h
+}
+
+// observeBroadcast records the duration of a broadcast started at start. It is
+// meant to be deferred at the top of a broadcast helper.
+func observeBroadcast(kind string, start time.Time) {
+	broadcastLatency.with(kind).observe(time.Since(start).Seconds())
+}
+
+// handleMetrics serves the server's metrics. They name every room, so only the
+// clients which may use the API may read them, unless they are made public with
+// -public-metrics.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !currentPublicMetrics() && !authorizeAdmin(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w)
+}
+
+// writeMetrics writes all metrics in the Prometheus text format.
+func writeMetrics(w io.Writer) {
+	type roomStats struct {
+		name    string
+		clients int
+		docSize int64
+	}
+
+	roomsMapMutex.Lock()
+	rooms := make([]roomStats, 0, len(roomsMap))
+	for name, room := range roomsMap {
+		room.Clients.mu.RLock()
+		clients := len(room.Clients.list)
+		room.Clients.mu.RUnlock()
+		rooms = append(rooms, roomStats{name: name, clients: clients, docSize: int64(room.documentLength())})
+	}
+	roomsMapMutex.Unlock()
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].name < rooms[j].name })
+
+	fmt.Fprintln(w, "# HELP codpen_rooms_active Number of open rooms.")
+	fmt.Fprintln(w, "# TYPE codpen_rooms_active gauge")
+	fmt.Fprintf(w, "codpen_rooms_active %d\n", len(rooms))
+
+	fmt.Fprintln(w, "# HELP codpen_room_clients Number of clients connected to a room.")
+	fmt.Fprintln(w, "# TYPE codpen_room_clients gauge")
+	for _, room := range rooms {
+		fmt.Fprintf(w, "codpen_room_clients{room=\"%s\"} %d\n", escapeLabel(room.name), room.clients)
+	}
+
+	fmt.Fprintln(w, "# HELP codpen_room_document_characters Number of characters, including deleted ones, in a room's document.")
+	fmt.Fprintln(w, "# TYPE codpen_room_document_characters gauge")
+	for _, room := range rooms {
+		fmt.Fprintf(w, "codpen_room_document_characters{room=\"%s\"} %d\n", escapeLabel(room.name), room.docSize)
+	}
+
+	fmt.Fprintln(w, "# HELP codpen_operations_relayed_total Number of operations relayed to other clients.")
+	fmt.Fprintln(w, "# TYPE codpen_operations_relayed_total counter")
+	fmt.Fprintf(w, "codpen_operations_relayed_total %d\n", operationsRelayed.value())
+
+	fmt.Fprintln(w, "# HELP codpen_messages_rejected_total Number of client messages rejected for breaking the protocol.")
+	fmt.Fprintln(w, "# TYPE codpen_messages_rejected_total counter")
+	fmt.Fprintf(w, "codpen_messages_rejected_total %d\n", messagesRejected.value())
+
+	fmt.Fprintln(w, "# HELP codpen_send_failures_total Number of messages that couldn't be sent to a client.")
+	fmt.Fprintln(w, "# TYPE codpen_send_failures_total counter")
+	fmt.Fprintf(w, "codpen_send_failures_total %d\n", sendFailures.value())
+
+	fmt.Fprintln(w, "# HELP codpen_connections_open Number of WebSocket connections being served.")
+	fmt.Fprintln(w, "# TYPE codpen_connections_open gauge")
+	fmt.Fprintf(w, "codpen_connections_open %d\n", atomic.LoadInt64(&openConns))
+
+	fmt.Fprintln(w, "# HELP codpen_connections_refused_total Number of connections refused because their room or the server was full.")
+	fmt.Fprintln(w, "# TYPE codpen_connections_refused_total counter")
+	fmt.Fprintf(w, "codpen_connections_refused_total %d\n", connectionsRefused.value())
+
+	fmt.Fprintln(w, "# HELP codpen_webhook_failures_total Number of webhook deliveries that failed for good.")
+	fmt.Fprintln(w, "# TYPE codpen_webhook_failures_total counter")
+	fmt.Fprintf(w, "codpen_webhook_failures_total %d\n", webhookFailures.value())
+
+	fmt.Fprintln(w, "# HELP codpen_broadcast_duration_seconds Time taken to broadcast a message, by broadcast helper.")
+	fmt.Fprintln(w, "# TYPE codpen_broadcast_duration_seconds histogram")
+	broadcastLatency.mu.Lock()
+	kinds := make([]string, 0, len(broadcastLatency.histograms))
+	for kind := range broadcastLatency.histograms {
+		kinds = append(kinds, kind)
+	}
+	broadcastLatency.mu.Unlock()
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		broadcastLatency.with(kind).write(w, "codpen_broadcast_duration_seconds", "kind=\""+escapeLabel(kind)+"\"")
+	}
+}
+
+// escapeLabel escapes a label value for the text format.
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// formatFloat formats a sample value for the text format.
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprint(f)
+}
+
+// labelPrefix returns label followed by a comma, ready to be followed by another label.
+func labelPrefix(label string) string {
+	if label == "" {
+		return ""
+	}
+	return label + ","
+}
+
+// braces returns label wrapped in braces, or nothing if there is no label.
+func braces(label string) string {
+	if label == "" {
+		return ""
+	}
+	return "{" + label + "}"
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{1, 5})
+	for _, v := range []float64{0.5, 1, 3, 10} {
+		h.observe(v)
+	}
+
+	var b strings.Builder
+	h.write(&b, "test", `kind="x"`)
+
+	want := `test_bucket{kind="x",le="1"} 2
+test_bucket{kind="x",le="5"} 3
+test_bucket{kind="x",le="+Inf"} 4
+test_sum{kind="x"} 14.5
+test_count{kind="x"} 4
+`
+	if got := b.String(); got != want {
+		t.Errorf("got != want; got =\n%v\nexpected =\n%v", got, want)
+	}
+}
+
+func TestHandleMetrics(t *testing.T) {
+	withOpenAPI(t)
+	name := uuid.New().String() + `"quoted"`
+	room, _, _ := joinRoom(name, "")
+	defer leaveRoom(room)
+
+	observeBroadcast("all", time.Now())
+	operationsRelayed.inc()
+
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %q", ct)
+	}
+
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE codpen_rooms_active gauge",
+		`codpen_room_clients{room="` + strings.TrimSuffix(name, `"quoted"`) + `\"quoted\""} 0`,
+		"# TYPE codpen_operations_relayed_total counter",
+		"# TYPE codpen_broadcast_duration_seconds histogram",
+		`codpen_broadcast_duration_seconds_bucket{kind="all",le="+Inf"}`,
+		"codpen_send_failures_total",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", want, body)
+		}
+	}
+}
+
+func TestHandleMetricsAuth(t *testing.T) {
+	authSecret = []byte("secret")
+	defer func() { authSecret, publicMetrics = nil, false }()
+
+	admin, _ := signToken(Claims{Subject: "root", Admin: true}, authSecret)
+	user, _ := signToken(Claims{Subject: "alice", Rooms: []string{"*"}}, authSecret)
+
+	tests := []struct {
+		description string
+		secret      []byte
+		public      bool
+		token       string
+		status      int
+	}{
+		{description: "no token", secret: authSecret, status: http.StatusUnauthorized},
+		{description: "user", secret: authSecret, token: user, status: http.StatusForbidden},
+		{description: "admin", secret: authSecret, token: admin, status: http.StatusOK},
+		{description: "public", secret: authSecret, public: true, status: http.StatusOK},
+		{description: "no secret", status: http.StatusForbidden},
+		{description: "public without a secret", public: true, status: http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		authSecret, publicMetrics = tc.secret, tc.public
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		rec := httptest.NewRecorder()
+		handleMetrics(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("(%s) expected status %d, got %d", tc.description, tc.status, rec.Code)
+		}
+	}
+}
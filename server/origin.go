@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Browsers send the page's origin when opening a WebSocket, and let any page
+// open one to any server, so the server only accepts upgrades from its own
+// origin and the allowed ones. Without this, any website a user visits could
+// connect to their local server and read or edit its rooms.
+
+// OriginsConfig holds the origins allowed to open WebSockets, besides the server's own.
+type OriginsConfig struct {
+	// Allowed lists the allowed origins, as scheme://host[:port]. A host may start
+	// with "*." to allow all of its subdomains, the scheme may be left out to allow
+	// any, and "*" allows every origin.
+	Allowed []string `yaml:"allowed"`
+
+	// AllowMissing allows requests without an Origin header, which are sent by
+	// clients that aren't browsers, like the terminal client.
+	AllowMissing bool `yaml:"allow_missing"`
+}
+
+// An originPattern matches the origins allowed by an entry of OriginsConfig.Allowed.
+type originPattern struct {
+	// scheme is the origin's scheme, or empty to match any.
+	scheme string
+
+	// host is the origin's host and port. If wildcard is set, it is the suffix
+	// subdomains of it must end with, starting with a dot.
+	host     string
+	wildcard bool
+
+	// any matches every origin.
+	any bool
+}
+
+var (
+	// allowedOrigins and allowMissingOrigin hold the origins allowed to open
+	// WebSockets. They are protected by settingsMu.
+	allowedOrigins     []originPattern
+	allowMissingOrigin = true
+)
+
+// parseOriginPattern parses an entry of OriginsConfig.Allowed.
+func parseOriginPattern(s string) (originPattern, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "*" {
+		return originPattern{any: true}, nil
+	}
+
+	var p originPattern
+	host := s
+	if i := strings.Index(s, "://"); i >= 0 {
+		p.scheme, host = s[:i], s[i+3:]
+		if p.scheme == "" {
+			return originPattern{}, fmt.Errorf("invalid origin %q: empty scheme", s)
+		}
+	}
+	if strings.HasPrefix(host, "*.") {
+		p.wildcard = true
+		host = host[1:]
+	}
+	if host == "" || host == "." || strings.ContainsAny(host, "/*?#@ ") {
+		return originPattern{}, fmt.Errorf("invalid origin %q", s)
+	}
+
+	p.host = host
+	return p, nil
+}
+
+// matches reports whether an origin, given as its scheme and host, matches the pattern.
+func (p originPattern) matches(scheme, host string) bool {
+	if p.any {
+		return true
+	}
+	if p.scheme != "" && p.scheme != scheme {
+		return false
+	}
+	if p.wildcard {
+		return strings.HasSuffix(host, p.host) && len(host) > len(p.host)
+	}
+	return host == p.host
+}
+
+// compileOrigins parses the allowed origins of a configuration.
+func compileOrigins(c OriginsConfig) ([]originPattern, error) {
+	patterns := make([]originPattern, 0, len(c.Allowed))
+	for _, s := range c.Allowed {
+		p, err := parseOriginPattern(s)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// checkOrigin reports whether a WebSocket upgrade request comes from an allowed
+// origin. The server's own origin is always allowed.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+
+	settingsMu.RLock()
+	patterns, allowMissing := allowedOrigins, allowMissingOrigin
+	settingsMu.RUnlock()
+
+	if origin == "" {
+		return allowMissing
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	scheme, host := strings.ToLower(u.Scheme), strings.ToLower(u.Host)
+
+	if host == strings.ToLower(r.Host) {
+		return true
+	}
+	for _, p := range patterns {
+		if p.matches(scheme, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// stringList is a flag.Value holding a comma-separated list of strings.
+type stringList []string
+
+// String returns the list, comma-separated.
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+// Set replaces the list with the comma-separated values of s.
+func (l *stringList) Set(s string) error {
+	*l = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
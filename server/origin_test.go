@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// withOrigins sets the allowed origins for the duration of a test.
+func withOrigins(t *testing.T, c OriginsConfig) {
+	t.Helper()
+
+	patterns, err := compileOrigins(c)
+	if err != nil {
+		t.Fatalf("Failed to compile origins: %v", err)
+	}
+	oldPatterns, oldAllowMissing := allowedOrigins, allowMissingOrigin
+	allowedOrigins, allowMissingOrigin = patterns, c.AllowMissing
+	t.Cleanup(func() {
+		allowedOrigins, allowMissingOrigin = oldPatterns, oldAllowMissing
+	})
+}
+
+func TestCheckOrigin(t *testing.T) {
+	tests := []struct {
+		description string
+		config      OriginsConfig
+		origin      string
+		allowed     bool
+	}{
+		{description: "same origin", origin: "http://codpen.test:8084", allowed: true},
+		{description: "same origin, any case", origin: "http://CODPEN.test:8084", allowed: true},
+		{description: "other origin", origin: "https://evil.example", allowed: false},
+		{description: "other port", origin: "http://codpen.test:9999", allowed: false},
+		{description: "malformed origin", origin: "::", allowed: false},
+		{description: "opaque origin", origin: "null", allowed: false},
+
+		{description: "missing origin allowed", config: OriginsConfig{AllowMissing: true}, allowed: true},
+		{description: "missing origin rejected", config: OriginsConfig{AllowMissing: false}, allowed: false},
+
+		{description: "listed origin", config: OriginsConfig{Allowed: []string{"http://localhost:5173"}}, origin: "http://localhost:5173", allowed: true},
+		{description: "listed origin, other scheme", config: OriginsConfig{Allowed: []string{"http://localhost:5173"}}, origin: "https://localhost:5173", allowed: false},
+		{description: "listed origin, other port", config: OriginsConfig{Allowed: []string{"http://localhost:5173"}}, origin: "http://localhost:5174", allowed: false},
+		{description: "any scheme", config: OriginsConfig{Allowed: []string{"docs.example.com"}}, origin: "https://docs.example.com", allowed: true},
+
+		{description: "wildcard subdomain", config: OriginsConfig{Allowed: []string{"https://*.example.com"}}, origin: "https://app.example.com", allowed: true},
+		{description: "wildcard nested subdomain", config: OriginsConfig{Allowed: []string{"https://*.example.com"}}, origin: "https://a.b.example.com", allowed: true},
+		{description: "wildcard excludes the domain itself", config: OriginsConfig{Allowed: []string{"https://*.example.com"}}, origin: "https://example.com", allowed: false},
+		{description: "wildcard excludes lookalikes", config: OriginsConfig{Allowed: []string{"https://*.example.com"}}, origin: "https://evilexample.com", allowed: false},
+		{description: "wildcard excludes suffixed domains", config: OriginsConfig{Allowed: []string{"https://*.example.com"}}, origin: "https://app.example.com.evil.test", allowed: false},
+
+		{description: "everything", config: OriginsConfig{Allowed: []string{"*"}}, origin: "https://evil.example", allowed: true},
+	}
+
+	for _, tc := range tests {
+		withOrigins(t, tc.config)
+
+		r := httptest.NewRequest(http.MethodGet, "http://codpen.test:8084/ws", nil)
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		if got := checkOrigin(r); got != tc.allowed {
+			t.Errorf("(%s) expected %v, got %v", tc.description, tc.allowed, got)
+		}
+	}
+}
+
+func TestParseOriginPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		valid   bool
+	}{
+		{pattern: "https://example.com", valid: true},
+		{pattern: "https://*.example.com", valid: true},
+		{pattern: "*.example.com", valid: true},
+		{pattern: "http://localhost:5173", valid: true},
+		{pattern: "*", valid: true},
+		{pattern: "", valid: false},
+		{pattern: "://example.com", valid: false},
+		{pattern: "https://example.com/path", valid: false},
+		{pattern: "https://*", valid: false},
+		{pattern: "https://app.*.example.com", valid: false},
+	}
+
+	for _, tc := range tests {
+		_, err := parseOriginPattern(tc.pattern)
+		if tc.valid && err != nil {
+			t.Errorf("(%q) unexpected error: %v", tc.pattern, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("(%q) expected an error", tc.pattern)
+		}
+	}
+}
+
+// TestRejectOrigin checks that connections from disallowed origins are refused
+// before a room is created for them.
+func TestRejectOrigin(t *testing.T) {
+	withOrigins(t, OriginsConfig{Allowed: []string{"https://*.example.com"}})
+
+	server := httptest.NewServer(newMux())
+	defer server.Close()
+
+	name := uuid.New().String()
+	header := http.Header{"Origin": []string{"https://evil.example"}}
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws?room="+name, header)
+	if err == nil {
+		t.Fatalf("Expected the connection to be refused")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status %d, got %v", http.StatusForbidden, resp)
+	}
+	if findRoom(name) != nil {
+		t.Errorf("Expected no room to be created")
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// passwordIterations is the PBKDF2 iteration count used to hash room passwords.
+	passwordIterations = 50000
+
+	// passwordSaltSize is the size of the random salt of a room password, in bytes.
+	passwordSaltSize = 16
+
+	// passwordHeader is the request header carrying a room's password.
+	passwordHeader = "X-Codpen-Room-Password"
+)
+
+var (
+	ErrPasswordRequired = errors.New("room password required")
+	ErrWrongPassword    = errors.New("wrong room password")
+	ErrTooManyAttempts  = errors.New("too many failed password attempts, try again later")
+
+	// passwordThrottle limits failed password attempts per remote address.
+	passwordThrottle = newThrottle(5, time.Minute)
+
+	// roomPasswords keeps the passwords of protected rooms by name, so that a room
+	// closed while idle is protected again when it is opened. Deleting a room
+	// forgets its password. It is protected by roomsMapMutex.
+	roomPasswords = make(map[string]*roomPassword)
+)
+
+// roomPassword is the salted hash of a room's password.
+type roomPassword struct {
+	salt []byte
+	hash []byte
+}
+
+// newRoomPassword hashes a password with a fresh random salt.
+func newRoomPassword(password string) (*roomPassword, error) {
+	salt := make([]byte, passwordSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return &roomPassword{salt: salt, hash: pbkdf2([]byte(password), salt, passwordIterations)}, nil
+}
+
+// matches reports whether password is the password the hash was created from.
+func (p *roomPassword) matches(password string) bool {
+	return hmac.Equal(p.hash, pbkdf2([]byte(password), p.salt, passwordIterations))
+}
+
+// pbkdf2 derives a 32-byte key from password and salt with PBKDF2-HMAC-SHA256 (RFC 8018).
+func pbkdf2(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+
+	// A single block is enough for a key the size of the hash.
+	mac.Write(salt)
+	_ = binary.Write(mac, binary.BigEndian, uint32(1))
+	u := mac.Sum(nil)
+
+	key := make([]byte, len(u))
+	copy(key, u)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+
+	return key
+}
+
+// passwordFromRequest returns the room password of a request, taken from the
+// password header. It is never read from the URL, which ends up in logs.
+func passwordFromRequest(r *http.Request) string {
+	return r.Header.Get(passwordHeader)
+}
+
+// checkPassword checks the password a request presents for a room, throttling
+// remote addresses that fail too often. It returns the HTTP status to respond
+// with on failure.
+func checkPassword(r *http.Request, room *Room) (int, error) {
+	if room.password == nil {
+		return http.StatusOK, nil
+	}
+
+	addr := remoteHost(r)
+	if passwordThrottle.blocked(addr) > 0 {
+		return http.StatusTooManyRequests, ErrTooManyAttempts
+	}
+
+	password := passwordFromRequest(r)
+	if password == "" {
+		return http.StatusUnauthorized, ErrPasswordRequired
+	}
+
+	if !room.password.matches(password) {
+		passwordThrottle.fail(addr)
+		return http.StatusUnauthorized, ErrWrongPassword
+	}
+
+	passwordThrottle.reset(addr)
+	return http.StatusOK, nil
+}
+
+// remoteHost returns the host part of a request's remote address.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// A throttle blocks keys, such as remote addresses, for a while after too many failures.
+type throttle struct {
+	// mu protects attempts.
+	mu sync.Mutex
+
+	// attempts maps keys to their recent failures.
+	attempts map[string]*attempts
+
+	// limit is the number of failures after which a key is blocked.
+	limit int
+
+	// window is how long failures are remembered, and how long keys stay blocked.
+	window time.Duration
+}
+
+// attempts records the failures of a key.
+type attempts struct {
+	failures int
+	last     time.Time
+}
+
+// newThrottle returns a throttle blocking keys for window after limit failures.
+func newThrottle(limit int, window time.Duration) *throttle {
+	return &throttle{
+		attempts: make(map[string]*attempts),
+		limit:    limit,
+		window:   window,
+	}
+}
+
+// blocked returns how long key remains blocked, or zero if it isn't.
+func (t *throttle) blocked(key string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	a, ok := t.attempts[key]
+	if !ok || a.failures < t.limit {
+		return 0
+	}
+
+	remaining := t.window - time.Since(a.last)
+	if remaining <= 0 {
+		delete(t.attempts, key)
+		return 0
+	}
+	return remaining
+}
+
+// fail records a failure for key.
+func (t *throttle) fail(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+
+	// Forget stale entries now and then, so the map doesn't grow without bound.
+	if len(t.attempts) > 1000 {
+		for k, a := range t.attempts {
+			if now.Sub(a.last) > t.window {
+				delete(t.attempts, k)
+			}
+		}
+	}
+
+	a, ok := t.attempts[key]
+	if !ok || now.Sub(a.last) > t.window {
+		a = &attempts{}
+		t.attempts[key] = a
+	}
+	a.failures++
+	a.last = now
+}
+
+// reset forgets the failures of key.
+func (t *throttle) reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.attempts, key)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// TestPBKDF2 checks pbkdf2 against the PBKDF2-HMAC-SHA256 test vector of RFC 7914.
+func TestPBKDF2(t *testing.T) {
+	got := hex.EncodeToString(pbkdf2([]byte("passwd"), []byte("salt"), 1))
+	want := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"
+	if got != want {
+		t.Errorf("got != want; got = %v, expected = %v\n", got, want)
+	}
+}
+
+// TestHandleConnPassword checks that joining a protected room requires its password,
+// and that repeated failures are throttled.
+func TestHandleConnPassword(t *testing.T) {
+	original := passwordThrottle
+	passwordThrottle = newThrottle(3, time.Minute)
+	defer func() { passwordThrottle = original }()
+
+	server := httptest.NewServer(http.HandlerFunc(handleConn))
+	defer server.Close()
+
+	url := "ws" + server.URL[4:] + "?room=" + uuid.New().String()
+
+	dial := func(password, query string) int {
+		header := http.Header{}
+		if password != "" {
+			header.Set(passwordHeader, password)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(url+query, header)
+		if conn != nil {
+			conn.Close()
+		}
+		if resp == nil {
+			t.Fatalf("Expected a response, got error %v", err)
+		}
+		return resp.StatusCode
+	}
+
+	tests := []struct {
+		description string
+		password    string
+		query       string
+		status      int
+	}{
+		{description: "creating the room sets its password", password: "hunter2", status: http.StatusSwitchingProtocols},
+		{description: "right password", password: "hunter2", status: http.StatusSwitchingProtocols},
+		{description: "no password", status: http.StatusUnauthorized},
+		{description: "password in the URL", query: "&password=hunter2", status: http.StatusUnauthorized},
+		{description: "wrong password", password: "hunter3", status: http.StatusUnauthorized},
+		{description: "success resets failures", password: "hunter2", status: http.StatusSwitchingProtocols},
+		{description: "first failure", password: "a", status: http.StatusUnauthorized},
+		{description: "second failure", password: "b", status: http.StatusUnauthorized},
+		{description: "third failure", password: "c", status: http.StatusUnauthorized},
+		{description: "throttled", password: "hunter2", status: http.StatusTooManyRequests},
+	}
+
+	for _, tc := range tests {
+		if got := dial(tc.password, tc.query); got != tc.status {
+			t.Errorf("(%s) expected status %d, got %d", tc.description, tc.status, got)
+		}
+	}
+}
+
+// TestJoinRoomPassword checks that rooms are protected with the password of the
+// client creating them, which is hashed before roomsMapMutex is taken.
+func TestJoinRoomPassword(t *testing.T) {
+	name := uuid.New().String()
+
+	// Without a hash, a protected room isn't created.
+	if _, _, err := joinRoomLocked(name, "hunter2", nil); err != errPasswordNotHashed {
+		t.Errorf("Expected %v, got %v", errPasswordNotHashed, err)
+	}
+	if hasRoom(name) {
+		t.Error("Expected the room not to be created")
+	}
+
+	room, created, err := joinRoom(name, "hunter2")
+	if err != nil || !created {
+		t.Fatalf("Expected the room to be created, got %v", err)
+	}
+	defer leaveRoom(room)
+	hash := room.password
+
+	joined, created, err := joinRoom(name, "hunter3")
+	if err != nil || created || joined != room {
+		t.Fatalf("Expected to join the room, got %v", err)
+	}
+	defer leaveRoom(joined)
+
+	tests := []struct {
+		description string
+		got, want   bool
+	}{
+		{description: "password set", got: hash != nil && hash.matches("hunter2"), want: true},
+		{description: "password kept by later joins", got: room.password == hash, want: true},
+	}
+	for _, tc := range tests {
+		if tc.got != tc.want {
+			t.Errorf("(%s) expected %t, got %t", tc.description, tc.want, tc.got)
+		}
+	}
+}
+
+// TestRoomPasswordKept checks that a room closed while idle keeps its password
+// when it is opened again, until it is deleted.
+func TestRoomPasswordKept(t *testing.T) {
+	withRoomTTL(t, 10*time.Millisecond)
+
+	name, renamed := uuid.New().String(), uuid.New().String()
+	room, _, err := joinRoom(name, "hunter2")
+	if err != nil {
+		t.Fatalf("Failed to join room: %v", err)
+	}
+	leaveRoom(room)
+	if !waitFor(2*time.Second, func() bool { return !hasRoom(name) }) {
+		t.Fatal("Expected the idle room to be closed")
+	}
+
+	room, created, err := joinRoom(name, "hunter3")
+	if err != nil || !created {
+		t.Fatalf("Expected the room to be created again, got %v", err)
+	}
+	defer leaveRoom(room)
+	if room.password == nil || !room.password.matches("hunter2") {
+		t.Error("Expected the room to keep its password")
+	}
+
+	if _, err := renameRoom(name, renamed); err != nil {
+		t.Fatalf("Failed to rename room: %v", err)
+	}
+	if err := deleteRoom(renamed, roomDeletedReason); err != nil {
+		t.Fatalf("Failed to delete room: %v", err)
+	}
+
+	tests := []struct {
+		description string
+		name        string
+	}{
+		{description: "old name", name: name},
+		{description: "deleted room", name: renamed},
+	}
+	for _, tc := range tests {
+		room, _, err := joinRoom(tc.name, "")
+		if err != nil {
+			t.Fatalf("(%s) failed to join room: %v", tc.description, err)
+		}
+		if room.password != nil {
+			t.Errorf("(%s) expected the room not to be protected", tc.description)
+		}
+		leaveRoom(room)
+		_ = deleteRoom(tc.name, roomDeletedReason)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/danii7514/codpen/commons"
+)
+
+// Policy is a room's access policy. It decides the role of every client joining the room.
+type Policy struct {
+	// mu protects the policy's fields.
+	mu sync.Mutex
+
+	// owned is set once a client has become the owner of the room.
+	owned bool
+
+	// Owner is the name of the user owning the room. It is empty if the owner
+	// joined without an access token.
+	Owner string
+
+	// Roles maps users to their role in the room.
+	Roles map[string]commons.Role
+
+	// DefaultRole is the role of users who aren't listed in Roles.
+	DefaultRole commons.Role
+}
+
+// NewPolicy returns a policy for a room without an owner, where everybody may edit.
+func NewPolicy() *Policy {
+	return &Policy{
+		Roles:       make(map[string]commons.Role),
+		DefaultRole: commons.RoleEditor,
+	}
+}
+
+// assign returns the role of a user joining the room. user is the name from the
+// user's access token, and granted the role the token grants; both are empty
+// when authentication is disabled. requested is the role the client asked for,
+// which can only lower its permissions. The first user joining without a known
+// role becomes the owner of the room.
+func (p *Policy) assign(user string, granted, requested commons.Role) commons.Role {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	role, known := p.Roles[user]
+	switch {
+	case user != "" && known:
+	case granted.Valid():
+		role = granted
+		if user != "" {
+			p.Roles[user] = role
+		}
+	case !p.owned:
+		role = commons.RoleOwner
+	default:
+		role = p.DefaultRole
+	}
+
+	if requested.Valid() && role.Includes(requested) {
+		role = requested
+	}
+
+	if role == commons.RoleOwner && !p.owned {
+		p.owned = true
+		p.Owner = user
+	}
+
+	return role
+}
+
+// owner returns the name of the user owning the room, which is empty if the
+// owner joined without an access token.
+func (p *Policy) owner() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.Owner
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/danii7514/codpen/commons"
+)
+
+func TestPolicyAssign(t *testing.T) {
+	type join struct {
+		user      string
+		granted   commons.Role
+		requested commons.Role
+		expected  commons.Role
+	}
+
+	tests := []struct {
+		description string
+		joins       []join
+	}{
+		{description: "first client owns the room", joins: []join{
+			{expected: commons.RoleOwner},
+			{expected: commons.RoleEditor},
+			{expected: commons.RoleEditor},
+		}},
+		{description: "viewer requested", joins: []join{
+			{requested: commons.RoleViewer, expected: commons.RoleViewer},
+			{expected: commons.RoleOwner},
+		}},
+		{description: "requested role can't raise permissions", joins: []join{
+			{expected: commons.RoleOwner},
+			{requested: commons.RoleOwner, expected: commons.RoleEditor},
+			{granted: commons.RoleViewer, requested: commons.RoleEditor, expected: commons.RoleViewer},
+		}},
+		{description: "token roles are remembered", joins: []join{
+			{user: "alice", granted: commons.RoleViewer, expected: commons.RoleViewer},
+			{user: "bob", expected: commons.RoleOwner},
+			{user: "alice", expected: commons.RoleViewer},
+			{user: "carol", expected: commons.RoleEditor},
+		}},
+		{description: "unknown roles are ignored", joins: []join{
+			{granted: "admin", requested: "root", expected: commons.RoleOwner},
+		}},
+	}
+
+	for _, tc := range tests {
+		p := NewPolicy()
+		for i, j := range tc.joins {
+			got := p.assign(j.user, j.granted, j.requested)
+			if got != j.expected {
+				t.Errorf("(%s) join %d: got role %q, expected %q", tc.description, i, got, j.expected)
+			}
+		}
+	}
+}
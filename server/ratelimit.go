@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Limits bounds what a single connection may send to the server.
+type Limits struct {
+	// MaxMessageSize is the largest message a client may send, in bytes.
+	MaxMessageSize int64 `yaml:"max_message_size"`
+
+	// MessagesPerSecond is the sustained number of messages a client may send per
+	// second, and MessageBurst the number it may send at once. A zero rate disables the limit.
+	MessagesPerSecond float64 `yaml:"messages_per_second"`
+	MessageBurst      int     `yaml:"message_burst"`
+
+	// BytesPerSecond is the sustained number of bytes a client may send per second,
+	// and ByteBurst the number it may send at once. A zero rate disables the limit.
+	BytesPerSecond float64 `yaml:"bytes_per_second"`
+	ByteBurst      int     `yaml:"byte_burst"`
+
+	// MaxRoomClients is the number of connections a room may have, and
+	// MaxConnections the number the server may have. Zero disables the limit.
+	MaxRoomClients int `yaml:"max_room_clients"`
+	MaxConnections int `yaml:"max_connections"`
+}
+
+var (
+	// defaultLimits are the limits used unless configured otherwise.
+	defaultLimits = Limits{
+		MaxMessageSize:    4 << 20,
+		MessagesPerSecond: 100,
+		MessageBurst:      200,
+		BytesPerSecond:    1 << 20,
+		ByteBurst:         4 << 20,
+	}
+
+	// limits are the limits applied to every new connection. It is protected by
+	// settingsMu, see currentLimits.
+	limits = defaultLimits
+
+	ErrRateLimited = errors.New("rate limit exceeded")
+)
+
+// validate checks that the limits are consistent.
+func (l Limits) validate() error {
+	if l.MaxMessageSize <= 0 {
+		return fmt.Errorf("max message size must be positive, got %d", l.MaxMessageSize)
+	}
+	if l.MessagesPerSecond < 0 || l.BytesPerSecond < 0 {
+		return errors.New("rate limits must not be negative")
+	}
+	if l.MaxRoomClients < 0 || l.MaxConnections < 0 {
+		return errors.New("connection limits must not be negative")
+	}
+	if l.MessagesPerSecond > 0 && l.MessageBurst < 1 {
+		return fmt.Errorf("message burst must be at least 1, got %d", l.MessageBurst)
+	}
+	if l.BytesPerSecond > 0 && int64(l.ByteBurst) < l.MaxMessageSize {
+		return fmt.Errorf("byte burst (%d) must be at least the max message size (%d)", l.ByteBurst, l.MaxMessageSize)
+	}
+	return nil
+}
+
+// A rateLimiter limits the messages and bytes sent by a client.
+type rateLimiter struct {
+	messages *tokenBucket
+	bytes    *tokenBucket
+}
+
+// newRateLimiter returns a rateLimiter enforcing l.
+func newRateLimiter(l Limits) *rateLimiter {
+	return &rateLimiter{
+		messages: newTokenBucket(l.MessagesPerSecond, l.MessageBurst),
+		bytes:    newTokenBucket(l.BytesPerSecond, l.ByteBurst),
+	}
+}
+
+// allow reports whether a message of the given size may be accepted. A nil
+// rateLimiter allows everything.
+func (l *rateLimiter) allow(size int) bool {
+	if l == nil {
+		return true
+	}
+	// Both buckets are charged, so a client sending huge messages pays for them
+	// even if it sends few of them.
+	okMessages := l.messages.take(1)
+	okBytes := l.bytes.take(float64(size))
+	return okMessages && okBytes
+}
+
+// A tokenBucket refills at a constant rate up to its burst size.
+type tokenBucket struct {
+	// mu protects tokens and last.
+	mu sync.Mutex
+
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket refilling at rate tokens per second. A nil
+// bucket, returned for a zero rate, never runs out.
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// take removes n tokens from the bucket, and reports whether there were enough.
+func (b *tokenBucket) take(n float64) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danii7514/codpen/commons"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// drainChannels consumes messageChan and syncChan until the test ends, standing in
+// for handleMsg and handleSync so that connections reach their read loop.
+func drainChannels(t *testing.T) {
+	stop := make(chan struct{})
+	msgs, syncs := messageChan, syncChan
+	go func() {
+		for {
+			select {
+			case <-msgs:
+			case <-syncs:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() { close(stop) })
+}
+
+// relayChannels is like drainChannels, but relays the messages of messageChan
+// like handleMsg does.
+func relayChannels(t *testing.T) {
+	stop := make(chan struct{})
+	msgs, syncs := messageChan, syncChan
+	go func() {
+		for {
+			select {
+			case msg := <-msgs:
+				relayMessage(msg)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	// relayMessage may wait for handleSync.
+	go func() {
+		for {
+			select {
+			case <-syncs:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() { close(stop) })
+}
+
+// withLimits sets limits for the duration of a test.
+func withLimits(t *testing.T, l Limits) {
+	original := limits
+	limits = l
+	t.Cleanup(func() { limits = original })
+}
+
+// readCloseError reads from conn until it fails, and returns the close error.
+func readCloseError(t *testing.T, conn *websocket.Conn) *websocket.CloseError {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			var ce *websocket.CloseError
+			if !errors.As(err, &ce) {
+				t.Fatalf("Expected a close error, got %v", err)
+			}
+			return ce
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(10, 3)
+	for i := 0; i < 3; i++ {
+		if !b.take(1) {
+			t.Fatalf("Expected take %d to be within the burst", i)
+		}
+	}
+	if b.take(1) {
+		t.Error("Expected an empty bucket to refuse tokens")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if !b.take(1) {
+		t.Error("Expected the bucket to refill over time")
+	}
+
+	var unlimited *tokenBucket
+	if !unlimited.take(1e9) {
+		t.Error("Expected a nil bucket to allow everything")
+	}
+}
+
+// TestRateLimitFlood checks that a client flooding the server is disconnected.
+func TestRateLimitFlood(t *testing.T) {
+	drainChannels(t)
+	withLimits(t, Limits{MaxMessageSize: 1 << 20, MessagesPerSecond: 10, MessageBurst: 5})
+
+	server := httptest.NewServer(http.HandlerFunc(handleConn))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:]+"?room="+uuid.New().String(), nil)
+	if err != nil {
+		t.Fatalf("Failed to establish WebSocket connection: %v", err)
+	}
+	defer conn.Close()
+
+	op := commons.Message{Type: commons.OperationMessage, Operation: commons.Operation{Type: "insert", Position: 1, Value: "a"}}
+	for i := 0; i < 50; i++ {
+		if err := conn.WriteJSON(op); err != nil {
+			break
+		}
+	}
+
+	ce := readCloseError(t, conn)
+	if ce.Code != websocket.ClosePolicyViolation || ce.Text != ErrRateLimited.Error() {
+		t.Errorf("Expected close %d %q, got %d %q", websocket.ClosePolicyViolation, ErrRateLimited, ce.Code, ce.Text)
+	}
+}
+
+// TestRateLimitMessageSize checks that a client sending an oversized message is disconnected.
+func TestRateLimitMessageSize(t *testing.T) {
+	drainChannels(t)
+	withLimits(t, Limits{MaxMessageSize: 1024})
+
+	server := httptest.NewServer(http.HandlerFunc(handleConn))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:]+"?room="+uuid.New().String(), nil)
+	if err != nil {
+		t.Fatalf("Failed to establish WebSocket connection: %v", err)
+	}
+	defer conn.Close()
+
+	// A small message is fine.
+	if err := conn.WriteJSON(commons.Message{Type: commons.JoinMessage, Username: "small"}); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+
+	big := commons.Message{Type: commons.DocSyncMessage, Text: strings.Repeat("x", 4096)}
+	if err := conn.WriteJSON(big); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+
+	ce := readCloseError(t, conn)
+	if ce.Code != websocket.CloseMessageTooBig {
+		t.Errorf("Expected close %d, got %d", websocket.CloseMessageTooBig, ce.Code)
+	}
+}
+
+func TestLimitsValidate(t *testing.T) {
+	tests := []struct {
+		description string
+		limits      Limits
+		valid       bool
+	}{
+		{description: "defaults", limits: limits, valid: true},
+		{description: "no rate limits", limits: Limits{MaxMessageSize: 1}, valid: true},
+		{description: "no max message size", limits: Limits{}},
+		{description: "negative rate", limits: Limits{MaxMessageSize: 1, MessagesPerSecond: -1}},
+		{description: "empty message burst", limits: Limits{MaxMessageSize: 1, MessagesPerSecond: 1}},
+		{description: "connection limits", limits: Limits{MaxMessageSize: 1, MaxRoomClients: 10, MaxConnections: 100}, valid: true},
+		{description: "negative connection limit", limits: Limits{MaxMessageSize: 1, MaxConnections: -1}},
+		{description: "byte burst below max message size", limits: Limits{MaxMessageSize: 10, BytesPerSecond: 1, ByteBurst: 5}},
+	}
+
+	for _, tc := range tests {
+		err := tc.limits.validate()
+		if (err == nil) != tc.valid {
+			t.Errorf("(%s) expected valid = %v, got error %v", tc.description, tc.valid, err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/danii7514/codpen/commons"
+	"github.com/danii7514/codpen/crdt"
+	"github.com/google/uuid"
+)
+
+// When the record directory is set, the server records every room: what enters
+// the room, and what the server sends to its clients in return, as
+// commons.Record JSON lines. A recording covers one life of a room, from its
+// creation to its closing, and is replayed with codpen-replay to reproduce a
+// session offline.
+
+// recordDir is the directory recordings are written to. Recording is disabled if
+// it is empty.
+var recordDir string
+
+// RecordingConfig holds the settings of session recordings.
+type RecordingConfig struct {
+	// Dir is the directory recordings are written to. Recording is disabled if it is empty.
+	Dir string `yaml:"dir"`
+}
+
+// A recorder appends to a room's recording.
+type recorder struct {
+	mu sync.Mutex
+
+	// f is the open recording, nil until the recording starts or once it ends.
+	f *os.File
+}
+
+// recordingFileName returns the name of the recording of a room started at start.
+func recordingFileName(room, roomID string, start time.Time) string {
+	return url.PathEscape(room) + "." + start.UTC().Format("20060102T150405Z") + "." + roomID[:8] + ".rec.jsonl"
+}
+
+// startRecording opens the room's recording, if recording is enabled, and
+// records the room's document. roomsMapMutex must not be held.
+func (r *Room) startRecording() {
+	if recordDir == "" {
+		return
+	}
+	r.recorder.mu.Lock()
+	defer r.recorder.mu.Unlock()
+	if r.recorder.f != nil {
+		return
+	}
+
+	now := time.Now().UTC()
+	err := os.MkdirAll(recordDir, 0o700)
+	if err == nil {
+		r.recorder.f, err = os.OpenFile(filepath.Join(recordDir, recordingFileName(r.name(), r.ID, now)), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	}
+	if err != nil {
+		r.log().WithError(err).Error("Failed to start recording")
+		return
+	}
+	doc := r.document()
+	r.recorder.write(r, commons.Record{Time: now, Kind: commons.RecordStart, Document: &doc})
+}
+
+// stopRecording records the room's document, and closes its recording.
+func (r *Room) stopRecording() {
+	r.recorder.mu.Lock()
+	defer r.recorder.mu.Unlock()
+	if r.recorder.f == nil {
+		return
+	}
+	doc := r.document()
+	r.recorder.write(r, commons.Record{Time: time.Now().UTC(), Kind: commons.RecordEnd, Document: &doc})
+	r.recorder.f.Close()
+	r.recorder.f = nil
+}
+
+// recordEntry appends a record to the room's recording, if it is being recorded.
+func (r *Room) recordEntry(rec commons.Record) {
+	r.recorder.mu.Lock()
+	defer r.recorder.mu.Unlock()
+	if r.recorder.f == nil {
+		return
+	}
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+	r.recorder.write(r, rec)
+}
+
+// write appends a record to the recording. l.mu must be held, and the
+// recording open.
+func (l *recorder) write(r *Room, rec commons.Record) {
+	line, err := json.Marshal(rec)
+	if err == nil {
+		_, err = l.f.Write(append(line, '\n'))
+	}
+	if err != nil {
+		r.log().WithError(err).Error("Failed to write to the recording")
+	}
+}
+
+// recordClient records something about a client of the room.
+func (r *Room) recordClient(kind commons.RecordKind, c *client, msg *commons.Message, perr *protocolError) {
+	rec := commons.Record{Kind: kind, Client: c.id.String(), Site: c.site(), Message: msg}
+	c.mu.Lock()
+	rec.User = c.Username
+	c.mu.Unlock()
+	if perr != nil {
+		rec.Error = perr.text
+	}
+	r.recordEntry(rec)
+}
+
+// recordOperation records an operation the room applied, sent by client id from
+// site, or by the server itself if id is uuid.Nil. relayMu must be held.
+func (r *Room) recordOperation(id uuid.UUID, site, user string, msg commons.Message) {
+	rec := commons.Record{Kind: commons.RecordOperation, Seq: r.seq, Site: site, User: user, Message: &msg}
+	if id != uuid.Nil {
+		rec.Client = id.String()
+	}
+	r.recordEntry(rec)
+}
+
+// recordDocument records that the server sent doc to client id, or to every
+// client of the room if id is uuid.Nil. relayMu must be held.
+func (r *Room) recordDocument(id uuid.UUID, doc crdt.Document) {
+	rec := commons.Record{Kind: commons.RecordDocument, Seq: r.seq, Document: &doc}
+	if id != uuid.Nil {
+		rec.Client = id.String()
+	}
+	r.recordEntry(rec)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danii7514/codpen/commons"
+	"github.com/danii7514/codpen/crdt"
+	"github.com/google/uuid"
+)
+
+// readRecording reads the records of the only recording in dir.
+func readRecording(t *testing.T, dir string) []commons.Record {
+	t.Helper()
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.rec.jsonl"))
+	if len(paths) != 1 {
+		t.Fatalf("Expected a recording, got %v", paths)
+	}
+	f, err := os.Open(paths[0])
+	if err != nil {
+		t.Fatalf("Failed to open the recording: %v", err)
+	}
+	defer f.Close()
+
+	var records []commons.Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec commons.Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("Invalid record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestRecording(t *testing.T) {
+	drainChannels(t)
+	recordDir = t.TempDir()
+	defer func() { recordDir = "" }()
+
+	server := httptest.NewServer(newMux())
+	defer server.Close()
+
+	name := uuid.New().String()
+	conn, _, err := dialRoom(server, name, nil)
+	if err != nil {
+		t.Fatalf("Failed to establish WebSocket connection: %v", err)
+	}
+	defer conn.Close()
+	id := readUntil(t, conn, commons.RoleMessage).ID
+
+	for _, msg := range []commons.Message{
+		{Type: commons.JoinMessage, Username: "alice"},
+		{Type: commons.OperationMessage, Operation: commons.Operation{Type: "insert", Position: 1, Value: "ab"}},
+	} {
+		if err := conn.WriteJSON(msg); err != nil {
+			t.Fatalf("Failed to send message: %v", err)
+		}
+	}
+	readUntil(t, conn, commons.ErrorMessage)
+
+	room := findRoom(name)
+	if err := room.mergeText("hi", "bob"); err != nil {
+		t.Fatalf("Failed to merge text: %v", err)
+	}
+	conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for <-room.Clients.get(id) != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := deleteRoom(name, ""); err != nil {
+		t.Fatalf("Failed to delete room: %v", err)
+	}
+
+	records := readRecording(t, recordDir)
+	var kinds []string
+	for _, rec := range records {
+		kind := string(rec.Kind)
+		if rec.Message != nil {
+			kind += " " + string(rec.Message.Type)
+		}
+		if rec.Error != "" {
+			kind += " rejected"
+		}
+		kinds = append(kinds, kind)
+	}
+	want := []string{"start", "connect", "message join", "message operation rejected", "operation operation", "operation operation", "disconnect", "end"}
+	if strings.Join(kinds, ", ") != strings.Join(want, ", ") {
+		t.Fatalf("Expected records %v, got %v", want, kinds)
+	}
+
+	tests := []struct {
+		description string
+		got, want   interface{}
+	}{
+		{description: "client", got: records[1].Client, want: id.String()},
+		{description: "site", got: records[1].Site != "", want: true},
+		{description: "join", got: records[2].Message.Username, want: "alice"},
+		{description: "rejection", got: records[3].Error != "", want: true},
+		{description: "operation sender", got: records[4].User, want: "bob"},
+		{description: "operation seq", got: records[5].Seq, want: uint64(2)},
+		{description: "end", got: crdt.Content(*records[7].Document), want: "hi"},
+	}
+	for _, tc := range tests {
+		if tc.got != tc.want {
+			t.Errorf("(%s) expected %v, got %v", tc.description, tc.want, tc.got)
+		}
+	}
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The server talks to Redis with its wire protocol, RESP
+// (https://redis.io/docs/reference/protocol-spec/), which is all a pub/sub
+// broker needs. Publishing uses one connection, and subscriptions share another,
+// which is reconnected with a backoff and resubscribed whenever it breaks.
+
+const (
+	// redisChannelPrefix prefixes the names of the Redis channels of rooms.
+	redisChannelPrefix = "codpen:room:"
+
+	// redisSiteKey is the key of the site ID counter shared by the nodes.
+	redisSiteKey = "codpen:site-id"
+
+	// redisTimeout bounds how long connecting to Redis and running a command may take.
+	redisTimeout = 5 * time.Second
+
+	// redisMinBackoff and redisMaxBackoff bound the delay between attempts to
+	// reconnect the subscription connection.
+	redisMinBackoff = 100 * time.Millisecond
+	redisMaxBackoff = 10 * time.Second
+
+	// redisPingInterval is how often the subscription connection is checked. It
+	// is considered broken when nothing was received for twice as long.
+	redisPingInterval = 30 * time.Second
+)
+
+var ErrRedisProtocol = errors.New("unexpected reply from redis")
+
+// A redisError is an error reply from Redis.
+type redisError string
+
+// Error returns the error message sent by Redis.
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// A redisConn is a connection to Redis.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialRedis connects to Redis at addr, and authenticates if password isn't empty.
+func dialRedis(addr, password string) (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+
+	if password != "" {
+		if _, err := c.do("AUTH", password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// do runs a command and returns its reply.
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(redisTimeout)); err != nil {
+		return nil, err
+	}
+	defer c.conn.SetDeadline(time.Time{})
+
+	if err := c.write(args...); err != nil {
+		return nil, err
+	}
+	reply, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	if err, ok := reply.(redisError); ok {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// write sends a command.
+func (c *redisConn) write(args ...string) error {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// read reads a reply. Simple strings are returned as strings, bulk strings as
+// []byte (nil if null), integers as int64, arrays as []interface{} and errors as
+// redisError.
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, ErrRedisProtocol
+	}
+	kind, line := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return redisError(line), nil
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < -1 {
+			return nil, ErrRedisProtocol
+		}
+		if n == -1 {
+			return []byte(nil), nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < -1 {
+			return nil, ErrRedisProtocol
+		}
+		if n == -1 {
+			return []interface{}(nil), nil
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	default:
+		return nil, ErrRedisProtocol
+	}
+}
+
+// close closes the connection.
+func (c *redisConn) close() error {
+	return c.conn.Close()
+}
+
+// A redisBroker is a Broker relaying messages through Redis pub/sub.
+type redisBroker struct {
+	addr     string
+	password string
+
+	// pubMu protects pub, the connection used to publish.
+	pubMu sync.Mutex
+	pub   *redisConn
+
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	// sub is the connection the subscriptions are made on, or nil while it is
+	// being reconnected.
+	sub *redisConn
+
+	// handlers holds the handlers of every subscribed channel.
+	handlers map[string]map[*func(data []byte)]struct{}
+
+	// pending holds channels closed once Redis confirms subscribing to a channel.
+	pending map[string]chan struct{}
+
+	closed bool
+	done   chan struct{}
+}
+
+// newRedisBroker returns a Broker relaying messages through the Redis server at
+// addr. It connects in the background, and reconnects whenever the connection breaks.
+func newRedisBroker(addr, password string) *redisBroker {
+	b := &redisBroker{
+		addr:     addr,
+		password: password,
+		handlers: make(map[string]map[*func(data []byte)]struct{}),
+		pending:  make(map[string]chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go b.subscribeLoop()
+	return b
+}
+
+// Publish sends data to the subscribers of a room, on every node.
+func (b *redisBroker) Publish(room string, data []byte) error {
+	_, err := b.do("PUBLISH", redisChannelPrefix+room, string(data))
+	return err
+}
+
+// Ping checks that Redis is reachable.
+func (b *redisBroker) Ping() error {
+	_, err := b.do("PING")
+	return err
+}
+
+// nextSiteID returns a site ID from the counter shared by the nodes. The counter
+// starts at the current time in milliseconds, like the one of a single node, so
+// that IDs stay unique if Redis loses it.
+func (b *redisBroker) nextSiteID() (int64, error) {
+	if _, err := b.do("SET", redisSiteKey, strconv.FormatInt(time.Now().UnixMilli(), 10), "NX"); err != nil {
+		return 0, err
+	}
+	reply, err := b.do("INCR", redisSiteKey)
+	if err != nil {
+		return 0, err
+	}
+	id, ok := reply.(int64)
+	if !ok {
+		return 0, ErrRedisProtocol
+	}
+	return id, nil
+}
+
+// do runs a command on the publishing connection, reconnecting it if needed.
+func (b *redisBroker) do(args ...string) (interface{}, error) {
+	b.pubMu.Lock()
+	defer b.pubMu.Unlock()
+
+	select {
+	case <-b.done:
+		return nil, ErrBrokerClosed
+	default:
+	}
+
+	// A connection which broke since the last command is only noticed when
+	// using it, so the command is retried once on a new connection.
+	for attempt := 0; ; attempt++ {
+		if b.pub == nil {
+			conn, err := dialRedis(b.addr, b.password)
+			if err != nil {
+				return nil, err
+			}
+			b.pub = conn
+		}
+
+		reply, err := b.pub.do(args...)
+		var redisErr redisError
+		if err == nil || errors.As(err, &redisErr) {
+			return reply, err
+		}
+		b.pub.close()
+		b.pub = nil
+		if attempt > 0 {
+			return nil, err
+		}
+	}
+}
+
+// Subscribe calls handler with the data published to a room, until unsubscribe
+// is called. If Redis is reachable, it returns once the subscription is active.
+func (b *redisBroker) Subscribe(room string, handler func(data []byte)) (func(), error) {
+	channel := redisChannelPrefix + room
+	h := &handler
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil, ErrBrokerClosed
+	}
+	var confirmed chan struct{}
+	if b.handlers[channel] == nil {
+		b.handlers[channel] = make(map[*func(data []byte)]struct{})
+		if b.sub != nil {
+			confirmed = make(chan struct{})
+			b.pending[channel] = confirmed
+			if err := b.sub.write("SUBSCRIBE", channel); err != nil {
+				// The subscription loop resubscribes once reconnected.
+				b.sub.close()
+			}
+		}
+	}
+	b.handlers[channel][h] = struct{}{}
+	b.mu.Unlock()
+
+	if confirmed != nil {
+		select {
+		case <-confirmed:
+		case <-b.done:
+		case <-time.After(redisTimeout):
+		}
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			delete(b.handlers[channel], h)
+			if len(b.handlers[channel]) > 0 {
+				return
+			}
+			delete(b.handlers, channel)
+			if b.sub != nil {
+				if err := b.sub.write("UNSUBSCRIBE", channel); err != nil {
+					b.sub.close()
+				}
+			}
+		})
+	}, nil
+}
+
+// Close closes the connections to Redis.
+func (b *redisBroker) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.done)
+	if b.sub != nil {
+		b.sub.close()
+	}
+	b.mu.Unlock()
+
+	b.pubMu.Lock()
+	defer b.pubMu.Unlock()
+	if b.pub != nil {
+		b.pub.close()
+		b.pub = nil
+	}
+	return nil
+}
+
+// subscribeLoop keeps the subscription connection up until the broker is closed,
+// and delivers the messages it receives.
+func (b *redisBroker) subscribeLoop() {
+	backoff := redisMinBackoff
+	for {
+		start := time.Now()
+		err := b.subscribeOnce()
+
+		select {
+		case <-b.done:
+			return
+		default:
+		}
+
+		// A connection which lasted a while starts over from the shortest delay.
+		if time.Since(start) > redisMaxBackoff {
+			backoff = redisMinBackoff
+		}
+		logger.WithError(err).WithFields(logrus.Fields{"addr": b.addr, "retry_in": backoff}).Warn("Lost connection to redis")
+
+		select {
+		case <-time.After(backoff):
+		case <-b.done:
+			return
+		}
+		if backoff *= 2; backoff > redisMaxBackoff {
+			backoff = redisMaxBackoff
+		}
+	}
+}
+
+// subscribeOnce connects to Redis, subscribes to the channels of the current
+// subscriptions, and delivers messages until the connection breaks.
+func (b *redisBroker) subscribeOnce() error {
+	conn, err := dialRedis(b.addr, b.password)
+	if err != nil {
+		return err
+	}
+	defer conn.close()
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrBrokerClosed
+	}
+	b.sub = conn
+	args := []string{"SUBSCRIBE"}
+	for channel := range b.handlers {
+		args = append(args, channel)
+	}
+	if len(args) > 1 {
+		err = conn.write(args...)
+	}
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		b.sub = nil
+		b.mu.Unlock()
+	}()
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go b.keepAlive(conn, stop)
+
+	for {
+		if err := conn.conn.SetReadDeadline(time.Now().Add(2 * redisPingInterval)); err != nil {
+			return err
+		}
+		reply, err := conn.read()
+		if err != nil {
+			return err
+		}
+		if err := b.dispatch(reply); err != nil {
+			return err
+		}
+	}
+}
+
+// keepAlive pings Redis on the subscription connection until stop is closed, so
+// that subscribeOnce notices when the connection silently breaks.
+func (b *redisBroker) keepAlive(conn *redisConn, stop chan struct{}) {
+	ticker := time.NewTicker(redisPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.mu.Lock()
+			err := conn.write("PING")
+			b.mu.Unlock()
+			if err != nil {
+				conn.close()
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// dispatch handles a reply received on the subscription connection.
+func (b *redisBroker) dispatch(reply interface{}) error {
+	if err, ok := reply.(redisError); ok {
+		return err
+	}
+	// Without subscriptions, Redis answers keepAlive's PINGs like any other.
+	if reply == "PONG" {
+		return nil
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) < 2 {
+		return fmt.Errorf("%w: %v", ErrRedisProtocol, reply)
+	}
+	kind, _ := values[0].([]byte)
+	channel, _ := values[1].([]byte)
+
+	switch string(kind) {
+	case "subscribe":
+		b.mu.Lock()
+		if confirmed, ok := b.pending[string(channel)]; ok {
+			close(confirmed)
+			delete(b.pending, string(channel))
+		}
+		b.mu.Unlock()
+
+	case "message":
+		if len(values) < 3 {
+			return fmt.Errorf("%w: %v", ErrRedisProtocol, reply)
+		}
+		data, _ := values[2].([]byte)
+		b.mu.Lock()
+		handlers := make([]func(data []byte), 0, len(b.handlers[string(channel)]))
+		for h := range b.handlers[string(channel)] {
+			handlers = append(handlers, *h)
+		}
+		b.mu.Unlock()
+
+		// Handlers run one at a time, so that every room sees its events in order.
+		for _, handler := range handlers {
+			handler(data)
+		}
+	}
+	return nil
+}
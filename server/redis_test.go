@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A fakeRedis is a Redis server supporting just enough commands for redisBroker.
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	// mu protects the fields below.
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	subs  map[string]map[*fakeRedisConn]struct{}
+	keys  map[string]string
+}
+
+// A fakeRedisConn is a connection to a fakeRedis.
+type fakeRedisConn struct {
+	*redisConn
+
+	// writeMu serializes replies and messages.
+	writeMu sync.Mutex
+}
+
+// newFakeRedis starts a fakeRedis requiring password, if not empty, and stops it
+// when the test ends.
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s := &fakeRedis{
+		listener: l,
+		password: password,
+		conns:    make(map[net.Conn]struct{}),
+		subs:     make(map[string]map[*fakeRedisConn]struct{}),
+		keys:     make(map[string]string),
+	}
+	go s.serve()
+	t.Cleanup(func() {
+		l.Close()
+		s.dropConnections()
+	})
+	return s
+}
+
+// addr returns the server's address.
+func (s *fakeRedis) addr() string {
+	return s.listener.Addr().String()
+}
+
+// dropConnections closes every client connection.
+func (s *fakeRedis) dropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// serve accepts connections until the listener is closed.
+func (s *fakeRedis) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go s.handle(&fakeRedisConn{redisConn: &redisConn{conn: conn, r: bufio.NewReader(conn)}})
+	}
+}
+
+// handle runs the commands of a connection until it is closed.
+func (s *fakeRedis) handle(c *fakeRedisConn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c.conn)
+		for _, subs := range s.subs {
+			delete(subs, c)
+		}
+		s.mu.Unlock()
+		c.conn.Close()
+	}()
+
+	authenticated := s.password == ""
+	subscribed := 0
+	for {
+		reply, err := c.read()
+		if err != nil {
+			return
+		}
+		values, _ := reply.([]interface{})
+		args := make([]string, len(values))
+		for i, v := range values {
+			b, _ := v.([]byte)
+			args[i] = string(b)
+		}
+		if len(args) == 0 {
+			return
+		}
+
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			authenticated = len(args) == 2 && args[1] == s.password
+			if !authenticated {
+				c.reply("-WRONGPASS invalid password\r\n")
+				continue
+			}
+			c.reply("+OK\r\n")
+		case !authenticated:
+			c.reply("-NOAUTH Authentication required.\r\n")
+		case cmd == "PING" && subscribed > 0:
+			c.reply(bulkArray("pong", ""))
+		case cmd == "PING":
+			c.reply("+PONG\r\n")
+		case cmd == "PUBLISH" && len(args) == 3:
+			c.reply(fmt.Sprintf(":%d\r\n", s.publish(args[1], args[2])))
+		case cmd == "SET" && len(args) == 4 && strings.ToUpper(args[3]) == "NX":
+			c.reply(s.setNX(args[1], args[2]))
+		case cmd == "INCR" && len(args) == 2:
+			c.reply(s.incr(args[1]))
+		case cmd == "SUBSCRIBE" || cmd == "UNSUBSCRIBE":
+			for _, channel := range args[1:] {
+				s.mu.Lock()
+				if cmd == "SUBSCRIBE" {
+					if s.subs[channel] == nil {
+						s.subs[channel] = make(map[*fakeRedisConn]struct{})
+					}
+					s.subs[channel][c] = struct{}{}
+					subscribed++
+				} else {
+					delete(s.subs[channel], c)
+					subscribed--
+				}
+				s.mu.Unlock()
+				c.reply(fmt.Sprintf("*3\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n:%d\r\n", len(strings.ToLower(cmd)), strings.ToLower(cmd), len(channel), channel, subscribed))
+			}
+		default:
+			c.reply("-ERR unknown command\r\n")
+		}
+	}
+}
+
+// publish sends a message to the subscribers of a channel, and returns how many there are.
+func (s *fakeRedis) publish(channel, message string) int {
+	s.mu.Lock()
+	subs := make([]*fakeRedisConn, 0, len(s.subs[channel]))
+	for c := range s.subs[channel] {
+		subs = append(subs, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range subs {
+		c.reply(bulkArray("message", channel, message))
+	}
+	return len(subs)
+}
+
+// setNX sets a key if it doesn't exist, and returns the reply.
+func (s *fakeRedis) setNX(key, value string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.keys[key]; ok {
+		return "$-1\r\n"
+	}
+	s.keys[key] = value
+	return "+OK\r\n"
+}
+
+// incr increments the integer stored at a key, and returns the reply.
+func (s *fakeRedis) incr(key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, err := strconv.ParseInt(s.keys[key], 10, 64)
+	if err != nil && s.keys[key] != "" {
+		return "-ERR value is not an integer or out of range\r\n"
+	}
+	n++
+	s.keys[key] = strconv.FormatInt(n, 10)
+	return fmt.Sprintf(":%d\r\n", n)
+}
+
+// reply writes a raw reply to the connection.
+func (c *fakeRedisConn) reply(s string) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, _ = c.conn.Write([]byte(s))
+}
+
+// bulkArray encodes an array of bulk strings.
+func bulkArray(values ...string) string {
+	s := fmt.Sprintf("*%d\r\n", len(values))
+	for _, v := range values {
+		s += fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	}
+	return s
+}
+
+func TestRedisBroker(t *testing.T) {
+	server := newFakeRedis(t, "secret")
+
+	pub := newRedisBroker(server.addr(), "secret")
+	defer pub.Close()
+	sub := newRedisBroker(server.addr(), "secret")
+	defer sub.Close()
+
+	if err := pub.Ping(); err != nil {
+		t.Fatalf("Failed to ping: %v", err)
+	}
+
+	received := make(chan []byte, 8)
+	// The subscription is made once the broker has connected.
+	if !waitFor(2*time.Second, func() bool {
+		sub.mu.Lock()
+		defer sub.mu.Unlock()
+		return sub.sub != nil
+	}) {
+		t.Fatalf("Expected the broker to connect")
+	}
+	unsubscribe, err := sub.Subscribe("room", func(data []byte) { received <- data })
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+
+	payload := "multi\r\nline payload"
+	if err := pub.Publish("room", []byte(payload)); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+	if got := string(receive(t, received)); got != payload {
+		t.Errorf("Expected %q, got %q", payload, got)
+	}
+
+	// Both connections come back after Redis drops them, and the subscription is renewed.
+	server.dropConnections()
+	deadline := time.Now().Add(5 * time.Second)
+	for delivered := false; !delivered; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected messages to be delivered after reconnecting")
+		}
+		_ = pub.Publish("room", []byte("again"))
+		select {
+		case data := <-received:
+			delivered = string(data) == "again"
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	unsubscribe()
+	if !waitFor(2*time.Second, func() bool { return server.publish(redisChannelPrefix+"room", "gone") == 0 }) {
+		t.Errorf("Expected the broker to unsubscribe from the channel")
+	}
+
+	if err := pub.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	if err := pub.Publish("room", []byte("closed")); err != ErrBrokerClosed {
+		t.Errorf("Expected %v publishing after Close, got %v", ErrBrokerClosed, err)
+	}
+}
+
+func TestRedisBrokerAuth(t *testing.T) {
+	server := newFakeRedis(t, "secret")
+
+	tests := []struct {
+		description string
+		password    string
+		ok          bool
+	}{
+		{description: "right password", password: "secret", ok: true},
+		{description: "wrong password", password: "wrong"},
+		{description: "no password"},
+	}
+
+	for _, tc := range tests {
+		b := newRedisBroker(server.addr(), tc.password)
+		err := b.Ping()
+		if tc.ok && err != nil {
+			t.Errorf("(%s) expected ping to succeed, got %v", tc.description, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("(%s) expected ping to fail", tc.description)
+		}
+		b.Close()
+	}
+}
+
+func TestRedisSiteID(t *testing.T) {
+	server := newFakeRedis(t, "")
+
+	// Two nodes share the counter, which starts at the current time.
+	start := time.Now().UnixMilli()
+	a := newRedisBroker(server.addr(), "")
+	defer a.Close()
+	b := newRedisBroker(server.addr(), "")
+	defer b.Close()
+
+	seen := make(map[int64]bool)
+	last := int64(0)
+	for i := 0; i < 10; i++ {
+		node := a
+		if i%2 == 1 {
+			node = b
+		}
+		id, err := node.nextSiteID()
+		if err != nil {
+			t.Fatalf("Failed to allocate site ID: %v", err)
+		}
+		if id <= start || id <= last || seen[id] {
+			t.Errorf("Expected a new site ID above %d and %d, got %d", start, last, id)
+		}
+		seen[id] = true
+		last = id
+	}
+
+	// A counter lost by Redis starts over from the current time.
+	server.mu.Lock()
+	delete(server.keys, redisSiteKey)
+	server.mu.Unlock()
+	if id, err := a.nextSiteID(); err != nil || id <= start {
+		t.Errorf("Expected a site ID above %d after losing the counter, got %d, %v", start, id, err)
+	}
+}
+
+func TestRedisDispatch(t *testing.T) {
+	b := &redisBroker{handlers: make(map[string]map[*func(data []byte)]struct{}), pending: make(map[string]chan struct{})}
+
+	tests := []struct {
+		description string
+		reply       interface{}
+		err         error
+	}{
+		{description: "pong without subscriptions", reply: "PONG"},
+		{description: "pong with subscriptions", reply: []interface{}{[]byte("pong"), []byte("")}},
+		{description: "subscription confirmed", reply: []interface{}{[]byte("subscribe"), []byte("room"), int64(1)}},
+		{description: "unexpected status", reply: "OK", err: ErrRedisProtocol},
+		{description: "truncated message", reply: []interface{}{[]byte("message"), []byte("room")}, err: ErrRedisProtocol},
+		{description: "error", reply: redisError("ERR unknown command"), err: redisError("ERR unknown command")},
+	}
+
+	for _, tc := range tests {
+		if err := b.dispatch(tc.reply); !errors.Is(err, tc.err) {
+			t.Errorf("(%s) expected error %v, got %v", tc.description, tc.err, err)
+		}
+	}
+}
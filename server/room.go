@@ -0,0 +1,503 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/danii7514/codpen/commons"
+	"github.com/danii7514/codpen/crdt"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// Room represents a chat room with its connected clients.
+type Room struct {
+	ID      string
+	Clients *Clients
+
+	// Name is the name clients use to join the room, and the key of the room in roomsMap.
+	Name string
+
+	// Policy decides the role of clients joining the room.
+	Policy *Policy
+
+	// password protects the room, if set. It is only set when the room is created,
+	// and kept in roomPasswords once the room is closed.
+	password *roomPassword
+
+	// doc is the server's copy of the room's document. It is kept up to date by
+	// applying the operations relayed to the room's clients.
+	doc crdt.Document
+
+	// docMu protects doc.
+	docMu sync.Mutex
+
+	// relayMu serializes applying and relaying operations, so that every client
+	// receives the room's operations in the same order.
+	relayMu sync.Mutex
+
+	// seq numbers the operations relayed in the room, and history holds the latest
+	// of them, for clients resuming their session. They are protected by relayMu.
+	seq     uint64
+	history []relayedOp
+
+	// bans keeps banned users out of the room.
+	bans banList
+
+	// auditLog records the changes to the room's document.
+	auditLog auditLog
+
+	// recorder records the room's session, see startRecording.
+	recorder recorder
+
+	// refs counts the connections currently attached to the room. It is protected by roomsMapMutex.
+	refs int
+
+	// idleTimer tears the room down once it has been empty for roomTTL. It is protected by roomsMapMutex.
+	idleTimer *time.Timer
+
+	// idleSeq identifies the most recently armed idle timer, so that a timer which
+	// fired while the room was being rejoined doesn't close it early.
+	idleSeq int
+
+	// clusterMu protects the fields below, which are only used when the server
+	// runs in a cluster. See joinCluster.
+	clusterMu sync.Mutex
+
+	// unsubscribe stops receiving the room's events from the other nodes.
+	unsubscribe func()
+
+	// channel is the name the room's events are published and received under:
+	// its name when it joined the cluster.
+	channel string
+
+	// remoteUsers holds the names of the room's users on the other nodes, by node.
+	remoteUsers map[string][]string
+
+	// lastPresence is the list of local users last sent to the other nodes.
+	lastPresence string
+}
+
+// NewRoom creates a new room with a unique ID.
+func NewRoom() *Room {
+	return &Room{
+		ID:      uuid.New().String(),
+		Clients: NewClients(),
+		Policy:  NewPolicy(),
+		doc:     crdt.New(),
+	}
+}
+
+// defaultRoomTTL is how long an empty room is kept unless configured otherwise.
+const defaultRoomTTL = time.Minute
+
+var (
+	ErrRoomExists   = errors.New("room already exists")
+	ErrRoomNotFound = errors.New("room not found")
+
+	// roomTTL is how long an empty room is kept around before it is torn down. It
+	// is protected by settingsMu, see currentRoomTTL.
+	roomTTL = defaultRoomTTL
+
+	// flushRoom is called with a room right before it is torn down, so that a
+	// persistence layer can write out its state. It is nil when the server runs
+	// without storage. It is protected by flushMu, see setFlushRoom.
+	flushRoom func(room *Room) error
+	flushMu   sync.Mutex
+)
+
+// setFlushRoom sets the function rooms are flushed with before they are torn
+// down, or none if f is nil.
+func setFlushRoom(f func(room *Room) error) {
+	flushMu.Lock()
+	flushRoom = f
+	flushMu.Unlock()
+}
+
+// getOrCreateRoomLocked returns the room with the given name, creating it if
+// necessary, and reports whether it was created. roomsMapMutex must be held. Once
+// it is released, the caller must call joinCluster on created rooms.
+func getOrCreateRoomLocked(roomID string) (*Room, bool) {
+	if room, ok := roomsMap[roomID]; ok {
+		return room, false
+	}
+
+	room := NewRoom()
+	room.Name = roomID
+	room.password = roomPasswords[roomID]
+	go room.Clients.handle()
+	roomsMap[roomID] = room
+
+	// A room nobody joins must not live forever either.
+	room.scheduleClose()
+
+	return room, true
+}
+
+// joinRoom returns the room with the given name, creating it if necessary, and
+// attaches a connection to it. If the room is created and password isn't empty,
+// the room is protected with password, unless it keeps the password it had when
+// it was last closed, see roomPasswords. The boolean result reports whether the
+// room was created by this call. It fails with ErrRoomFull if the room has as
+// many connections as the limits allow. Every successful call must be paired
+// with a call to leaveRoom.
+func joinRoom(roomID string, password string) (*Room, bool, error) {
+	var hash *roomPassword
+	for {
+		// Hashing the password is slow on purpose, so it is done before taking
+		// roomsMapMutex, and only if the room looks like it has to be created.
+		if password != "" && hash == nil && !hasRoom(roomID) {
+			var err error
+			if hash, err = newRoomPassword(password); err != nil {
+				return nil, false, err
+			}
+		}
+
+		room, created, err := joinRoomLocked(roomID, password, hash)
+		if err == errPasswordNotHashed {
+			// The room was closed meanwhile.
+			continue
+		}
+		if err == nil && created {
+			room.joinCluster()
+			room.startRecording()
+			room.auditText("")
+			room.emitEvent(eventRoomCreated, nil)
+		}
+		return room, created, err
+	}
+}
+
+// errPasswordNotHashed is returned by joinRoomLocked when it would create a room
+// protected with a password it was given no hash of.
+var errPasswordNotHashed = errors.New("room password not hashed")
+
+// joinRoomLocked does the work of joinRoom under roomsMapMutex. A room it creates
+// is protected with hash, which must have been created from password.
+func joinRoomLocked(roomID string, password string, hash *roomPassword) (*Room, bool, error) {
+	roomsMapMutex.Lock()
+	defer roomsMapMutex.Unlock()
+
+	if _, ok := roomsMap[roomID]; !ok && password != "" && hash == nil {
+		return nil, false, errPasswordNotHashed
+	}
+	room, created := getOrCreateRoomLocked(roomID)
+	if max := currentLimits().MaxRoomClients; max > 0 && room.refs >= max {
+		return nil, false, ErrRoomFull
+	}
+	if created && password != "" && room.password == nil {
+		room.password = hash
+		roomPasswords[roomID] = hash
+	}
+
+	room.refs++
+	if room.idleTimer != nil {
+		room.idleTimer.Stop()
+		room.idleTimer = nil
+	}
+
+	return room, created, nil
+}
+
+// hasRoom reports whether a room with the given name exists.
+func hasRoom(roomID string) bool {
+	roomsMapMutex.Lock()
+	defer roomsMapMutex.Unlock()
+	_, ok := roomsMap[roomID]
+	return ok
+}
+
+// leaveRoom detaches a connection from a room. Once the last connection has
+// left, the room is torn down after roomTTL unless somebody joins it again.
+func leaveRoom(room *Room) {
+	roomsMapMutex.Lock()
+	defer roomsMapMutex.Unlock()
+
+	room.refs--
+	if room.refs > 0 {
+		return
+	}
+	room.refs = 0
+	room.scheduleClose()
+}
+
+// scheduleClose arms the room's idle timer. roomsMapMutex must be held.
+func (r *Room) scheduleClose() {
+	r.idleSeq++
+	seq := r.idleSeq
+	r.idleTimer = time.AfterFunc(currentRoomTTL(), func() {
+		closeIdleRoom(r, seq)
+	})
+}
+
+// closeIdleRoom removes a room from roomsMap and stops its goroutines, provided
+// it is still empty and no newer idle timer has been armed since seq.
+func closeIdleRoom(room *Room, seq int) {
+	roomsMapMutex.Lock()
+	if room.refs > 0 || room.idleSeq != seq || roomsMap[room.Name] != room {
+		roomsMapMutex.Unlock()
+		return
+	}
+	if len(room.bans.active()) > 0 {
+		// Closing the room would lift its bans.
+		room.scheduleClose()
+		roomsMapMutex.Unlock()
+		return
+	}
+	delete(roomsMap, room.Name)
+	room.idleTimer = nil
+	roomsMapMutex.Unlock()
+
+	room.close()
+}
+
+// close flushes the room to storage, if any, and stops its goroutines. The room
+// must already have been removed from roomsMap.
+func (r *Room) close() {
+	flushMu.Lock()
+	flush := flushRoom
+	flushMu.Unlock()
+	if flush != nil {
+		if err := flush(r); err != nil {
+			r.log().WithError(err).Error("Failed to flush room")
+		}
+	}
+	r.leaveCluster()
+	r.Clients.stop()
+	r.auditLog.close()
+	r.stopRecording()
+	r.emitEvent(eventRoomClosed, nil)
+}
+
+// name returns the room's name. roomsMapMutex must not be held.
+func (r *Room) name() string {
+	roomsMapMutex.Lock()
+	defer roomsMapMutex.Unlock()
+	return r.Name
+}
+
+func getRoomByClientID(clientID uuid.UUID) *Room {
+	roomsMapMutex.Lock()
+	defer roomsMapMutex.Unlock()
+
+	for _, room := range roomsMap {
+		room.Clients.mu.RLock()
+		_, exists := room.Clients.list[clientID]
+		room.Clients.mu.RUnlock()
+		if exists {
+			return room
+		}
+	}
+
+	return nil
+}
+
+// document returns a copy of the room's document.
+func (r *Room) document() crdt.Document {
+	r.docMu.Lock()
+	defer r.docMu.Unlock()
+
+	return crdt.Document{Characters: append([]crdt.Character(nil), r.doc.Characters...)}
+}
+
+// text returns the content of the room's document.
+func (r *Room) text() string {
+	r.docMu.Lock()
+	defer r.docMu.Unlock()
+
+	return crdt.Content(r.doc)
+}
+
+// documentLength returns the number of characters, including deleted ones, in the room's document.
+func (r *Room) documentLength() int {
+	r.docMu.Lock()
+	defer r.docMu.Unlock()
+
+	return r.doc.Length()
+}
+
+// setDocument replaces the room's document.
+func (r *Room) setDocument(doc crdt.Document) {
+	r.docMu.Lock()
+	defer r.docMu.Unlock()
+
+	r.doc = doc
+}
+
+// apply applies an operation to the room's document, and returns the character
+// it inserted or deleted, whose ID is empty if it changed nothing.
+func (r *Room) apply(op commons.Operation) (crdt.Character, error) {
+	r.docMu.Lock()
+	defer r.docMu.Unlock()
+
+	switch op.Type {
+	case "insert":
+		// The new character comes right after the visible one before position,
+		// or at the end past it.
+		before := op.Position - 1
+		if n := visibleLength(r.doc); before > n {
+			before = n
+		}
+		if before < 0 {
+			before = 0
+		}
+		if _, err := r.doc.Insert(op.Position, op.Value); err != nil {
+			return crdt.Character{}, err
+		}
+		return visibleAt(r.doc, before+1), nil
+	case "delete":
+		char := visibleAt(r.doc, op.Position)
+		r.doc.Delete(op.Position)
+		return char, nil
+	}
+	return crdt.Character{}, nil
+}
+
+// visibleAt returns the character at a visible position of a document, counting
+// from 1, or an empty character if there is none.
+func visibleAt(doc crdt.Document, position int) crdt.Character {
+	if char := crdt.IthVisible(doc, position); char.ID != "-1" {
+		return char
+	}
+	return crdt.Character{}
+}
+
+// visibleLength returns the number of visible characters of a document.
+func visibleLength(doc crdt.Document) int {
+	n := 0
+	for _, char := range doc.Characters {
+		if char.Visible {
+			n++
+		}
+	}
+	return n
+}
+
+// newDocument returns a document containing text.
+func newDocument(text string) (crdt.Document, error) {
+	doc := crdt.New()
+	pos := 1
+	for _, r := range text {
+		if _, err := doc.Insert(pos, string(r)); err != nil {
+			return doc, err
+		}
+		pos++
+	}
+	return doc, nil
+}
+
+// createRoom creates a room with the given name and content. It fails with
+// ErrRoomExists if the name is taken. Callers record the content in the room's
+// audit log, see auditText.
+func createRoom(roomID string, content string) (*Room, error) {
+	doc, err := newDocument(content)
+	if err != nil {
+		return nil, err
+	}
+
+	roomsMapMutex.Lock()
+	if _, ok := roomsMap[roomID]; ok {
+		roomsMapMutex.Unlock()
+		return nil, ErrRoomExists
+	}
+
+	room, _ := getOrCreateRoomLocked(roomID)
+	room.setDocument(doc)
+	roomsMapMutex.Unlock()
+
+	room.joinCluster()
+	room.startRecording()
+	room.emitEvent(eventRoomCreated, nil)
+	return room, nil
+}
+
+// findRoom returns the room with the given name, or nil if there is none.
+func findRoom(roomID string) *Room {
+	roomsMapMutex.Lock()
+	defer roomsMapMutex.Unlock()
+
+	return roomsMap[roomID]
+}
+
+// renameRoom renames a room. Connected clients stay in the room, and new clients
+// join it under its new name, as do the nodes of the cluster.
+func renameRoom(oldName, newName string) (*Room, error) {
+	roomsMapMutex.Lock()
+	room, ok := roomsMap[oldName]
+	if !ok {
+		roomsMapMutex.Unlock()
+		return nil, ErrRoomNotFound
+	}
+	if _, ok := roomsMap[newName]; ok {
+		roomsMapMutex.Unlock()
+		return nil, ErrRoomExists
+	}
+
+	delete(roomsMap, oldName)
+	roomsMap[newName] = room
+	room.Name = newName
+
+	// The room's password follows it, and the old name is free to be taken.
+	delete(roomPasswords, oldName)
+	if room.password != nil {
+		roomPasswords[newName] = room.password
+	} else {
+		delete(roomPasswords, newName)
+	}
+	roomsMapMutex.Unlock()
+
+	room.rejoinCluster()
+	return room, nil
+}
+
+// deleteRoom removes a room, disconnects its clients with the given reason, and
+// flushes and stops it.
+func deleteRoom(roomID string, reason string) error {
+	roomsMapMutex.Lock()
+	room, ok := roomsMap[roomID]
+	if !ok {
+		roomsMapMutex.Unlock()
+		return ErrRoomNotFound
+	}
+	if room.idleTimer != nil {
+		room.idleTimer.Stop()
+		room.idleTimer = nil
+	}
+	delete(roomsMap, roomID)
+	delete(roomPasswords, roomID)
+	roomsMapMutex.Unlock()
+
+	room.disconnectAll(websocket.CloseNormalClosure, reason, time.Now().Add(time.Second))
+	room.close()
+	return nil
+}
+
+// disconnectAll sends every client of the room a close frame with the given code
+// and reason.
+func (r *Room) disconnectAll(code int, reason string, deadline time.Time) {
+	for client := range r.Clients.getAll() {
+		if err := client.sendClose(code, reason, deadline); err != nil {
+			client.log().WithError(err).Error("Failed to send close frame")
+		}
+	}
+}
+
+// kick disconnects a client from the room with the given reason. It reports
+// whether the client was in the room.
+func (r *Room) kick(id uuid.UUID, reason string) bool {
+	client := <-r.Clients.get(id)
+	if client == nil {
+		return false
+	}
+
+	// A kicked client may not come back by resuming its session.
+	if client.session != nil {
+		client.session.forget()
+	}
+	if err := client.sendClose(websocket.ClosePolicyViolation, reason, time.Now().Add(time.Second)); err != nil {
+		client.log().WithError(err).Error("Failed to send close frame")
+	}
+	r.Clients.delete(id)
+	return true
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// withRoomTTL sets roomTTL for the duration of a test.
+func withRoomTTL(t *testing.T, ttl time.Duration) {
+	original := roomTTL
+	roomTTL = ttl
+	t.Cleanup(func() { roomTTL = original })
+}
+
+// waitFor polls cond until it returns true or the timeout expires.
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+// TestRoomClosedAfterTTL checks that an empty room is removed once its TTL expires.
+func TestRoomClosedAfterTTL(t *testing.T) {
+	withRoomTTL(t, 50*time.Millisecond)
+
+	name := uuid.New().String()
+	room, _, _ := joinRoom(name, "")
+	leaveRoom(room)
+
+	if !hasRoom(name) {
+		t.Fatal("Expected room to outlive its last client until the TTL expires")
+	}
+
+	if !waitFor(time.Second, func() bool { return !hasRoom(name) }) {
+		t.Fatal("Expected room to be closed after the TTL expired")
+	}
+
+	select {
+	case <-room.Clients.done:
+	default:
+		t.Error("Expected the room's monitor to be stopped")
+	}
+}
+
+// TestRoomRejoinedWithinTTL checks that rejoining an empty room cancels its teardown.
+func TestRoomRejoinedWithinTTL(t *testing.T) {
+	withRoomTTL(t, 50*time.Millisecond)
+
+	name := uuid.New().String()
+	room, _, _ := joinRoom(name, "")
+	leaveRoom(room)
+
+	rejoined, _, _ := joinRoom(name, "")
+	if rejoined != room {
+		t.Fatal("Expected rejoining within the TTL to return the same room")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if !hasRoom(name) {
+		t.Error("Expected an occupied room to survive past its TTL")
+	}
+
+	leaveRoom(rejoined)
+	if !waitFor(time.Second, func() bool { return !hasRoom(name) }) {
+		t.Error("Expected room to be closed after its last client left again")
+	}
+}
+
+// withFlushRoom sets the function rooms are flushed with for the duration of the test.
+// Rooms left over from other tests may be flushed with it too.
+func withFlushRoom(t *testing.T, f func(room *Room) error) {
+	setFlushRoom(f)
+	t.Cleanup(func() { setFlushRoom(nil) })
+}
+
+// TestRoomFlushedBeforeClose checks that flushRoom sees a room before it is torn down.
+func TestRoomFlushedBeforeClose(t *testing.T) {
+	withRoomTTL(t, 0)
+
+	name := uuid.New().String()
+	flushed := make(chan *Room, 1)
+	withFlushRoom(t, func(room *Room) error {
+		if room.name() != name {
+			return nil
+		}
+		select {
+		case <-room.Clients.done:
+			t.Error("Expected room to be flushed before its monitor is stopped")
+		default:
+		}
+		flushed <- room
+		return nil
+	})
+
+	room, _, _ := joinRoom(name, "")
+	leaveRoom(room)
+
+	select {
+	case got := <-flushed:
+		if got != room {
+			t.Errorf("Expected room %s to be flushed, got %s", room.Name, got.Name)
+		}
+	case <-time.After(time.Second):
+		t.Error("Timeout waiting for room to be flushed")
+	}
+}
+
+// TestRoomLifecycleNoGoroutineLeak checks that creating and leaving rooms many times
+// doesn't leave monitor or timer goroutines behind.
+func TestRoomLifecycleNoGoroutineLeak(t *testing.T) {
+	withRoomTTL(t, 0)
+
+	// Let goroutines from earlier tests settle before taking the baseline.
+	time.Sleep(100 * time.Millisecond)
+	baseline := runtime.NumGoroutine()
+
+	prefix := uuid.New().String()
+	for i := 0; i < 5000; i++ {
+		room, _, _ := joinRoom(prefix+strconv.Itoa(i%50), "")
+		room.Clients.updateName(uuid.New(), "nobody")
+		leaveRoom(room)
+	}
+
+	ok := waitFor(5*time.Second, func() bool {
+		return runtime.NumGoroutine() <= baseline
+	})
+	if !ok {
+		t.Errorf("Expected goroutines to return to %d, got %d", baseline, runtime.NumGoroutine())
+	}
+
+	for i := 0; i < 50; i++ {
+		if hasRoom(prefix + strconv.Itoa(i)) {
+			t.Errorf("Expected room %d to be closed", i)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/danii7514/codpen/commons"
+)
+
+// A client whose connection drops can come back within sessionTTL and pick up
+// where it left off. Along with its site ID, the server gives every client a
+// session token, and it numbers the operations it relays in each room. A client
+// reconnecting with its token and the number of the last operation it received
+// keeps its site ID, name and role, and is sent the operations it missed, or the
+// whole document if they are too old. It then sends the operations it made while
+// offline, like any other.
+//
+// Sessions live in the node's memory: behind a load balancer, only the node the
+// client was connected to can resume them.
+
+const (
+	// sessionTTL is how long a session can be resumed after its connection dropped.
+	sessionTTL = 2 * time.Minute
+
+	// historyLimit is how many of the latest operations a room keeps for resuming
+	// clients.
+	historyLimit = 1024
+
+	// sessionHeader is the HTTP header a reconnecting client presents its session
+	// token in, and lastSeqHeader the one holding the number of the last operation
+	// it received.
+	sessionHeader = "X-Codpen-Session"
+	lastSeqHeader = "X-Codpen-Last-Seq"
+)
+
+// A session is what the server remembers about a client, to let it resume after
+// reconnecting.
+type session struct {
+	token string
+	room  *Room
+
+	siteID   string
+	username string
+	subject  string
+	role     commons.Role
+
+	// connected is set while a connection uses the session. Otherwise, the
+	// session can be resumed until expires.
+	connected bool
+	expires   time.Time
+}
+
+// A relayedOp is an operation relayed in a room, kept for resuming clients.
+type relayedOp struct {
+	seq uint64
+	op  commons.Operation
+
+	// site is the site ID of the client which made the operation, or empty if it
+	// didn't come from a client of this node.
+	site string
+}
+
+var (
+	// sessions holds the sessions by token. It is protected by sessionsMu.
+	sessions   = make(map[string]*session)
+	sessionsMu sync.Mutex
+)
+
+// newSession starts a session for a client which just joined a room.
+func newSession(room *Room, c *client) (*session, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	s := &session{
+		token:     hex.EncodeToString(b),
+		room:      room,
+		siteID:    c.site(),
+		subject:   c.subject,
+		role:      c.role,
+		connected: true,
+	}
+
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	// Forget the expired sessions while at it.
+	now := time.Now()
+	for token, old := range sessions {
+		if !old.connected && now.After(old.expires) {
+			delete(sessions, token)
+		}
+	}
+	sessions[s.token] = s
+	return s, nil
+}
+
+// resumeSession returns the session with the given token, if a client with the
+// given subject may resume it in room, and marks it connected. Otherwise, it
+// returns nil.
+func resumeSession(token string, room *Room, subject string) *session {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	s, ok := sessions[token]
+	if !ok || s.connected || s.room != room || s.subject != subject {
+		return nil
+	}
+	if time.Now().After(s.expires) {
+		delete(sessions, token)
+		return nil
+	}
+
+	s.connected = true
+	return s
+}
+
+// release detaches a session from its connection, letting it be resumed for
+// sessionTTL. username is the client's name when the connection dropped.
+func (s *session) release(username string) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	s.username = username
+	s.connected = false
+	s.expires = time.Now().Add(sessionTTL)
+}
+
+// setSite changes the site ID kept by the session.
+func (s *session) setSite(site string) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	s.siteID = site
+}
+
+// forget ends a session, so that it can't be resumed.
+func (s *session) forget() {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	delete(sessions, s.token)
+}
+
+// parseLastSeq parses the number of the last operation a reconnecting client
+// received. A missing or invalid number counts as 0, which makes the client get
+// the whole document.
+func parseLastSeq(s string) uint64 {
+	seq, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return seq
+}
+
+// record numbers an operation relayed in the room, and keeps it for resuming
+// clients. site is the site ID of the client which made it, if any. relayMu must
+// be held.
+func (r *Room) record(op commons.Operation, site string) uint64 {
+	r.seq++
+	r.history = append(r.history, relayedOp{seq: r.seq, op: op, site: site})
+	if len(r.history) > historyLimit {
+		r.history = append(r.history[:0], r.history[len(r.history)-historyLimit:]...)
+	}
+	return r.seq
+}
+
+// resetHistory forgets the operations kept for resuming clients, after the
+// room's document was replaced. relayMu must be held.
+func (r *Room) resetHistory() {
+	// Numbering the replacement makes clients who resume from before it get the
+	// new document.
+	r.seq++
+	r.history = nil
+}
+
+// missedSince returns the operations relayed in the room after the one numbered
+// seq, except those made by site. ok is false if the room no longer has all of
+// them. relayMu must be held.
+func (r *Room) missedSince(seq uint64, site string) (ops []commons.Operation, ok bool) {
+	if seq > r.seq {
+		return nil, false
+	}
+	if seq < r.seq && (len(r.history) == 0 || r.history[0].seq > seq+1) {
+		return nil, false
+	}
+
+	for _, relayed := range r.history {
+		if relayed.seq > seq && relayed.site != site {
+			ops = append(ops, relayed.op)
+		}
+	}
+	return ops, true
+}
+
+// resumeMessage returns the message catching a client resuming from seq up with
+// the room. relayMu must be held.
+func (r *Room) resumeMessage(seq uint64, site string) commons.Message {
+	msg := commons.Message{Type: commons.ResumeMessage, Seq: r.seq}
+	if ops, ok := r.missedSince(seq, site); ok {
+		msg.Operations = ops
+	} else {
+		msg.Document = r.document()
+	}
+	return msg
+}
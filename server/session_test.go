@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/danii7514/codpen/commons"
+	"github.com/danii7514/codpen/crdt"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+func TestMissedSince(t *testing.T) {
+	insert := func(v string) commons.Operation {
+		return commons.Operation{Type: "insert", Position: 1, Value: v}
+	}
+
+	room := NewRoom()
+	room.record(insert("a"), "1")
+	room.record(insert("b"), "2")
+	room.record(insert("c"), "")
+
+	tests := []struct {
+		description string
+		seq         uint64
+		site        string
+		ops         []commons.Operation
+		ok          bool
+	}{
+		{description: "from the start", seq: 0, site: "9", ops: []commons.Operation{insert("a"), insert("b"), insert("c")}, ok: true},
+		{description: "own operations", seq: 0, site: "2", ops: []commons.Operation{insert("a"), insert("c")}, ok: true},
+		{description: "some missed", seq: 2, site: "1", ops: []commons.Operation{insert("c")}, ok: true},
+		{description: "up to date", seq: 3, site: "1", ok: true},
+		{description: "from the future", seq: 4, site: "1"},
+	}
+
+	for _, tc := range tests {
+		ops, ok := room.missedSince(tc.seq, tc.site)
+		if ok != tc.ok || !reflect.DeepEqual(ops, tc.ops) {
+			t.Errorf("(%s) expected %+v, %t, got %+v, %t", tc.description, tc.ops, tc.ok, ops, ok)
+		}
+	}
+
+	// Once the oldest operations are forgotten, resuming from before them requires the document.
+	for i := 0; i < historyLimit; i++ {
+		room.record(insert("x"), "")
+	}
+	if _, ok := room.missedSince(0, "1"); ok {
+		t.Errorf("Expected operations older than the history to be missing")
+	}
+	if ops, ok := room.missedSince(room.seq-1, "1"); !ok || len(ops) != 1 {
+		t.Errorf("Expected the latest operation, got %+v, %t", ops, ok)
+	}
+
+	room.resetHistory()
+	if _, ok := room.missedSince(room.seq-1, "1"); ok {
+		t.Errorf("Expected operations from before a reset to be missing")
+	}
+}
+
+// dialSession connects to a room, resuming a session if token isn't empty, and
+// returns the connection and the session and site ID messages it was sent.
+func dialSession(t *testing.T, server *httptest.Server, room, token string, lastSeq uint64) (*websocket.Conn, commons.Message, commons.Message) {
+	t.Helper()
+
+	header := http.Header{}
+	if token != "" {
+		header.Set(sessionHeader, token)
+		header.Set(lastSeqHeader, strconv.FormatUint(lastSeq, 10))
+	}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:]+"/ws?room="+room, header)
+	if err != nil {
+		t.Fatalf("Failed to establish WebSocket connection: %v", err)
+	}
+	site := readUntil(t, conn, commons.SiteIDMessage)
+	return conn, readUntil(t, conn, commons.SessionMessage), site
+}
+
+// waitReleased waits until the session with the given token is no longer connected.
+func waitReleased(t *testing.T, token string) {
+	t.Helper()
+	released := waitFor(2*time.Second, func() bool {
+		sessionsMu.Lock()
+		defer sessionsMu.Unlock()
+		s, ok := sessions[token]
+		return ok && !s.connected
+	})
+	if !released {
+		t.Fatalf("Expected the session to be released")
+	}
+}
+
+// TestResumeSession checks that a reconnecting client keeps its site ID and gets
+// what it missed.
+func TestResumeSession(t *testing.T) {
+	drainChannels(t)
+	withOpenAPI(t)
+
+	server := httptest.NewServer(newMux())
+	defer server.Close()
+
+	name := uuid.New().String()
+	if status, _ := contentRequest(t, server, http.MethodPut, name, "", "hello"); status != http.StatusCreated {
+		t.Fatalf("Expected status %d creating a room, got %d", http.StatusCreated, status)
+	}
+
+	conn, session, site := dialSession(t, server, name, "", 0)
+	if session.Text == "" {
+		t.Fatalf("Expected a session token")
+	}
+	conn.Close()
+	waitReleased(t, session.Text)
+
+	// Operations relayed while the client is away are sent when it comes back.
+	if status, _ := contentRequest(t, server, http.MethodPut, name, "", "hello world"); status != http.StatusNoContent {
+		t.Fatalf("Expected status %d merging content, got %d", http.StatusNoContent, status)
+	}
+	conn, resumed, resumedSite := dialSession(t, server, name, session.Text, session.Seq)
+	if resumed.Text != session.Text || resumedSite.Text != site.Text {
+		t.Errorf("Expected session %s and site %s, got %s and %s", session.Text, site.Text, resumed.Text, resumedSite.Text)
+	}
+	resume := readUntil(t, conn, commons.ResumeMessage)
+	if want := diffOperations([]rune("hello"), []rune("hello world")); !reflect.DeepEqual(resume.Operations, want) {
+		t.Errorf("Expected the missed operations %+v, got %+v", want, resume.Operations)
+	}
+
+	// A connected session can't be resumed twice.
+	other, otherSession, otherSite := dialSession(t, server, name, session.Text, resume.Seq)
+	if otherSession.Text == session.Text || otherSite.Text == site.Text {
+		t.Errorf("Expected a new session and site for a session already in use")
+	}
+	other.Close()
+	conn.Close()
+	waitReleased(t, session.Text)
+
+	// Resuming from before the document was replaced sends the new document.
+	if status, _ := contentRequest(t, server, http.MethodPut, name, "?mode=replace", "replaced"); status != http.StatusNoContent {
+		t.Fatalf("Expected status %d replacing content, got %d", http.StatusNoContent, status)
+	}
+	conn, _, _ = dialSession(t, server, name, session.Text, resume.Seq)
+	resume = readUntil(t, conn, commons.ResumeMessage)
+	if got := crdt.Content(resume.Document); got != "replaced" || len(resume.Operations) != 0 {
+		t.Errorf("Expected the document %q and no operations, got %q and %+v", "replaced", got, resume.Operations)
+	}
+
+	// A kicked client can't come back.
+	if !findRoom(name).kick(resume.ID, "kicked") {
+		t.Fatalf("Expected the client to be kicked")
+	}
+	conn.Close()
+	conn, kicked, _ := dialSession(t, server, name, session.Text, resume.Seq)
+	defer conn.Close()
+	if kicked.Text == session.Text {
+		t.Errorf("Expected a kicked client's session not to be resumed")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// connsMu protects draining and activeConns, so that no connection is
+	// registered once shutdown started waiting for them to end.
+	connsMu sync.Mutex
+
+	// connsDone is signalled whenever activeConns drops to zero.
+	connsDone = sync.NewCond(&connsMu)
+
+	// draining is set once the server starts shutting down. New WebSocket
+	// connections are refused while it is set.
+	draining bool
+
+	// activeConns counts the WebSocket connections that are still being served.
+	activeConns int
+)
+
+// isDraining reports whether the server is shutting down.
+func isDraining() bool {
+	connsMu.Lock()
+	defer connsMu.Unlock()
+	return draining
+}
+
+// setDraining sets whether the server is shutting down.
+func setDraining(d bool) {
+	connsMu.Lock()
+	draining = d
+	connsMu.Unlock()
+}
+
+// trackConn registers a WebSocket connection being served, unless the server
+// is shutting down. It reports whether it did, in which case untrackConn must
+// be called once the connection ends.
+func trackConn() bool {
+	connsMu.Lock()
+	defer connsMu.Unlock()
+	if draining {
+		return false
+	}
+	activeConns++
+	return true
+}
+
+// untrackConn unregisters a WebSocket connection registered by trackConn.
+func untrackConn() {
+	connsMu.Lock()
+	defer connsMu.Unlock()
+	if activeConns--; activeConns == 0 {
+		connsDone.Broadcast()
+	}
+}
+
+// waitConns waits until no WebSocket connection is being served.
+func waitConns() {
+	connsMu.Lock()
+	defer connsMu.Unlock()
+	for activeConns > 0 {
+		connsDone.Wait()
+	}
+}
+
+// shutdown gracefully stops server. It stops accepting new connections, sends every
+// connected client a close frame carrying reason, flushes all rooms, and waits for the
+// clients to hang up and the webhooks to be delivered. Connections still open after
+// timeout are closed forcibly.
+func shutdown(server *http.Server, reason string, timeout time.Duration) error {
+	setDraining(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Shutdown closes the listener. It doesn't track hijacked connections, so the
+	// WebSockets are taken care of below.
+	err := server.Shutdown(ctx)
+
+	rooms := closeAllRooms(reason, time.Now().Add(timeout))
+	if broker != nil {
+		if err := broker.Close(); err != nil {
+			logger.WithError(err).Error("Failed to close the cluster broker")
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		waitConns()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logger.Warn("Shutdown deadline exceeded, closing remaining connections")
+		for _, room := range rooms {
+			room.Clients.mu.RLock()
+			for _, client := range room.Clients.list {
+				client.Conn.Close()
+			}
+			room.Clients.mu.RUnlock()
+		}
+	}
+
+	// The rooms' last events go out in the time left.
+	waitWebhooks(ctx)
+
+	return err
+}
+
+// closeAllRooms removes every room from roomsMap, sends a close frame with the given
+// reason to all of their clients, and flushes and stops them. It returns the closed rooms.
+func closeAllRooms(reason string, deadline time.Time) []*Room {
+	roomsMapMutex.Lock()
+	rooms := make([]*Room, 0, len(roomsMap))
+	for name, room := range roomsMap {
+		if room.idleTimer != nil {
+			room.idleTimer.Stop()
+			room.idleTimer = nil
+		}
+		delete(roomsMap, name)
+		rooms = append(rooms, room)
+	}
+	roomsMapMutex.Unlock()
+
+	for _, room := range rooms {
+		room.disconnectAll(websocket.CloseServiceRestart, reason, deadline)
+		room.close()
+	}
+
+	return rooms
+}
+
+// sendClose sends a close frame with the given code and reason to the client.
+func (c *client) sendClose(code int, reason string, deadline time.Time) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/danii7514/codpen/commons"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// TestShutdown checks that shutting down sends clients a close frame with the reason,
+// flushes their rooms, and refuses new connections.
+func TestShutdown(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(handleConn))
+	defer server.Close()
+	defer setDraining(false)
+
+	roomID := uuid.New().String()
+
+	// Rooms left over from other tests are flushed too, so only record ours.
+	flushed := make(chan string, 1)
+	withFlushRoom(t, func(room *Room) error {
+		if name := room.name(); name == roomID {
+			flushed <- name
+		}
+		return nil
+	})
+
+	url := "ws" + server.URL[4:] + "?room=" + roomID
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Failed to establish WebSocket connection: %v", err)
+	}
+	defer conn.Close()
+
+	// Wait for the server to register the client.
+	if !waitFor(time.Second, func() bool { return hasRoom(roomID) }) {
+		t.Fatal("Expected room to be created")
+	}
+
+	// Read messages until the connection is closed, answering the close frame.
+	closeErr := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				closeErr <- err
+				return
+			}
+		}
+	}()
+
+	if err := shutdown(server.Config, commons.ServerRestartingReason, 500*time.Millisecond); err != nil {
+		t.Errorf("Unexpected error shutting down: %v", err)
+	}
+
+	select {
+	case err := <-closeErr:
+		var ce *websocket.CloseError
+		if !errors.As(err, &ce) {
+			t.Fatalf("Expected a close error, got %v", err)
+		}
+		if ce.Code != websocket.CloseServiceRestart || ce.Text != commons.ServerRestartingReason {
+			t.Errorf("Expected close %d %q, got %d %q", websocket.CloseServiceRestart, commons.ServerRestartingReason, ce.Code, ce.Text)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for close frame")
+	}
+
+	select {
+	case <-flushed:
+	default:
+		t.Error("Expected room to be flushed on shutdown")
+	}
+
+	if hasRoom(roomID) {
+		t.Error("Expected room to be removed on shutdown")
+	}
+
+	// The listener is closed, so exercise the handler directly.
+	rec := httptest.NewRecorder()
+	handleConn(rec, httptest.NewRequest(http.MethodGet, "/?room="+roomID, nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d while draining, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/danii7514/codpen/commons"
+)
+
+// Site IDs tell apart the characters inserted by each client, so a client must
+// never get a site ID used in a document it edits, even after the server
+// restarted. The server hands them out from a counter which never falls behind
+// the current time in milliseconds: a restarted server starts above every ID
+// it handed out before, unless it handed out more than one per millisecond. In
+// a cluster, the nodes share a counter in Redis.
+//
+// A client which finds characters from its site in its document anyway, for
+// example in a file saved long ago, asks for another site ID.
+
+// A siteClock hands out site IDs from a counter following the clock.
+type siteClock struct {
+	mu   sync.Mutex
+	last int64
+}
+
+// next returns a site ID greater than every ID returned before, and at least the
+// current time in milliseconds.
+func (c *siteClock) next() (int64, error) {
+	now := time.Now().UnixMilli()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now > c.last {
+		c.last = now
+	} else {
+		c.last++
+	}
+	return c.last, nil
+}
+
+// allocateSiteID returns a new site ID. In a cluster, it is replaced by one
+// sharing a counter with the other nodes.
+var allocateSiteID = (&siteClock{}).next
+
+// newSiteID returns a new site ID, formatted for the SiteID message.
+func newSiteID() (string, error) {
+	id, err := allocateSiteID()
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(id, 10), nil
+}
+
+// site returns the client's site ID.
+func (c *client) site() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.SiteID
+}
+
+// changeSite gives the client a new site ID, after it found characters from its
+// site in its document.
+func (c *client) changeSite() error {
+	id, err := newSiteID()
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.SiteID = id
+	c.mu.Unlock()
+
+	if c.session != nil {
+		c.session.setSite(id)
+	}
+
+	// The client's log lines keep the site it connected with.
+	c.log().WithField("new_site", id).Warn("Client's site ID was already used in its document, assigning another")
+	return c.send(commons.Message{Type: commons.SiteIDMessage, Text: id, ID: c.id})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/danii7514/codpen/commons"
+	"github.com/google/uuid"
+)
+
+func TestSiteClock(t *testing.T) {
+	// A clock restarted within the same millisecond still starts at the current time.
+	start := time.Now().UnixMilli()
+	var c siteClock
+	last := int64(0)
+	for i := 0; i < 1000; i++ {
+		id, err := c.next()
+		if err != nil {
+			t.Fatalf("Failed to allocate site ID: %v", err)
+		}
+		if id < start || id <= last {
+			t.Fatalf("Expected a site ID of at least %d above %d, got %d", start, last, id)
+		}
+		last = id
+	}
+
+	// A clock set back doesn't hand out IDs again.
+	ahead := time.Now().Add(time.Hour).UnixMilli()
+	c.last = ahead
+	if id, _ := c.next(); id != ahead+1 {
+		t.Errorf("Expected site ID %d, got %d", ahead+1, id)
+	}
+}
+
+// TestChangeSite checks that a client sending its site ID back gets another,
+// which is kept if it resumes its session.
+func TestChangeSite(t *testing.T) {
+	drainChannels(t)
+
+	server := httptest.NewServer(newMux())
+	defer server.Close()
+
+	name := uuid.New().String()
+	conn, session, site := dialSession(t, server, name, "", 0)
+
+	if err := conn.WriteJSON(commons.Message{Type: commons.SiteIDMessage, Text: site.Text}); err != nil {
+		t.Fatalf("Failed to reject site ID: %v", err)
+	}
+	changed := readUntil(t, conn, commons.SiteIDMessage)
+	if changed.Text == "" || changed.Text == site.Text {
+		t.Fatalf("Expected a new site ID instead of %s, got %q", site.Text, changed.Text)
+	}
+	conn.Close()
+	waitReleased(t, session.Text)
+
+	conn, _, resumedSite := dialSession(t, server, name, session.Text, session.Seq)
+	defer conn.Close()
+	if resumedSite.Text != changed.Text {
+		t.Errorf("Expected the resumed session to keep site %s, got %s", changed.Text, resumedSite.Text)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TLSConfig holds the TLS settings. The server serves plain HTTP unless CertFile
+// or SelfSigned is set.
+type TLSConfig struct {
+	// CertFile and KeyFile are the PEM files holding the server's certificate chain and private key.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+
+	// ClientCAFile is the PEM file holding the CAs client certificates must be
+	// signed by. Clients must present a certificate when it is set.
+	ClientCAFile string `yaml:"client_ca_file"`
+
+	// SelfSigned makes the server generate a self-signed certificate for localhost
+	// when it starts, for development.
+	SelfSigned bool `yaml:"self_signed"`
+}
+
+// selfSignedValidity is how long generated self-signed certificates are valid.
+const selfSignedValidity = 30 * 24 * time.Hour
+
+var (
+	// serverCert is the certificate the server presents. It is protected by
+	// settingsMu, and replaced when the configuration is reloaded.
+	serverCert *tls.Certificate
+
+	ErrNoCertificates = errors.New("no PEM certificates found")
+)
+
+// enabled reports whether the server serves TLS.
+func (c TLSConfig) enabled() bool {
+	return c.CertFile != "" || c.SelfSigned
+}
+
+// validate checks that the TLS settings are consistent and that their files can be loaded.
+func (c TLSConfig) validate() []string {
+	var problems []string
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		problems = append(problems, "tls.cert_file and tls.key_file must be set together")
+	}
+	if c.SelfSigned && c.CertFile != "" {
+		problems = append(problems, "tls.self_signed can't be used with tls.cert_file")
+	}
+	if c.ClientCAFile != "" && !c.enabled() {
+		problems = append(problems, "tls.client_ca_file requires tls.cert_file or tls.self_signed")
+	}
+
+	if c.CertFile != "" && c.KeyFile != "" {
+		if _, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile); err != nil {
+			problems = append(problems, "tls.cert_file: "+err.Error())
+		}
+	}
+	if c.ClientCAFile != "" {
+		if _, err := loadCertPool(c.ClientCAFile); err != nil {
+			problems = append(problems, "tls.client_ca_file: "+err.Error())
+		}
+	}
+	return problems
+}
+
+// newTLSConfig returns the TLS configuration of the server. The certificate is
+// looked up on every handshake, so that reloading the configuration replaces it.
+func newTLSConfig(c TLSConfig) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			settingsMu.RLock()
+			defer settingsMu.RUnlock()
+			return serverCert, nil
+		},
+	}
+
+	if c.ClientCAFile != "" {
+		pool, err := loadCertPool(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// loadCertPool returns a pool of the certificates in a PEM file.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, ErrNoCertificates
+	}
+	return pool, nil
+}
+
+// setupSelfSigned generates a self-signed certificate for the server, and writes
+// it to a file clients can trust with -tls-ca.
+func setupSelfSigned() error {
+	cert, certPEM, err := selfSignedCertificate([]string{"localhost"}, []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}, time.Now())
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(os.TempDir(), "codpen-dev-cert.pem")
+	if err := os.WriteFile(path, certPEM, 0o644); err != nil {
+		return err
+	}
+
+	settingsMu.Lock()
+	serverCert = cert
+	settingsMu.Unlock()
+
+	logger.WithFields(logrus.Fields{"cert": path, "sha256": fingerprint(cert)}).Warn("Serving a self-signed certificate, for development only")
+	return nil
+}
+
+// selfSignedCertificate generates a self-signed certificate valid for the given
+// names and addresses from now on. It returns the certificate and its PEM encoding.
+func selfSignedCertificate(names []string, ips []net.IP, now time.Time) (*tls.Certificate, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"codpen development"}, CommonName: names[0]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              names,
+		IPAddresses:           ips,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert := &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// fingerprint returns the SHA-256 fingerprint of a certificate.
+func fingerprint(cert *tls.Certificate) string {
+	sum := sha256.Sum256(cert.Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
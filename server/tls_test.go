@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeKeyPair writes a certificate and its private key to PEM files, and returns their paths.
+func writeKeyPair(t *testing.T, cert *tls.Certificate) (string, string) {
+	t.Helper()
+
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	certPath := writeFile(t, "cert.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})))
+	keyPath := writeFile(t, "key.pem", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key})))
+	return certPath, keyPath
+}
+
+// newClientCert returns a CA, and a client certificate it signed.
+func newClientCert(t *testing.T) (*x509.Certificate, *tls.Certificate) {
+	t.Helper()
+
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "alice"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Failed to create client certificate: %v", err)
+	}
+
+	return ca, &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTLSConfigValidate(t *testing.T) {
+	cert, _, err := selfSignedCertificate([]string{"localhost"}, nil, time.Now())
+	if err != nil {
+		t.Fatalf("Failed to generate certificate: %v", err)
+	}
+	certPath, keyPath := writeKeyPair(t, cert)
+	notPEM := writeFile(t, "garbage.pem", "garbage")
+
+	tests := []struct {
+		description string
+		config      TLSConfig
+		problem     string
+	}{
+		{description: "disabled", config: TLSConfig{}},
+		{description: "key pair", config: TLSConfig{CertFile: certPath, KeyFile: keyPath}},
+		{description: "self-signed with client CA", config: TLSConfig{SelfSigned: true, ClientCAFile: certPath}},
+		{description: "missing key", config: TLSConfig{CertFile: certPath}, problem: "must be set together"},
+		{description: "self-signed with key pair", config: TLSConfig{CertFile: certPath, KeyFile: keyPath, SelfSigned: true}, problem: "can't be used with"},
+		{description: "client CA without TLS", config: TLSConfig{ClientCAFile: certPath}, problem: "requires tls.cert_file"},
+		{description: "mismatched key pair", config: TLSConfig{CertFile: certPath, KeyFile: notPEM}, problem: "tls.cert_file"},
+		{description: "invalid client CA", config: TLSConfig{SelfSigned: true, ClientCAFile: notPEM}, problem: ErrNoCertificates.Error()},
+		{description: "missing client CA", config: TLSConfig{SelfSigned: true, ClientCAFile: filepath.Join(t.TempDir(), "ca.pem")}, problem: "tls.client_ca_file"},
+	}
+
+	for _, tc := range tests {
+		problems := strings.Join(tc.config.validate(), "\n")
+		if tc.problem == "" && problems != "" {
+			t.Errorf("(%s) unexpected problems: %s", tc.description, problems)
+		}
+		if !strings.Contains(problems, tc.problem) {
+			t.Errorf("(%s) expected a problem mentioning %q, got %q", tc.description, tc.problem, problems)
+		}
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	defer func() { serverCert = nil }()
+
+	cert, certPEM, err := selfSignedCertificate([]string{"localhost"}, []net.IP{net.IPv4(127, 0, 0, 1)}, time.Now())
+	if err != nil {
+		t.Fatalf("Failed to generate certificate: %v", err)
+	}
+	serverCert = cert
+
+	ca, clientCert := newClientCert(t)
+	caPath := writeFile(t, "ca.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})))
+
+	config, err := newTLSConfig(TLSConfig{SelfSigned: true, ClientCAFile: caPath})
+	if err != nil {
+		t.Fatalf("Failed to create TLS config: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := &http.Server{Handler: newMux()}
+	go func() { _ = server.Serve(tls.NewListener(listener, config)) }()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+
+	tests := []struct {
+		description string
+		certs       []tls.Certificate
+		ok          bool
+	}{
+		{description: "no client certificate"},
+		{description: "self-signed client certificate", certs: []tls.Certificate{*cert}},
+		{description: "client certificate signed by the CA", certs: []tls.Certificate{*clientCert}, ok: true},
+	}
+
+	for _, tc := range tests {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: tc.certs},
+		}}
+		resp, err := client.Get("https://" + listener.Addr().String() + "/healthz")
+		if err == nil {
+			resp.Body.Close()
+		}
+		if tc.ok && err != nil {
+			t.Errorf("(%s) unexpected error: %v", tc.description, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("(%s) expected the handshake to fail", tc.description)
+		}
+	}
+}
+
+func TestReloadCertificate(t *testing.T) {
+	defer func() {
+		serverCert = nil
+		_ = defaultConfig().apply()
+	}()
+
+	config, _ := newTLSConfig(TLSConfig{})
+	for i := 0; i < 2; i++ {
+		cert, _, err := selfSignedCertificate([]string{"localhost"}, nil, time.Now())
+		if err != nil {
+			t.Fatalf("Failed to generate certificate: %v", err)
+		}
+		certPath, keyPath := writeKeyPair(t, cert)
+
+		cfg := defaultConfig()
+		cfg.TLS = TLSConfig{CertFile: certPath, KeyFile: keyPath}
+		if err := cfg.apply(); err != nil {
+			t.Fatalf("Failed to apply configuration: %v", err)
+		}
+
+		served, _ := config.GetCertificate(&tls.ClientHelloInfo{})
+		if fingerprint(served) != fingerprint(cert) {
+			t.Errorf("Expected certificate %d to be served after applying the configuration", i)
+		}
+	}
+}
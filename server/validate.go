@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/danii7514/codpen/commons"
+	"github.com/danii7514/codpen/crdt"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Every message read from a client is checked against the protocol before the
+// server acts on it. A message breaking it is dropped, and its sender told why
+// with an error message, whose Code is one of the commons.Error* codes.
+// Operations are also checked against the room's document when they are
+// applied, so that an operation the server can't apply is never relayed.
+
+// maxUsernameLength bounds the length of usernames, in bytes.
+const maxUsernameLength = 64
+
+// messagesRejected counts the messages rejected for breaking the protocol.
+var messagesRejected counter
+
+// A protocolError describes why a message was rejected.
+type protocolError struct {
+	code commons.ErrorCode
+	text string
+}
+
+// Error returns the reason the message was rejected.
+func (e *protocolError) Error() string {
+	return e.text
+}
+
+// reject returns a protocolError with the given code and formatted reason.
+func reject(code commons.ErrorCode, format string, args ...interface{}) *protocolError {
+	return &protocolError{code: code, text: fmt.Sprintf(format, args...)}
+}
+
+// message returns the error message telling client id why its message was rejected.
+func (e *protocolError) message(id uuid.UUID) commons.Message {
+	return commons.Message{Type: commons.ErrorMessage, Code: e.code, Text: e.text, ID: id}
+}
+
+// validateMessage checks that a message read from a client is one clients may
+// send, with sane fields.
+func validateMessage(msg commons.Message) *protocolError {
+	switch msg.Type {
+	case commons.OperationMessage:
+		return validateOperation(msg.Operation)
+
+	case commons.JoinMessage:
+		return validateUsername(msg.Username)
+
+	case commons.DocSyncMessage:
+		if msg.ID == uuid.Nil {
+			return reject(commons.ErrorInvalidMessage, "invalid docSync: no recipient")
+		}
+		return validateDocument(msg.Document)
+
+	case commons.SiteIDMessage:
+		return nil
+	}
+	return reject(commons.ErrorUnknownType, "unknown message type %q", msg.Type)
+}
+
+// validateOperation checks the fields of an operation. Whether its position is
+// in the room's document is checked when it is applied, see Room.checkOperation.
+func validateOperation(op commons.Operation) *protocolError {
+	switch op.Type {
+	case "insert":
+		if !isCharacter(op.Value) {
+			return reject(commons.ErrorInvalidOperation, "invalid insert: the value must be a single character, got %d bytes", len(op.Value))
+		}
+	case "delete":
+		if op.Value != "" {
+			return reject(commons.ErrorInvalidOperation, "invalid delete: unexpected value")
+		}
+	default:
+		return reject(commons.ErrorInvalidOperation, "unknown operation type %q", op.Type)
+	}
+
+	if op.Position < 1 {
+		return reject(commons.ErrorInvalidOperation, "invalid %s: position %d is before the start of the text", op.Type, op.Position)
+	}
+	return nil
+}
+
+// validateUsername checks a username sent in a join message. Usernames may be
+// empty, but are listed in users messages separated by commas, so they may not
+// hold any.
+func validateUsername(name string) *protocolError {
+	switch {
+	case len(name) > maxUsernameLength:
+		return reject(commons.ErrorInvalidMessage, "invalid username: longer than %d bytes", maxUsernameLength)
+	case !utf8.ValidString(name):
+		return reject(commons.ErrorInvalidMessage, "invalid username: not UTF-8")
+	case strings.ContainsRune(name, ','):
+		return reject(commons.ErrorInvalidMessage, "invalid username: commas aren't allowed")
+	case strings.IndexFunc(name, unicode.IsControl) >= 0:
+		return reject(commons.ErrorInvalidMessage, "invalid username: control characters aren't allowed")
+	}
+	return nil
+}
+
+// validateDocument checks that a document sent by a client is well formed: it
+// starts and ends with the start and end characters, and holds single characters
+// with IDs in between.
+func validateDocument(doc crdt.Document) *protocolError {
+	chars := doc.Characters
+	if len(chars) < 2 || chars[0].ID != crdt.CharacterStart.ID || chars[len(chars)-1].ID != crdt.CharacterEnd.ID {
+		return reject(commons.ErrorInvalidMessage, "invalid document: it must start and end with the start and end characters")
+	}
+	for i, char := range chars[1 : len(chars)-1] {
+		if char.ID == "" || !isCharacter(char.Value) {
+			return reject(commons.ErrorInvalidMessage, "invalid document: character %d must have an ID and a single character value", i+1)
+		}
+	}
+	return nil
+}
+
+// isCharacter reports whether s holds a single valid character.
+func isCharacter(s string) bool {
+	_, size := utf8.DecodeRuneInString(s)
+	return size > 0 && size == len(s) && utf8.ValidString(s)
+}
+
+// checkOperation checks that an operation applies to the room's document:
+// insertions go at most right after the last character, and deletions remove
+// an existing one.
+func (r *Room) checkOperation(op commons.Operation) *protocolError {
+	r.docMu.Lock()
+	n := visibleLength(r.doc)
+	r.docMu.Unlock()
+
+	if op.Type == "insert" && op.Position > n+1 {
+		return reject(commons.ErrorInvalidOperation, "invalid insert: position %d is past the end of the text, at %d", op.Position, n+1)
+	}
+	if op.Type == "delete" && op.Position > n {
+		return reject(commons.ErrorInvalidOperation, "invalid delete: position %d is past the end of the text, at %d", op.Position, n)
+	}
+	return nil
+}
+
+// reject tells the client why its message to room was rejected, and records it.
+func (c *client) reject(room *Room, msg commons.Message, perr *protocolError) {
+	messagesRejected.inc()
+	room.recordClient(commons.RecordMessage, c, &msg, perr)
+	c.log().WithField("code", perr.code).Warnf("Rejecting message: %s", perr.text)
+	if err := c.send(perr.message(c.id)); err != nil {
+		c.log().WithError(err).Error("Failed to send message")
+	}
+}
+
+// rejectOperation tells the client which sent msg why its operation was
+// rejected, and sends it the room's document, which the operation's position was
+// meant for. relayMu must be held.
+func (r *Room) rejectOperation(msg commons.Message, perr *protocolError) {
+	id := msg.ID
+	messagesRejected.inc()
+	r.log().WithFields(logrus.Fields{"client": id, "code": perr.code}).Warnf("Rejecting operation: %s", perr.text)
+	if c := <-r.Clients.get(id); c != nil {
+		r.recordClient(commons.RecordMessage, c, &msg, perr)
+	}
+	r.Clients.broadcastOne(perr.message(id), id)
+
+	doc := r.document()
+	r.recordDocument(id, doc)
+	r.Clients.broadcastOne(commons.Message{Type: commons.DocSyncMessage, Document: doc, Seq: r.seq, ID: id}, id)
+}
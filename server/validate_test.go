@@ -0,0 +1,217 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/danii7514/codpen/commons"
+	"github.com/danii7514/codpen/crdt"
+	"github.com/google/uuid"
+)
+
+func TestValidateMessage(t *testing.T) {
+	doc := crdt.New()
+	if _, err := doc.Insert(1, "é"); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	badDoc := crdt.New()
+	badDoc.Characters = append(badDoc.Characters[:1], crdt.Character{ID: "1.1", Value: "ab"}, crdt.CharacterEnd)
+
+	tests := []struct {
+		description string
+		msg         commons.Message
+		want        commons.ErrorCode
+	}{
+		{description: "insert", msg: commons.Message{Type: commons.OperationMessage, Operation: commons.Operation{Type: "insert", Position: 1, Value: "€"}}},
+		{description: "delete", msg: commons.Message{Type: commons.OperationMessage, Operation: commons.Operation{Type: "delete", Position: 3}}},
+		{description: "join", msg: commons.Message{Type: commons.JoinMessage, Username: "alice"}},
+		{description: "join without a name", msg: commons.Message{Type: commons.JoinMessage}},
+		{description: "site ID", msg: commons.Message{Type: commons.SiteIDMessage, Text: "4"}},
+		{description: "document", msg: commons.Message{Type: commons.DocSyncMessage, ID: uuid.New(), Document: doc}},
+		{description: "unknown type", msg: commons.Message{Type: "shout"}, want: commons.ErrorUnknownType},
+		{description: "server message", msg: commons.Message{Type: commons.UsersMessage, Text: "alice"}, want: commons.ErrorUnknownType},
+		{description: "unknown operation", msg: commons.Message{Type: commons.OperationMessage, Operation: commons.Operation{Type: "move", Position: 1}}, want: commons.ErrorInvalidOperation},
+		{description: "empty insert", msg: commons.Message{Type: commons.OperationMessage, Operation: commons.Operation{Type: "insert", Position: 1}}, want: commons.ErrorInvalidOperation},
+		{description: "long insert", msg: commons.Message{Type: commons.OperationMessage, Operation: commons.Operation{Type: "insert", Position: 1, Value: strings.Repeat("a", 4096)}}, want: commons.ErrorInvalidOperation},
+		{description: "invalid UTF-8", msg: commons.Message{Type: commons.OperationMessage, Operation: commons.Operation{Type: "insert", Position: 1, Value: "\xff"}}, want: commons.ErrorInvalidOperation},
+		{description: "delete with a value", msg: commons.Message{Type: commons.OperationMessage, Operation: commons.Operation{Type: "delete", Position: 1, Value: "a"}}, want: commons.ErrorInvalidOperation},
+		{description: "position zero", msg: commons.Message{Type: commons.OperationMessage, Operation: commons.Operation{Type: "delete"}}, want: commons.ErrorInvalidOperation},
+		{description: "negative position", msg: commons.Message{Type: commons.OperationMessage, Operation: commons.Operation{Type: "insert", Position: -4, Value: "a"}}, want: commons.ErrorInvalidOperation},
+		{description: "long name", msg: commons.Message{Type: commons.JoinMessage, Username: strings.Repeat("a", maxUsernameLength+1)}, want: commons.ErrorInvalidMessage},
+		{description: "name with a comma", msg: commons.Message{Type: commons.JoinMessage, Username: "alice,bob"}, want: commons.ErrorInvalidMessage},
+		{description: "name with a newline", msg: commons.Message{Type: commons.JoinMessage, Username: "alice\n"}, want: commons.ErrorInvalidMessage},
+		{description: "document without recipient", msg: commons.Message{Type: commons.DocSyncMessage, Document: doc}, want: commons.ErrorInvalidMessage},
+		{description: "empty document", msg: commons.Message{Type: commons.DocSyncMessage, ID: uuid.New()}, want: commons.ErrorInvalidMessage},
+		{description: "malformed document", msg: commons.Message{Type: commons.DocSyncMessage, ID: uuid.New(), Document: badDoc}, want: commons.ErrorInvalidMessage},
+	}
+
+	for _, tc := range tests {
+		var got commons.ErrorCode
+		if perr := validateMessage(tc.msg); perr != nil {
+			got = perr.code
+		}
+		if got != tc.want {
+			t.Errorf("(%s) expected code %q, got %q", tc.description, tc.want, got)
+		}
+	}
+}
+
+func TestCheckOperation(t *testing.T) {
+	name := uuid.New().String()
+	room, _, err := joinRoom(name, "")
+	if err != nil {
+		t.Fatalf("Failed to join room: %v", err)
+	}
+	defer leaveRoom(room)
+	defer deleteRoom(name, "")
+	if err := room.mergeText("abc", ""); err != nil {
+		t.Fatalf("Failed to merge text: %v", err)
+	}
+
+	tests := []struct {
+		description string
+		op          commons.Operation
+		valid       bool
+	}{
+		{description: "insert at the start", op: commons.Operation{Type: "insert", Position: 1, Value: "x"}, valid: true},
+		{description: "insert at the end", op: commons.Operation{Type: "insert", Position: 4, Value: "x"}, valid: true},
+		{description: "insert past the end", op: commons.Operation{Type: "insert", Position: 5, Value: "x"}},
+		{description: "delete the last character", op: commons.Operation{Type: "delete", Position: 3}, valid: true},
+		{description: "delete past the end", op: commons.Operation{Type: "delete", Position: 4}},
+	}
+
+	for _, tc := range tests {
+		if perr := room.checkOperation(tc.op); (perr == nil) != tc.valid {
+			t.Errorf("(%s) expected valid %t, got %v", tc.description, tc.valid, perr)
+		}
+	}
+}
+
+func TestRejectMessages(t *testing.T) {
+	drainChannels(t)
+
+	server := httptest.NewServer(newMux())
+	defer server.Close()
+
+	name := uuid.New().String()
+	conn, _, err := dialRoom(server, name, nil)
+	if err != nil {
+		t.Fatalf("Failed to establish WebSocket connection: %v", err)
+	}
+	defer conn.Close()
+	id := readUntil(t, conn, commons.RoleMessage).ID
+
+	before := messagesRejected.value()
+	tests := []struct {
+		description string
+		msg         commons.Message
+		want        commons.ErrorCode
+	}{
+		{description: "unknown type", msg: commons.Message{Type: "shout"}, want: commons.ErrorUnknownType},
+		{description: "multi-character insert", msg: commons.Message{Type: commons.OperationMessage, Operation: commons.Operation{Type: "insert", Position: 1, Value: "abc"}}, want: commons.ErrorInvalidOperation},
+		{description: "document for another room", msg: commons.Message{Type: commons.DocSyncMessage, ID: uuid.New(), Document: crdt.New()}, want: commons.ErrorInvalidMessage},
+	}
+	for _, tc := range tests {
+		if err := conn.WriteJSON(tc.msg); err != nil {
+			t.Fatalf("(%s) failed to send message: %v", tc.description, err)
+		}
+		if got := readUntil(t, conn, commons.ErrorMessage); got.Code != tc.want || got.Text == "" {
+			t.Errorf("(%s) expected an error with code %q, got %+v", tc.description, tc.want, got)
+		}
+	}
+	if got := messagesRejected.value() - before; got != uint64(len(tests)) {
+		t.Errorf("Expected %d messages to be counted as rejected, got %d", len(tests), got)
+	}
+
+	// An operation rejected when applied is followed by the room's document.
+	room := findRoom(name)
+	if err := room.mergeText("hi", ""); err != nil {
+		t.Fatalf("Failed to merge text: %v", err)
+	}
+	op := commons.Operation{Type: "delete", Position: 9}
+	room.relayMu.Lock()
+	if perr := room.checkOperation(op); perr != nil {
+		room.rejectOperation(commons.Message{Type: commons.OperationMessage, Operation: op, ID: id}, perr)
+	}
+	room.relayMu.Unlock()
+	if got := readUntil(t, conn, commons.ErrorMessage); got.Code != commons.ErrorInvalidOperation {
+		t.Errorf("Expected an %q error, got %+v", commons.ErrorInvalidOperation, got)
+	}
+	if got := readUntil(t, conn, commons.DocSyncMessage); crdt.Content(got.Document) != "hi" {
+		t.Errorf("Expected the room's document to follow the error, got %q", crdt.Content(got.Document))
+	}
+}
+
+func TestViewerDocSync(t *testing.T) {
+	drainChannels(t)
+
+	server := httptest.NewServer(newMux())
+	defer server.Close()
+
+	name := uuid.New().String()
+	viewer, _, err := dialRoom(server, name+"&role=viewer", nil)
+	if err != nil {
+		t.Fatalf("Failed to establish WebSocket connection: %v", err)
+	}
+	defer viewer.Close()
+	if got := readUntil(t, viewer, commons.RoleMessage); got.Text != string(commons.RoleViewer) {
+		t.Fatalf("Expected the %q role, got %q", commons.RoleViewer, got.Text)
+	}
+	if err := findRoom(name).mergeText("hi", ""); err != nil {
+		t.Fatalf("Failed to merge text: %v", err)
+	}
+
+	// The viewer isn't asked for the document, so the server sends its own.
+	editor, _, err := dialRoom(server, name, nil)
+	if err != nil {
+		t.Fatalf("Failed to establish WebSocket connection: %v", err)
+	}
+	defer editor.Close()
+	editorID := readUntil(t, editor, commons.RoleMessage).ID
+	if got := readUntil(t, editor, commons.DocSyncMessage); crdt.Content(got.Document) != "hi" {
+		t.Errorf("Expected the room's document, got %q", crdt.Content(got.Document))
+	}
+
+	// Nor may it send one.
+	doc, _ := newDocument("overwritten")
+	if err := viewer.WriteJSON(commons.Message{Type: commons.DocSyncMessage, ID: editorID, Document: doc}); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	if got := readUntil(t, viewer, commons.ErrorMessage); got.Code != commons.ErrorReadOnly {
+		t.Errorf("Expected a %q error, got %+v", commons.ErrorReadOnly, got)
+	}
+	if got := crdt.Content(findRoom(name).document()); got != "hi" {
+		t.Errorf("Expected the room's document to be left alone, got %q", got)
+	}
+}
+
+func TestViewerReceivesOperations(t *testing.T) {
+	relayChannels(t)
+
+	server := httptest.NewServer(newMux())
+	defer server.Close()
+
+	name := uuid.New().String()
+	editor, _, err := dialRoom(server, name, nil)
+	if err != nil {
+		t.Fatalf("Failed to establish WebSocket connection: %v", err)
+	}
+	defer editor.Close()
+	readUntil(t, editor, commons.RoleMessage)
+
+	viewer, _, err := dialRoom(server, name+"&role=viewer", nil)
+	if err != nil {
+		t.Fatalf("Failed to establish WebSocket connection: %v", err)
+	}
+	defer viewer.Close()
+	readUntil(t, viewer, commons.RoleMessage)
+
+	op := commons.Operation{Type: "insert", Position: 1, Value: "a"}
+	if err := editor.WriteJSON(commons.Message{Type: commons.OperationMessage, Operation: op}); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	if got := readUntil(t, viewer, commons.OperationMessage); got.Operation != op {
+		t.Errorf("Expected the viewer to be sent %+v, got %+v", op, got.Operation)
+	}
+}
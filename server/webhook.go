@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The server notifies other services of room events by POSTing them as JSON to
+// the configured webhook URLs. Every request is signed with the webhook secret:
+// its X-Codpen-Signature header holds "t=<unix time>,v1=<hex HMAC-SHA256 of
+// '<unix time>.<body>'>", so that receivers can check where it came from and
+// reject replays. Failed deliveries are retried with exponential backoff, and
+// those that fail for good are appended to the dead-letter file.
+
+// Types of webhook events.
+const (
+	eventRoomCreated  = "room.created"
+	eventRoomClosed   = "room.closed"
+	eventUserJoined   = "user.joined"
+	eventContentSaved = "content.saved"
+)
+
+const (
+	// defaultWebhookAttempts is how many times a delivery is attempted unless
+	// configured otherwise.
+	defaultWebhookAttempts = 5
+
+	// maxWebhookBackoff bounds the delay between two attempts.
+	maxWebhookBackoff = 5 * time.Minute
+
+	// maxPendingWebhooks bounds the deliveries in progress. Events beyond it go
+	// straight to the dead-letter file.
+	maxPendingWebhooks = 1000
+
+	// signatureHeader is the header carrying a webhook request's signature.
+	signatureHeader = "X-Codpen-Signature"
+)
+
+// WebhooksConfig holds the settings of webhooks.
+type WebhooksConfig struct {
+	// URLs lists the URLs events are sent to. Webhooks are disabled if it is empty.
+	URLs []string `yaml:"urls"`
+
+	// SecretFile is the file containing the secret signing the requests.
+	SecretFile string `yaml:"secret_file"`
+
+	// MaxAttempts is how many times a delivery is attempted before giving up.
+	MaxAttempts int `yaml:"max_attempts"`
+
+	// DeadLetterFile is the file deliveries that failed for good are appended to,
+	// as JSON lines. They are only logged if it is empty.
+	DeadLetterFile string `yaml:"dead_letter_file"`
+}
+
+// A webhookEvent is the body of a webhook request.
+type webhookEvent struct {
+	// ID identifies the event. It stays the same across attempts, so that receivers
+	// can tell retries apart.
+	ID     string    `json:"id"`
+	Type   string    `json:"type"`
+	Time   time.Time `json:"time"`
+	Room   string    `json:"room"`
+	RoomID string    `json:"roomID"`
+
+	// Data holds the details of the event, like the name of the user who joined.
+	Data map[string]string `json:"data,omitempty"`
+}
+
+// A deadLetter records a delivery that failed for good.
+type deadLetter struct {
+	Time     time.Time    `json:"time"`
+	URL      string       `json:"url"`
+	Attempts int          `json:"attempts"`
+	Error    string       `json:"error"`
+	Event    webhookEvent `json:"event"`
+}
+
+// A webhookStatusError is a response to a webhook request without a 2xx status.
+type webhookStatusError struct {
+	code int
+}
+
+func (e webhookStatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d %s", e.code, http.StatusText(e.code))
+}
+
+var (
+	// webhooks holds the webhook settings in effect. It is protected by settingsMu.
+	webhooks WebhooksConfig
+
+	// webhookSecret signs webhook requests. It is protected by settingsMu.
+	webhookSecret []byte
+
+	// webhookClient sends webhook requests.
+	webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+	// webhookBackoff is the delay before the second attempt of a delivery, which
+	// doubles with every attempt after it.
+	webhookBackoff = time.Second
+
+	// pendingWebhooks counts, and webhookDeliveries tracks, the deliveries in progress.
+	pendingWebhooks   int32
+	webhookDeliveries sync.WaitGroup
+
+	// deadLetterMu serializes writes to the dead-letter file.
+	deadLetterMu sync.Mutex
+
+	// webhookFailures counts the deliveries that failed for good.
+	webhookFailures counter
+
+	ErrNoWebhookSecret = errors.New("a secret file is needed to sign webhooks")
+)
+
+// validate checks the webhook settings.
+func (c WebhooksConfig) validate() []string {
+	var problems []string
+	for _, u := range c.URLs {
+		if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			problems = append(problems, fmt.Sprintf("webhooks.urls: invalid URL %q", u))
+		}
+	}
+	if len(c.URLs) > 0 && c.SecretFile == "" {
+		problems = append(problems, "webhooks.secret_file: "+ErrNoWebhookSecret.Error())
+	}
+	if c.SecretFile != "" {
+		if _, err := readSecret(c.SecretFile); err != nil {
+			problems = append(problems, "webhooks.secret_file: "+err.Error())
+		}
+	}
+	if c.MaxAttempts < 1 {
+		problems = append(problems, fmt.Sprintf("webhooks.max_attempts must be positive, got %d", c.MaxAttempts))
+	}
+	return problems
+}
+
+// currentWebhooks returns the webhook settings in effect and the signing secret.
+func currentWebhooks() (WebhooksConfig, []byte) {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return webhooks, webhookSecret
+}
+
+// emitEvent sends an event about a room to the webhook URLs, if any. It doesn't
+// wait for the deliveries. roomsMapMutex must not be held.
+func (r *Room) emitEvent(eventType string, data map[string]string) {
+	cfg, secret := currentWebhooks()
+	if len(cfg.URLs) == 0 {
+		return
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		r.log().WithError(err).Error("Failed to create webhook event")
+		return
+	}
+	event := webhookEvent{
+		ID:     hex.EncodeToString(b),
+		Type:   eventType,
+		Time:   time.Now().UTC(),
+		Room:   r.name(),
+		RoomID: r.ID,
+		Data:   data,
+	}
+
+	for _, u := range cfg.URLs {
+		if atomic.AddInt32(&pendingWebhooks, 1) > maxPendingWebhooks {
+			atomic.AddInt32(&pendingWebhooks, -1)
+			cfg.deadLetter(u, event, 0, errors.New("too many pending deliveries"))
+			continue
+		}
+		webhookDeliveries.Add(1)
+		go func(u string) {
+			defer webhookDeliveries.Done()
+			defer atomic.AddInt32(&pendingWebhooks, -1)
+			cfg.deliver(u, event, secret)
+		}(u)
+	}
+}
+
+// deliver sends an event to a webhook URL, retrying until it succeeds or the
+// attempts run out, in which case the event is dead-lettered.
+func (c WebhooksConfig) deliver(u string, event webhookEvent, secret []byte) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		c.deadLetter(u, event, 0, err)
+		return
+	}
+
+	attempt := 1
+	for ; ; attempt++ {
+		if err = postWebhook(u, event, body, secret); err == nil {
+			logger.WithFields(logrus.Fields{"url": u, "event": event.Type, "attempts": attempt}).Debug("Delivered webhook")
+			return
+		}
+		if attempt >= c.MaxAttempts || !retryable(err) {
+			break
+		}
+		logger.WithError(err).WithFields(logrus.Fields{"url": u, "event": event.Type, "attempt": attempt}).Warn("Webhook delivery failed, retrying")
+		time.Sleep(webhookDelay(attempt))
+	}
+	c.deadLetter(u, event, attempt, err)
+}
+
+// postWebhook makes a single attempt at delivering an event.
+func postWebhook(u string, event webhookEvent, body, secret []byte) error {
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "codpen-webhook")
+	req.Header.Set("X-Codpen-Event", event.Type)
+	req.Header.Set("X-Codpen-Delivery", event.ID)
+	req.Header.Set(signatureHeader, signWebhook(secret, time.Now(), body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return webhookStatusError{code: resp.StatusCode}
+	}
+	return nil
+}
+
+// signWebhook returns the signature header of a webhook request sent at t with
+// the given body.
+func signWebhook(secret []byte, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// retryable reports whether a failed delivery may succeed if attempted again.
+// Other client errors than timeouts and rate limiting won't.
+func retryable(err error) bool {
+	var statusErr webhookStatusError
+	if !errors.As(err, &statusErr) {
+		return true
+	}
+	code := statusErr.code
+	return code >= 500 || code == http.StatusRequestTimeout || code == http.StatusTooManyRequests
+}
+
+// webhookDelay returns how long to wait after the given failed attempt, counting from 1.
+func webhookDelay(attempt int) time.Duration {
+	d := maxWebhookBackoff
+	if attempt <= 16 {
+		if d = webhookBackoff << (attempt - 1); d > maxWebhookBackoff {
+			d = maxWebhookBackoff
+		}
+	}
+	return d
+}
+
+// deadLetter records an event that couldn't be delivered to a webhook URL.
+func (c WebhooksConfig) deadLetter(u string, event webhookEvent, attempts int, err error) {
+	webhookFailures.inc()
+	logger.WithError(err).WithFields(logrus.Fields{
+		"url":      u,
+		"event":    event.Type,
+		"delivery": event.ID,
+		"room":     event.Room,
+		"attempts": attempts,
+	}).Error("Giving up on webhook delivery")
+
+	if c.DeadLetterFile == "" {
+		return
+	}
+	line, err := json.Marshal(deadLetter{Time: time.Now().UTC(), URL: u, Attempts: attempts, Error: err.Error(), Event: event})
+	if err != nil {
+		return
+	}
+
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+	f, err := os.OpenFile(c.DeadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		logger.WithError(err).Error("Failed to open the webhook dead-letter file")
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		logger.WithError(err).Error("Failed to write to the webhook dead-letter file")
+	}
+}
+
+// waitWebhooks waits for the deliveries in progress to end, until ctx is done.
+func waitWebhooks(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		webhookDeliveries.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		if pending := atomic.LoadInt32(&pendingWebhooks); pending > 0 {
+			logger.WithField("pending", pending).Warn("Shutting down before delivering every webhook")
+		}
+	}
+}
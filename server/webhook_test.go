@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// A receivedHook is a webhook request received by a test receiver.
+type receivedHook struct {
+	event     webhookEvent
+	signature string
+	body      []byte
+}
+
+// newWebhookReceiver starts a server receiving webhooks, answering the nth
+// request, counting from 1, with status(n). It sends the requests it answered
+// with a 2xx status to the returned channel.
+func newWebhookReceiver(t *testing.T, status func(n int32) int) (*httptest.Server, <-chan receivedHook) {
+	hooks := make(chan receivedHook, 100)
+	var n int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		code := status(atomic.AddInt32(&n, 1))
+		w.WriteHeader(code)
+		if code/100 != 2 {
+			return
+		}
+		var event webhookEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("Failed to decode webhook: %v", err)
+		}
+		hooks <- receivedHook{event: event, signature: r.Header.Get(signatureHeader), body: body}
+	}))
+	t.Cleanup(server.Close)
+	return server, hooks
+}
+
+// withWebhooks sends webhooks as given by cfg, signed with secret, for the
+// duration of a test, retrying without delay.
+func withWebhooks(t *testing.T, cfg WebhooksConfig, secret string) {
+	original, originalSecret, originalBackoff := webhooks, webhookSecret, webhookBackoff
+	webhooks, webhookSecret, webhookBackoff = cfg, []byte(secret), time.Millisecond
+	t.Cleanup(func() {
+		webhookDeliveries.Wait()
+		webhooks, webhookSecret, webhookBackoff = original, originalSecret, originalBackoff
+	})
+}
+
+// waitHook returns the next webhook of the given type about room.
+func waitHook(t *testing.T, hooks <-chan receivedHook, eventType, room string) receivedHook {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case hook := <-hooks:
+			if hook.event.Type == eventType && hook.event.Room == room {
+				return hook
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for a %s webhook", eventType)
+		}
+	}
+}
+
+func TestWebhookEvents(t *testing.T) {
+	withOpenAPI(t)
+	receiver, hooks := newWebhookReceiver(t, func(int32) int { return http.StatusNoContent })
+	withWebhooks(t, WebhooksConfig{URLs: []string{receiver.URL}, MaxAttempts: 1}, "secret")
+
+	name := uuid.New().String()
+	room, err := createRoom(name, "hello")
+	if err != nil {
+		t.Fatalf("Failed to create room: %v", err)
+	}
+	created := waitHook(t, hooks, eventRoomCreated, name)
+	if created.event.RoomID != room.ID || created.event.ID == "" {
+		t.Errorf("Unexpected event: %+v", created.event)
+	}
+
+	// The signature is an HMAC of the timestamp and the body.
+	parts := strings.Split(created.signature, ",")
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(strings.TrimPrefix(parts[0], "t=") + "."))
+	mac.Write(created.body)
+	if len(parts) != 2 || parts[1] != "v1="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("Invalid signature %q", created.signature)
+	}
+
+	id := uuid.New()
+	room.join(id, "alice")
+	if joined := waitHook(t, hooks, eventUserJoined, name); joined.event.Data["username"] != "alice" || joined.event.Data["client"] != id.String() {
+		t.Errorf("Unexpected join event data: %+v", joined.event.Data)
+	}
+
+	server := httptest.NewServer(newMux())
+	defer server.Close()
+	req, _ := http.NewRequest(http.MethodPut, server.URL+"/rooms/"+name+"/content", strings.NewReader("bye"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to upload content: %v", err)
+	}
+	resp.Body.Close()
+	if saved := waitHook(t, hooks, eventContentSaved, name); saved.event.Data["source"] != "upload" {
+		t.Errorf("Unexpected save event data: %+v", saved.event.Data)
+	}
+
+	if err := deleteRoom(name, ""); err != nil {
+		t.Fatalf("Failed to delete room: %v", err)
+	}
+	waitHook(t, hooks, eventRoomClosed, name)
+}
+
+func TestWebhookRetries(t *testing.T) {
+	deadLetters := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+
+	tests := []struct {
+		description string
+		status      func(n int32) int
+		attempts    int
+		delivered   bool
+	}{
+		{
+			description: "retried until delivered",
+			status: func(n int32) int {
+				if n < 3 {
+					return http.StatusServiceUnavailable
+				}
+				return http.StatusOK
+			},
+			delivered: true,
+		},
+		{
+			description: "attempts exhausted",
+			status:      func(int32) int { return http.StatusInternalServerError },
+			attempts:    4,
+		},
+		{
+			description: "not retried",
+			status:      func(int32) int { return http.StatusBadRequest },
+			attempts:    1,
+		},
+		{
+			description: "rate limited",
+			status: func(n int32) int {
+				if n == 1 {
+					return http.StatusTooManyRequests
+				}
+				return http.StatusAccepted
+			},
+			delivered: true,
+		},
+	}
+
+	for _, tc := range tests {
+		receiver, hooks := newWebhookReceiver(t, tc.status)
+		withWebhooks(t, WebhooksConfig{URLs: []string{receiver.URL}, MaxAttempts: 4, DeadLetterFile: deadLetters}, "secret")
+		_ = os.Remove(deadLetters)
+
+		room := NewRoom()
+		room.emitEvent(eventRoomCreated, nil)
+		webhookDeliveries.Wait()
+
+		if delivered := len(hooks) == 1; delivered != tc.delivered {
+			t.Errorf("(%s) expected delivered to be %t, got %t", tc.description, tc.delivered, delivered)
+		}
+
+		f, err := os.Open(deadLetters)
+		if tc.delivered {
+			if err == nil {
+				f.Close()
+				t.Errorf("(%s) expected no dead letter", tc.description)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("(%s) expected a dead letter: %v", tc.description, err)
+			continue
+		}
+		var letter deadLetter
+		scanner := bufio.NewScanner(f)
+		if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &letter) != nil {
+			t.Errorf("(%s) failed to read the dead letter", tc.description)
+		} else if letter.Attempts != tc.attempts || letter.URL != receiver.URL || letter.Event.RoomID != room.ID {
+			t.Errorf("(%s) unexpected dead letter: %+v", tc.description, letter)
+		}
+		f.Close()
+	}
+}
+
+func TestWebhookDelay(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{attempt: 1, want: time.Second},
+		{attempt: 2, want: 2 * time.Second},
+		{attempt: 5, want: 16 * time.Second},
+		{attempt: 10, want: maxWebhookBackoff},
+		{attempt: 100, want: maxWebhookBackoff},
+	}
+
+	for _, tc := range tests {
+		if got := webhookDelay(tc.attempt); got != tc.want {
+			t.Errorf("(attempt %d) expected %s, got %s", tc.attempt, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// The web client is built into the server binary: `yarn build` in client-web
+// writes its assets to webui/dist, which is embedded when the server is built.
+// They are served on every path the server doesn't otherwise handle, and paths
+// which aren't files, like /edit, are the client's own routes, so they are
+// served index.html for the client to route.
+
+//go:embed webui
+var webuiFiles embed.FS
+
+// webAssets holds the built web client. It is empty if the server was built
+// without it.
+var webAssets = mustSub(webuiFiles, "webui/dist")
+
+// webuiMissing is served in place of the web client when it isn't built in.
+const webuiMissing = `<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="UTF-8"><title>coDpen</title></head>
+<body>
+<p>This server was built without the web client. Run <code>yarn build</code> in
+<code>client-web</code>, then build the server again.</p>
+<p>The terminal client can still connect to <code>/ws</code>.</p>
+</body>
+</html>
+`
+
+// mustSub returns the subtree of fsys at dir, which must be a valid path.
+func mustSub(fsys fs.FS, dir string) fs.FS {
+	sub, err := fs.Sub(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+// serveWebClient serves the web client's file at the request's path, or its
+// index.html for paths which are routes of the client.
+func serveWebClient(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowed(w, http.MethodGet, http.MethodHead)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name != "" && name != "index.html" {
+		if content, err := fs.ReadFile(webAssets, name); err == nil {
+			// Vite names bundled assets after their content, so they never change.
+			if strings.HasPrefix(name, "assets/") {
+				w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+			}
+			http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(content))
+			return
+		}
+		// Missing files are not found, rather than answered with the client.
+		if path.Ext(name) != "" {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	index, err := fs.ReadFile(webAssets, "index.html")
+	if err != nil {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(webuiMissing))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "index.html", time.Time{}, bytes.NewReader(index))
+}